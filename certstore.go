@@ -1,49 +1,2500 @@
 package certstore
 
 import (
+	"bytes"
+	"context"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
 	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
 	// ErrUnsupportedHash is returned by Signer.Sign() when the provided hash
 	// algorithm isn't supported.
 	ErrUnsupportedHash = errors.New("unsupported hash algorithm")
+
+	// ErrUnsupportedOperation is returned when an operation isn't supported
+	// for a given identity or on the current platform.
+	ErrUnsupportedOperation = errors.New("unsupported operation")
+
+	// ErrNotImplemented is returned when an operation isn't implemented on
+	// the current platform yet. It wraps ErrUnsupportedOperation, so callers
+	// falling back on ErrUnsupportedOperation handle both.
+	ErrNotImplemented = fmt.Errorf("not implemented: %w", ErrUnsupportedOperation)
+
+	// ErrNotFound is returned when a requested identity can't be found. It may
+	// be wrapped with details of the lookup, so use errors.Is to check for it.
+	// Enumerating an empty store isn't an error.
+	ErrNotFound = errors.New("identity not found")
+
+	// ErrNotExportable is returned when exporting a private key that was not
+	// marked as exportable.
+	ErrNotExportable = errors.New("private key is not exportable")
+
+	// ErrNoPrivateKey is returned when an identity's private key is missing or
+	// can't be loaded.
+	ErrNoPrivateKey = errors.New("identity has no usable private key")
+
+	// ErrPSSUnsupportedByProvider is returned when signing with
+	// *rsa.PSSOptions using a key whose provider can't produce RSA-PSS
+	// signatures (e.g. older smart cards). On Windows, keys loaded through
+	// CryptoAPI are reacquired through CNG for PSS, and this is returned if
+	// that isn't possible. On macOS, it's returned for salt lengths other
+	// than the hash size. There is no software fallback, since the private key
+	// can't leave the provider.
+	ErrPSSUnsupportedByProvider = errors.New("key provider does not support RSA-PSS")
+
+	// ErrPartialChain is returned, wrapped, by Identity.CertificateChain
+	// along with the certificates found when the chain couldn't be built up
+	// to a root (e.g. because an intermediate isn't installed).
+	// Identity.CompleteChain can be used to fetch the missing certificates.
+	ErrPartialChain = errors.New("certificate chain is incomplete")
+
+	// ErrClosed is returned when using a store or identity that has been
+	// closed.
+	ErrClosed = errors.New("store or identity is closed")
+
+	// ErrNoIdentities is returned by RequireIdentities and FirstIdentity when
+	// the store was enumerated successfully but doesn't contain any identities.
+	// It is never returned for a failed enumeration.
+	ErrNoIdentities = errors.New("no identities in store")
+
+	// ErrSmartCardFull is returned when a smart card doesn't have space for
+	// another key or certificate.
+	ErrSmartCardFull = errors.New("smart card is full")
+
+	// ErrIncorrectPIN is returned when a smart card PIN is wrong or the card
+	// is blocked after too many incorrect attempts.
+	ErrIncorrectPIN = errors.New("incorrect or blocked PIN")
+
+	// ErrPINCancelled is returned when the user cancels a PIN prompt.
+	ErrPINCancelled = errors.New("PIN entry cancelled by user")
+
+	// ErrPermissionDenied is returned when the user isn't allowed to use a
+	// key (e.g. a machine key without the right ACL).
+	ErrPermissionDenied = errors.New("permission denied for key")
+
+	// ErrSilentPINRequired is returned when OpenOptions.Silent is set but the
+	// key provider needs to prompt the user, usually for a PIN.
+	ErrSilentPINRequired = errors.New("key provider requires user interaction in silent mode")
+
+	// ErrNoSmartCard is returned when a key's smart card isn't inserted or
+	// was removed.
+	ErrNoSmartCard = errors.New("smart card not present")
 )
 
 // Open opens the system's certificate store.
 func Open() (Store, error) {
-	return openStore()
+	return OpenWithOptions(OpenOptions{})
+}
+
+// OpenWithOptions opens the system's certificate store with the given options.
+func OpenWithOptions(opts OpenOptions) (_ Store, err error) {
+	defer trace("certstore.Open")(&err)
+
+	s, err := openStore(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// ImportEphemeral loads a PKCS#12 (PFX) blob into a temporary, in-memory store
+// rather than the system store. Private keys are never persisted, so the
+// identities only live until the returned Store is closed. This suits
+// short-lived signing tasks (e.g. in CI) that shouldn't touch the user's
+// store. It is only supported on Windows.
+func ImportEphemeral(data []byte, password string) (_ Store, err error) {
+	defer trace("certstore.Open")(&err)
+
+	s, err := importEphemeral(data, password)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// OpenAll opens the system's certificate stores at each of the given locations
+// and merges them into a single Store. Identities found in more than one store
+// (by thumbprint) are only returned once, from the first location listed. If no
+// locations are given, those searched by ResolveIdentity are opened. Import and
+// ImportWithOptions import into the first location. Closing the returned Store
+// closes every underlying store.
+func OpenAll(locations ...StoreLocation) (_ Store, err error) {
+	defer trace("certstore.Open")(&err)
+
+	if len(locations) == 0 {
+		locations = resolveLocations
+	}
+
+	ms := &multiStore{stores: make([]Store, 0, len(locations))}
+
+	for _, location := range locations {
+		s, err := openStore(OpenOptions{Location: location})
+		if err != nil {
+			ms.Close()
+			return nil, fmt.Errorf("failed to open %s store: %w", location, err)
+		}
+
+		ms.stores = append(ms.stores, s)
+	}
+
+	return ms, nil
+}
+
+// multiStore implements the Store interface for OpenAll, merging several
+// underlying stores.
+type multiStore struct {
+	stores []Store
+}
+
+// Identities implements the Store interface.
+func (ms *multiStore) Identities() (_ []Identity, err error) {
+	defer trace("certstore.Identities")(&err)
+
+	var (
+		seen   = map[string]bool{}
+		idents = []Identity{}
+	)
+
+	for _, s := range ms.stores {
+		storeIdents, err := s.Identities()
+		if err != nil {
+			closeIdentities(idents)
+			return nil, err
+		}
+
+		for _, ident := range storeIdents {
+			tp, err := ident.Thumbprint()
+			if err != nil {
+				closeIdentities(idents)
+				closeIdentities(storeIdents)
+				return nil, err
+			}
+
+			if key := string(tp); seen[key] {
+				ident.Close()
+			} else {
+				seen[key] = true
+				idents = append(idents, ident)
+			}
+		}
+	}
+
+	return idents, nil
+}
+
+// closeIdentities closes each of the identities.
+func closeIdentities(idents []Identity) {
+	for _, ident := range idents {
+		ident.Close()
+	}
+}
+
+// Import implements the Store interface.
+func (ms *multiStore) Import(data []byte, password string) error {
+	return ms.stores[0].Import(data, password)
+}
+
+// ImportWithOptions implements the Store interface.
+func (ms *multiStore) ImportWithOptions(data []byte, password string, opts ImportOptions) error {
+	return ms.stores[0].ImportWithOptions(data, password, opts)
+}
+
+// FindRenewalOf implements the Store interface.
+func (ms *multiStore) FindRenewalOf(cert *x509.Certificate) (Identity, error) {
+	return findRenewalOf(ms, cert)
+}
+
+// ExportTrustAnchors implements the Store interface.
+func (ms *multiStore) ExportTrustAnchors() ([]*x509.Certificate, error) {
+	var anchors []*x509.Certificate
+
+	for _, s := range ms.stores {
+		certs, err := s.ExportTrustAnchors()
+		if err != nil {
+			return nil, err
+		}
+
+		anchors = append(anchors, certs...)
+	}
+
+	return dedupCertificates(anchors), nil
+}
+
+// Close implements the Store interface.
+func (ms *multiStore) Close() {
+	for _, s := range ms.stores {
+		s.Close()
+	}
+}
+
+// Tracer records spans around store operations, so that operators can see
+// where time goes (e.g. in a slow hardware sign during a TLS handshake). Spans
+// are recorded for "certstore.Open", "certstore.Identities",
+// "certstore.AcquireKey" and "certstore.Sign". An OpenTelemetry tracer can be
+// adapted to this interface without the package depending on OpenTelemetry.
+type Tracer interface {
+	// StartSpan starts a span for the named operation. The returned function
+	// ends the span and is passed the operation's error, which is nil on
+	// success.
+	StartSpan(name string) (end func(err error))
+}
+
+// tracer holds a tracerHolder for the Tracer set with SetTracer.
+var tracer atomic.Value
+
+// tracerHolder lets a nil Tracer be stored in an atomic.Value.
+type tracerHolder struct {
+	Tracer
+}
+
+// SetTracer sets the Tracer used to record spans. By default, no spans are
+// recorded. Passing nil disables tracing again.
+func SetTracer(t Tracer) {
+	tracer.Store(tracerHolder{t})
+}
+
+// trace starts a span for the named operation. The returned function ends the
+// span with the error pointed to, and is meant to be deferred with a pointer to
+// a named error result:
+//
+//	defer trace("certstore.Sign")(&err)
+func trace(name string) func(errp *error) {
+	holder, _ := tracer.Load().(tracerHolder)
+	if holder.Tracer == nil {
+		return func(*error) {}
+	}
+
+	end := holder.StartSpan(name)
+
+	return func(errp *error) {
+		end(*errp)
+	}
+}
+
+// OpenOptions configures OpenWithOptions. The zero value opens the same store
+// as Open.
+type OpenOptions struct {
+	// PINCache controls PIN caching for smart card keys used by the store's
+	// identities. It is only honored by the Microsoft Smart Card KSP on Windows
+	// 8 and later. Other providers, including the TPM platform crypto provider
+	// and CryptoAPI CSPs, silently ignore it.
+	PINCache PINCacheMode
+
+	// Location selects which store to open. It is only honored on Windows.
+	Location StoreLocation
+
+	// StoreName is the name of the system store to open at Location (e.g.
+	// "WebHosting"). It defaults to "MY", the personal store. A name that is
+	// blank or contains NUL characters is rejected rather than falling back to
+	// the default. It is only honored on Windows.
+	StoreName string
+
+	// StoreProvider selects the CryptoAPI store provider used to open
+	// StoreName. It defaults to the system store provider. It is only honored
+	// on Windows.
+	StoreProvider StoreProvider
+
+	// IncludeArchived includes archived certificates when enumerating
+	// identities. Archived certificates (e.g. ones superseded by renewal) are
+	// normally hidden, so they are excluded from selection unless this is set.
+	// It is only honored on Windows.
+	IncludeArchived bool
+
+	// Revocation controls revocation checking by Identity.VerifyForUsage. It
+	// is only honored on Windows.
+	Revocation RevocationMode
+
+	// Intermediates are extra CA certificates used to complete identities'
+	// certificate chains when the store doesn't hold them. It is only used on
+	// Linux, where tokens often hold just the leaf certificate.
+	Intermediates []*x509.Certificate
+
+	// PKCS11 configures the PKCS#11 token used as the store. It is only used
+	// on Linux.
+	PKCS11 PKCS11Options
+
+	// Reader pins smart card keys to the card in the named reader (e.g.
+	// "Identiv uTrust 3700 F CL Reader 0"). When several readers hold a card
+	// with the same certificate, this makes which card signs deterministic.
+	// Signer returns an error wrapping ErrNotFound if the named reader has no
+	// card with the identity's key. It is only honored on Windows, for keys
+	// held by a CNG key storage provider.
+	Reader string
+
+	// KeyStorage chooses between CryptoAPI and CNG for the store's keys and
+	// for keys imported into it. It is only used on Windows.
+	KeyStorage KeyStoragePreference
+
+	// Silent stops key providers from showing UI (e.g. a PIN dialog) while
+	// acquiring keys, signing or decrypting, so that headless services don't
+	// hang on a modal prompt. If the provider needs to prompt, the operation
+	// fails with an error wrapping ErrSilentPINRequired instead. It is only
+	// used on Windows.
+	Silent bool
+
+	// Logger, if set, receives a debug message for each major native call
+	// (opening the store, acquiring a key and signing) with the flags it was
+	// made with and the resulting error code. This helps diagnose failures
+	// that only happen on particular machines. It is only used on Windows.
+	Logger Logger
+
+	// Retry retries signing when a smart card fails with an error that may
+	// clear up on its own, such as the card being reset by another process or
+	// briefly losing contact. Other errors fail immediately. By default,
+	// signing isn't retried. It is only used on Windows.
+	Retry RetryPolicy
+}
+
+// RetryPolicy configures retries of operations failing with transient smart
+// card errors.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first. Zero
+	// or one disables retries.
+	MaxAttempts int
+
+	// Delay is how long to wait between attempts.
+	Delay time.Duration
+}
+
+// retrySign calls sign until it succeeds, fails with an error that
+// isTransient rejects, or the policy's attempts run out.
+func retrySign(p RetryPolicy, isTransient func(error) bool, sign func() ([]byte, error)) ([]byte, error) {
+	for attempt := 1; ; attempt++ {
+		sig, err := sign()
+		if err == nil || attempt >= p.MaxAttempts || !isTransient(err) {
+			return sig, err
+		}
+
+		time.Sleep(p.Delay)
+	}
+}
+
+// Logger receives debug messages from a store. *log.Logger implements it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// logf sends a debug message to l, if it is set.
+func logf(l Logger, format string, v ...interface{}) {
+	if l != nil {
+		l.Printf(format, v...)
+	}
+}
+
+// KeyStoragePreference chooses between the Windows CryptoAPI and CNG key
+// storage APIs.
+type KeyStoragePreference int
+
+const (
+	// KeyStorageAuto prefers CNG.
+	KeyStorageAuto KeyStoragePreference = iota
+
+	// KeyStoragePreferCAPI prefers CryptoAPI, using CNG for keys that are
+	// only available through it.
+	KeyStoragePreferCAPI
+
+	// KeyStoragePreferCNG prefers CNG, using CryptoAPI for keys that are only
+	// available through it.
+	KeyStoragePreferCNG
+
+	// KeyStorageOnlyCNG only uses CNG.
+	KeyStorageOnlyCNG
+)
+
+// PKCS11Options configures the PKCS#11 module and token used as the store on
+// Linux. Empty fields fall back to the PKCS11_MODULE, PKCS11_SLOT,
+// PKCS11_TOKEN_LABEL and PKCS11_PIN environment variables.
+type PKCS11Options struct {
+	// ModulePath is the path of the PKCS#11 module to load. It defaults to
+	// the OpenSC module if it isn't set here or in PKCS11_MODULE.
+	ModulePath string
+
+	// Slot selects the token by slot number.
+	Slot *int
+
+	// TokenLabel selects the token by label, as an alternative to Slot.
+	TokenLabel string
+
+	// PIN is the user PIN used to log in to the token. Some HSMs only expose
+	// private keys after login, so identities may be missing without it.
+	PIN string
+
+	// PINFunc is called to prompt for the PIN when PIN and PKCS11_PIN are
+	// both empty, so that the PIN needn't be held in memory up front.
+	PINFunc func() (string, error)
+}
+
+// StoreLocation selects between the current user's and the machine's
+// certificate stores.
+type StoreLocation int
+
+const (
+	// StoreLocationCurrentUser is the current user's store (CurrentUser/MY on
+	// Windows).
+	StoreLocationCurrentUser StoreLocation = iota
+
+	// StoreLocationLocalMachine is the machine-wide store (LocalMachine/MY on
+	// Windows). Opening it may require administrator privileges.
+	StoreLocationLocalMachine
+)
+
+// String implements the fmt.Stringer interface.
+func (l StoreLocation) String() string {
+	switch l {
+	case StoreLocationCurrentUser:
+		return "CurrentUser"
+	case StoreLocationLocalMachine:
+		return "LocalMachine"
+	default:
+		return fmt.Sprintf("StoreLocation(%d)", int(l))
+	}
+}
+
+// StoreProvider selects the CryptoAPI store provider used to open a store on
+// Windows. Certificates for keys held by smart card and virtual smart card KSPs
+// are added to the system MY store by certificate propagation, so they are
+// found with the default provider. Use OpenOptions.Reader to pin their keys to a
+// particular reader.
+type StoreProvider int
+
+const (
+	// StoreProviderSystem opens a system store (CERT_STORE_PROV_SYSTEM_W). This
+	// is a collection of the store's physical stores, including ones set by
+	// group policy. This is the default.
+	StoreProviderSystem StoreProvider = iota
+
+	// StoreProviderSystemRegistry opens just the registry-backed part of a
+	// system store (CERT_STORE_PROV_SYSTEM_REGISTRY_W), leaving out its other
+	// physical stores.
+	StoreProviderSystemRegistry
+
+	// StoreProviderPhysical opens a single physical store
+	// (CERT_STORE_PROV_PHYSICAL_W). OpenOptions.StoreName must be set to the
+	// system and physical store names separated by a backslash, e.g.
+	// `MY\.Default` or `Root\.GroupPolicy`.
+	StoreProviderPhysical
+)
+
+// String implements the fmt.Stringer interface.
+func (p StoreProvider) String() string {
+	switch p {
+	case StoreProviderSystem:
+		return "System"
+	case StoreProviderSystemRegistry:
+		return "SystemRegistry"
+	case StoreProviderPhysical:
+		return "Physical"
+	default:
+		return fmt.Sprintf("StoreProvider(%d)", int(p))
+	}
 }
 
+// RevocationMode controls how certificate revocation is checked when verifying
+// a chain.
+type RevocationMode int
+
+const (
+	// RevocationNone doesn't check revocation.
+	RevocationNone RevocationMode = iota
+
+	// RevocationCacheOnly checks revocation using only CRLs and OCSP
+	// responses already cached by the system, never going to the network.
+	// This keeps verification fast enough for latency sensitive paths like a
+	// TLS handshake, at the cost of freshness: a recently revoked certificate
+	// passes if the cache predates its revocation, and verification fails if
+	// nothing is cached for an issuer.
+	RevocationCacheOnly
+
+	// RevocationOnline checks revocation, fetching CRLs and OCSP responses
+	// over the network as needed.
+	RevocationOnline
+)
+
+// PINCacheMode controls whether a smart card PIN is cached after it is
+// entered.
+type PINCacheMode int
+
+const (
+	// PINCacheDefault leaves PIN caching up to the provider.
+	PINCacheDefault PINCacheMode = iota
+
+	// PINCacheEnabled asks the provider to cache the PIN, so that a process
+	// signing repeatedly with the same key only prompts once.
+	PINCacheEnabled
+
+	// PINCacheDisabled asks the provider not to cache the PIN.
+	PINCacheDisabled
+)
+
 // Store represents the system's certificate store.
+//
+// A Store is safe for concurrent use by multiple goroutines. Each call to
+// Identities enumerates the store with its own cursor, and Close waits for
+// in-flight enumerations and imports to finish. Later calls return ErrClosed,
+// except on macOS, where Close is a no-op. Identities aren't safe for
+// concurrent use, so use Identity.Clone to hand one to another goroutine.
 type Store interface {
-	// Identities gets a list of identities from the store.
+	// Identities gets a list of identities from the store. An empty store
+	// yields an empty slice and a nil error. Use RequireIdentities to treat an
+	// empty store as an error.
 	Identities() ([]Identity, error)
 
 	// Import imports a PKCS#12 (PFX) blob containing a certificate and private
 	// key.
 	Import(data []byte, password string) error
 
+	// ImportWithOptions is like Import, but allows the import to be
+	// customized.
+	ImportWithOptions(data []byte, password string, opts ImportOptions) error
+
+	// FindRenewalOf finds an identity for a renewed version of the given
+	// certificate. That is, one with the same subject and key but a more recent
+	// NotBefore. ErrNotFound is returned if there is no newer certificate.
+	FindRenewalOf(cert *x509.Certificate) (Identity, error)
+
+	// ExportTrustAnchors gets the platform's trusted root certificates, so
+	// that an x509.CertPool mirroring the system's trust can be built for
+	// offline verification. Duplicates are removed.
+	ExportTrustAnchors() ([]*x509.Certificate, error)
+
 	// Close closes the store.
 	Close()
 }
 
+// ImportOptions configures Store.ImportWithOptions. The zero value behaves
+// like Store.Import.
+type ImportOptions struct {
+	// SmartCard writes the private key and certificate to a smart card instead
+	// of the software certificate store. The card's minidriver must support
+	// writing keys and certificates. Notably, the PIV minidriver built into
+	// Windows is read-only, so PIV cards need a vendor minidriver (e.g. the
+	// YubiKey minidriver). Windows' certificate propagation service adds the
+	// certificate to the user's personal store once it is on the card.
+	//
+	// ErrSmartCardFull is returned if the card has no space left, while
+	// ErrIncorrectPIN and ErrPINCancelled are returned for PIN failures. This
+	// is only supported on Windows.
+	SmartCard bool
+
+	// Exportable marks the imported private keys as exportable, so they can be
+	// exported from the store again later. This makes keys easier to
+	// round-trip, but any process running as the user can then copy them off
+	// the machine, so keys are non-exportable by default. This is only
+	// supported on Windows and is ignored for smart card imports.
+	Exportable bool
+
+	// InstallCACertificates adds the CA certificates from the PFX (those
+	// without a private key) to the intermediate "CA" store of the same
+	// location, so that chains can be built. Otherwise they are skipped, as
+	// only certificates with a private key are imported into the store. This
+	// is only supported on Windows and is ignored for smart card imports.
+	InstallCACertificates bool
+
+	// Reader names the smart card reader holding the card to import onto. If
+	// empty, the smart card provider picks the card (prompting if there are
+	// several). It is ignored unless SmartCard is set.
+	Reader string
+
+	// FriendlyName labels the imported certificates, as shown by the Windows
+	// certificate manager and returned by Identity.DisplayName. It is only
+	// supported on Windows and is ignored for smart card imports.
+	FriendlyName string
+}
+
 // Identity is a X.509 certificate and its corresponding private key.
+//
+// Every platform implements the same method set, so code using Identity builds
+// everywhere without build tags of its own. Methods a platform can't support
+// return ErrUnsupportedOperation.
 type Identity interface {
 	// Certificate gets the identity's certificate.
 	Certificate() (*x509.Certificate, error)
 
-	// CertificateChain attempts to get the identity's full certificate chain.
+	// CertificateChain attempts to get the identity's full certificate chain,
+	// leaf first. If the chain can't be built up to a root, the partial chain
+	// is returned along with an error wrapping ErrPartialChain.
 	CertificateChain() ([]*x509.Certificate, error)
 
-	// Signer gets a crypto.Signer that uses the identity's private key.
+	// Signer gets a crypto.Signer that uses the identity's private key. The
+	// signer is owned by the identity and repeated calls return the same
+	// signer. It must not be used once the identity is closed. On Windows,
+	// where closing releases the key handle, doing so returns ErrClosed.
 	Signer() (crypto.Signer, error)
 
-	// Delete deletes this identity from the system.
+	// Delete deletes this identity from the system. The certificate is
+	// removed from the store and its private key is destroyed, so this can't
+	// be undone. The Identity must still be closed afterwards.
 	Delete() error
 
-	// Close any manually managed memory held by the Identity.
+	// Close any manually managed memory held by the Identity (e.g. certificate
+	// contexts and key handles). It doesn't modify the store, and the identity
+	// can't be used afterwards.
 	Close()
+
+	// Clone returns a new Identity referring to the same certificate and key.
+	// The clone is independent of the original: each must be Close()'ed by its
+	// owner and closing one doesn't affect the other. This allows an identity
+	// to be handed off to another goroutine safely.
+	Clone() (Identity, error)
+
+	// ReaderName gets the name of the smart card reader holding the identity's
+	// private key. ErrUnsupportedOperation is returned if the key isn't on a
+	// smart card.
+	ReaderName() (string, error)
+
+	// KeyProviderInfo gets information about the provider holding the
+	// identity's private key. ErrUnsupportedOperation is returned on platforms
+	// without named key providers.
+	KeyProviderInfo() (ProviderInfo, error)
+
+	// SPKIFingerprint gets the SHA-256 hash of the identity's DER encoded
+	// SubjectPublicKeyInfo. Unlike the certificate thumbprint, this stays the
+	// same when a certificate is renewed with the same key, so it is suitable
+	// for key pinning (e.g. HPKP).
+	SPKIFingerprint() ([]byte, error)
+
+	// VerifyForUsage builds the identity's certificate chain requiring the
+	// given extended key usages (e.g. "1.3.6.1.5.5.7.3.2" for client auth) and
+	// checks it against the platform's chain policy. On Windows this uses the
+	// CryptoAPI policy engine, which may disagree with Go's x509 verifier.
+	// ErrUnsupportedOperation is returned on other platforms.
+	VerifyForUsage(usageOIDs []string) error
+
+	// ExportCER gets the identity's certificate in DER form, as in a binary
+	// .cer file. Use EncodeCERBase64 for the base64 .cer form.
+	ExportCER() ([]byte, error)
+
+	// SameKeyAs checks whether this identity and other share a private key,
+	// e.g. because a certificate was renewed without rotating its key. This
+	// compares the certificates' SubjectPublicKeyInfo. ErrClosed is returned
+	// if either identity is closed.
+	SameKeyAs(other Identity) (bool, error)
+
+	// CAIssuersURLs gets the caIssuers URLs from the certificate's Authority
+	// Information Access extension. These can be used to fetch intermediates
+	// missing from the store. An empty slice is returned if there are none.
+	CAIssuersURLs() ([]string, error)
+
+	// CompleteChain gets the identity's certificate chain, following AIA
+	// caIssuers URLs to fetch any missing intermediates. The fetcher is
+	// provided by the caller, so that this package doesn't depend on
+	// net/http. Fetched certificates may be DER or PEM encoded. The chain
+	// ends at a self-signed certificate or a certificate without caIssuers
+	// URLs. If fetching fails, the partial chain is returned along with the
+	// error.
+	CompleteChain(ctx context.Context, fetch func(ctx context.Context, url string) ([]byte, error)) ([]*x509.Certificate, error)
+
+	// MustStaple checks whether the certificate has a TLS Feature extension
+	// (RFC 7633) requiring status_request, i.e. OCSP must-staple. Servers
+	// presenting such a certificate must staple an OCSP response or clients
+	// will reject it. False is returned if the extension is absent.
+	MustStaple() (bool, error)
+
+	// SetArchived archives or unarchives the identity's certificate. Archived
+	// certificates are hidden from enumeration unless
+	// OpenOptions.IncludeArchived is set. ErrUnsupportedOperation is returned
+	// on platforms other than Windows.
+	SetArchived(archived bool) error
+
+	// ExportPFX exports the identity's certificate and private key as a
+	// PKCS#12 (PFX) blob encrypted with password, e.g. to back up or migrate a
+	// key. Only exportable keys (see ImportOptions.Exportable) can be
+	// exported, and ErrNotExportable is returned for others. This is only
+	// supported on Windows.
+	ExportPFX(password string) ([]byte, error)
+
+	// KeyInfo gets the type and size of the identity's key from its
+	// certificate, without using the private key. This helps choose between
+	// e.g. RSA-PSS and PKCS#1 v1.5 up front. On Windows, if a CNG key has
+	// already been acquired, its algorithm and length are cross-checked
+	// against the certificate.
+	KeyInfo() (KeyInfo, error)
+
+	// DisplayName gets a human-friendly label for the identity, e.g. for a
+	// certificate picker. This is the certificate's friendly name on Windows
+	// and the key's CKA_LABEL on Linux, where set. Otherwise, it is the
+	// certificate's subject common name, or the whole subject if that is
+	// empty.
+	DisplayName() (string, error)
+
+	// Thumbprint gets the SHA-1 hash of the identity's DER encoded
+	// certificate, as displayed by the Windows certificate manager. It is a
+	// stable key for comparing identities, e.g. from different stores.
+	Thumbprint() ([]byte, error)
+
+	// ThumbprintSHA256 is like Thumbprint, but uses SHA-256.
+	ThumbprintSHA256() ([]byte, error)
+
+	// Capabilities reports which operations the identity's private key
+	// supports, so that callers can pick a suitable key up front rather than
+	// finding out from a failed Sign. The key type and the certificate's
+	// KeyUsage extension are checked everywhere. On Windows, the private key
+	// is also acquired so that its provider's usage restrictions and algorithm
+	// group (e.g. ECDH-only keys) are taken into account.
+	Capabilities() (KeyCapabilities, error)
+}
+
+// KeyCapabilities reports the operations an identity's private key supports.
+type KeyCapabilities struct {
+	// Sign is set if the key can sign.
+	Sign bool
+
+	// Decrypt is set if the key can decrypt data encrypted to it.
+	Decrypt bool
+
+	// KeyAgreement is set if the key can be used for key agreement (ECDH).
+	KeyAgreement bool
+}
+
+// certCapabilities gets the operations a certificate's key type and KeyUsage
+// extension allow. A certificate without a KeyUsage extension doesn't restrict
+// its key.
+func certCapabilities(crt *x509.Certificate) KeyCapabilities {
+	var caps KeyCapabilities
+
+	switch crt.PublicKey.(type) {
+	case *rsa.PublicKey:
+		caps = KeyCapabilities{Sign: true, Decrypt: true}
+	case *ecdsa.PublicKey:
+		caps = KeyCapabilities{Sign: true, KeyAgreement: true}
+	case ed25519.PublicKey:
+		caps = KeyCapabilities{Sign: true}
+	}
+
+	if ku := crt.KeyUsage; ku != 0 {
+		caps.Sign = caps.Sign && ku&(x509.KeyUsageDigitalSignature|x509.KeyUsageContentCommitment|x509.KeyUsageCertSign|x509.KeyUsageCRLSign) != 0
+		caps.Decrypt = caps.Decrypt && ku&(x509.KeyUsageKeyEncipherment|x509.KeyUsageDataEncipherment) != 0
+		caps.KeyAgreement = caps.KeyAgreement && ku&x509.KeyUsageKeyAgreement != 0
+	}
+
+	return caps
+}
+
+// identityCapabilities gets the KeyCapabilities for an identity's certificate.
+func identityCapabilities(ident Identity) (KeyCapabilities, error) {
+	crt, err := ident.Certificate()
+	if err != nil {
+		return KeyCapabilities{}, err
+	}
+
+	return certCapabilities(crt), nil
+}
+
+// ProviderInfo describes the provider holding an identity's private key.
+type ProviderInfo struct {
+	// Provider is the name of the CSP or KSP holding the key.
+	Provider string
+
+	// Container is the name of the key container within the provider.
+	Container string
+
+	// ProviderType is the CryptoAPI provider type. It is zero for CNG keys.
+	ProviderType uint32
+
+	// KeySpec is the CryptoAPI key spec (e.g. AT_SIGNATURE) or
+	// CERT_NCRYPT_KEY_SPEC for CNG keys.
+	KeySpec uint32
+}
+
+// identityThumbprint gets the SHA-1 thumbprint of an identity's certificate.
+func identityThumbprint(ident Identity) ([]byte, error) {
+	crt, err := ident.Certificate()
+	if err != nil {
+		return nil, err
+	}
+
+	return thumbprint(crt), nil
+}
+
+// identityThumbprintSHA256 gets the SHA-256 thumbprint of an identity's
+// certificate.
+func identityThumbprintSHA256(ident Identity) ([]byte, error) {
+	crt, err := ident.Certificate()
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(crt.Raw)
+	return sum[:], nil
+}
+
+// subjectDisplayName gets the display name for an identity from its
+// certificate's subject, for when the platform has no better label.
+func subjectDisplayName(ident Identity) (string, error) {
+	crt, err := ident.Certificate()
+	if err != nil {
+		return "", err
+	}
+
+	if crt.Subject.CommonName != "" {
+		return crt.Subject.CommonName, nil
+	}
+
+	return crt.Subject.String(), nil
+}
+
+// identityKeyInfo gets the KeyInfo for an identity's certificate.
+func identityKeyInfo(ident Identity) (KeyInfo, error) {
+	crt, err := ident.Certificate()
+	if err != nil {
+		return KeyInfo{}, err
+	}
+
+	return keyInfo(crt), nil
+}
+
+// WrappedKeyExporter is implemented by signers whose private key can be
+// exported wrapped (encrypted) to another key. On Windows, the crypto.Signer
+// returned for CNG keys implements this interface.
+type WrappedKeyExporter interface {
+	// ExportWrapped exports the private key, encrypted to the given wrapping
+	// key. The private key is never exposed in plaintext.
+	ExportWrapped(wrappingKey crypto.PublicKey) ([]byte, error)
+}
+
+// ContextSigner is implemented by signers that can abandon a signing operation
+// when a context is done. On Linux, the crypto.Signer returned by
+// Identity.Signer implements this interface.
+type ContextSigner interface {
+	// SignContext is like crypto.Signer's Sign, but returns ctx.Err() if ctx is
+	// done before the signature is produced.
+	SignContext(ctx context.Context, digest []byte, opts crypto.SignerOpts) ([]byte, error)
+}
+
+// KeyOp is a private key operation.
+type KeyOp int
+
+const (
+	// KeyOpSign is signing a digest.
+	KeyOpSign KeyOp = iota
+
+	// KeyOpDecrypt is decrypting data encrypted to the public key.
+	KeyOpDecrypt
+
+	// KeyOpKeyAgreement is deriving a shared secret (e.g. ECDH).
+	KeyOpKeyAgreement
+)
+
+// KeyOpChecker is implemented by signers that can report which operations
+// their private key allows. On Windows, the crypto.Signer returned by
+// Identity.Signer implements this interface.
+type KeyOpChecker interface {
+	// CanPerform checks whether the key's usage restrictions allow the
+	// operation. This lets callers fail early with a clear result rather than
+	// getting an obscure provider error from Sign.
+	CanPerform(op KeyOp) (bool, error)
+}
+
+// SignFlags selects how RawSigner.SignRaw pads the data it signs.
+type SignFlags int
+
+const (
+	// SignRawPKCS1 applies PKCS#1 v1.5 signature padding to the data as is,
+	// without prepending a DigestInfo. The data is usually an already DER
+	// encoded DigestInfo, e.g. for a hash algorithm the provider doesn't
+	// know.
+	SignRawPKCS1 SignFlags = iota
+
+	// SignRawNoPadding applies the RSA private key operation to the data as
+	// is. The data must be exactly as long as the modulus and already padded.
+	SignRawNoPadding
+)
+
+// RawSigner is implemented by signers that can sign data exactly as given,
+// bypassing the hashing and padding setup of crypto.Signer.Sign. On Windows,
+// the crypto.Signer returned by Identity.Signer implements this interface, but
+// only RSA keys held by CNG providers support it. Other keys return
+// ErrUnsupportedOperation.
+//
+// This is for advanced callers, such as CMS or PKCS#7 signers that build their
+// own DigestInfo. Nothing checks what is signed: a malformed or mislabeled
+// DigestInfo still yields a valid-looking signature that verifiers will reject
+// or, worse, interpret as a signature over a different hash. SignRawNoPadding
+// is a bare RSA private key operation, so signing data an attacker controls
+// with it lets them decrypt messages or forge signatures with the key. It is
+// performed as a decryption without padding, so providers may also require the
+// key to allow decryption. Prefer crypto.Signer.Sign whenever it will do.
+type RawSigner interface {
+	// SignRaw signs data with the padding selected by flags.
+	SignRaw(data []byte, flags SignFlags) ([]byte, error)
+}
+
+// LittleEndianOpts can be passed to Sign to request the raw signature produced
+// by the Windows CryptoAPI rather than the usual big-endian form.
+//
+// CryptSignHash returns RSA signatures as little-endian integers. By default,
+// signers reverse these bytes so that the signature is a big-endian PKCS#1
+// v1.5 signature as expected by rsa.VerifyPKCS1v15 and everything else using
+// crypto.Signer. When signing with LittleEndianOpts, the bytes are returned
+// exactly as CryptSignHash produced them. This is only useful for debugging or
+// interop with other CryptoAPI consumers (e.g. CryptVerifySignature).
+//
+// The option only affects RSA keys held by CryptoAPI providers. Signatures
+// from CNG keys and from other platforms are always big-endian (or ASN.1 DER
+// for ECDSA). The wrapped options must be a plain crypto.Hash, since CryptoAPI
+// byte order only applies to PKCS#1 v1.5 signatures. Signing fails otherwise.
+type LittleEndianOpts struct {
+	crypto.SignerOpts
+}
+
+// unwrapLittleEndianOpts gets the options wrapped by LittleEndianOpts (or a
+// pointer to them), reporting whether they were wrapped. Anything but a plain
+// hash is rejected rather than unwrapped, since signers would otherwise see
+// e.g. *rsa.PSSOptions as a hash and silently sign with PKCS#1 v1.5.
+func unwrapLittleEndianOpts(opts crypto.SignerOpts) (crypto.SignerOpts, bool, error) {
+	var inner crypto.SignerOpts
+
+	switch o := opts.(type) {
+	case LittleEndianOpts:
+		inner = o.SignerOpts
+	case *LittleEndianOpts:
+		if o == nil {
+			return nil, false, errors.New("nil *LittleEndianOpts")
+		}
+		inner = o.SignerOpts
+	default:
+		return opts, false, nil
+	}
+
+	if _, isHash := inner.(crypto.Hash); !isHash {
+		return nil, false, fmt.Errorf("LittleEndianOpts must wrap a crypto.Hash, not %T: %w", inner, ErrUnsupportedOperation)
+	}
+
+	return inner, true, nil
+}
+
+// TLSCertificate gets a tls.Certificate for the identity, for use in a
+// tls.Config. The certificate chain is included, except for a self-signed root,
+// and the private key is the identity's signer. The identity must not be closed
+// while the certificate is in use.
+func TLSCertificate(ident Identity) (*tls.Certificate, error) {
+	chain, err := ident.CertificateChain()
+	if err != nil && !errors.Is(err, ErrPartialChain) {
+		return nil, err
+	}
+
+	signer, err := ident.Signer()
+	if err != nil {
+		return nil, err
+	}
+
+	cert := &tls.Certificate{
+		PrivateKey: signer,
+		Leaf:       chain[0],
+	}
+
+	for j, crt := range chain {
+		if j > 0 && isSelfSigned(crt) {
+			break
+		}
+
+		cert.Certificate = append(cert.Certificate, crt.Raw)
+	}
+
+	return cert, nil
+}
+
+// TLSClientConfig gets a TLS config that presents the identity as its client
+// certificate through GetClientCertificate. Callers may set other fields, such
+// as RootCAs, before use. As with NewMTLSTransport, the identity must not be
+// closed while the config is in use.
+func TLSClientConfig(ident Identity) (*tls.Config, error) {
+	cert, err := TLSCertificate(ident)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return cert, nil
+		},
+	}, nil
+}
+
+// NewMTLSTransport clones base (or http.DefaultTransport if base is nil) and
+// configures it to present the identity as its TLS client certificate. The
+// identity's signer is reused for every connection, so the identity must not be
+// closed while the transport is in use.
+func NewMTLSTransport(ident Identity, base *http.Transport) (*http.Transport, error) {
+	config, err := TLSClientConfig(ident)
+	if err != nil {
+		return nil, err
+	}
+
+	if base == nil {
+		base = http.DefaultTransport.(*http.Transport)
+	}
+
+	transport := base.Clone()
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+
+	transport.TLSClientConfig.Certificates = nil
+	transport.TLSClientConfig.GetClientCertificate = config.GetClientCertificate
+
+	return transport, nil
+}
+
+// BatchError is returned by SignBatch when one or more digests couldn't be
+// signed. It has one entry per digest, which is nil if that digest was signed
+// successfully.
+type BatchError []error
+
+func (e BatchError) Error() string {
+	var (
+		failed int
+		first  error
+	)
+
+	for _, err := range e {
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			failed++
+		}
+	}
+
+	return fmt.Sprintf("failed to sign %d of %d digests: %v", failed, len(e), first)
+}
+
+// SignBatch signs each digest with the identity's private key. The key is
+// acquired once and reused for every digest, which avoids repeated handle
+// setup and PIN prompts for slow smart cards. A failure signing one digest
+// doesn't abort the batch. Instead, its signature is left nil and a BatchError
+// is returned describing which digests failed.
+func SignBatch(ident Identity, digests [][]byte, hash crypto.Hash) ([][]byte, error) {
+	signer, err := ident.Signer()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		sigs   = make([][]byte, len(digests))
+		errs   = make(BatchError, len(digests))
+		failed bool
+	)
+
+	for j, digest := range digests {
+		if sigs[j], errs[j] = signer.Sign(rand.Reader, digest, hash); errs[j] != nil {
+			failed = true
+		}
+	}
+
+	if failed {
+		return sigs, errs
+	}
+
+	return sigs, nil
+}
+
+// findRenewalOf implements Store.FindRenewalOf on top of Store.Identities.
+func findRenewalOf(s Store, cert *x509.Certificate) (Identity, error) {
+	idents, err := s.Identities()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		newest    Identity
+		newestCrt = cert
+	)
+
+	for _, ident := range idents {
+		crt, err := ident.Certificate()
+		if err != nil {
+			ident.Close()
+			continue
+		}
+
+		if !sameSubjectAndKey(cert, crt) || !crt.NotBefore.After(newestCrt.NotBefore) {
+			ident.Close()
+			continue
+		}
+
+		if newest != nil {
+			newest.Close()
+		}
+
+		newest, newestCrt = ident, crt
+	}
+
+	if newest == nil {
+		return nil, ErrNotFound
+	}
+
+	return newest, nil
+}
+
+// sameSubjectAndKey checks if two certificates have the same subject and key.
+// Keys are compared by SubjectKeyId, falling back to the SubjectPublicKeyInfo
+// when either certificate is missing the extension.
+func sameSubjectAndKey(a, b *x509.Certificate) bool {
+	if !bytes.Equal(a.RawSubject, b.RawSubject) {
+		return false
+	}
+
+	if len(a.SubjectKeyId) > 0 && len(b.SubjectKeyId) > 0 {
+		return bytes.Equal(a.SubjectKeyId, b.SubjectKeyId)
+	}
+
+	return bytes.Equal(a.RawSubjectPublicKeyInfo, b.RawSubjectPublicKeyInfo)
+}
+
+// ResolveIdentity searches every store on this platform for an identity with
+// the given DER encoded certificate and a usable private key. On Windows, the
+// CurrentUser/MY and LocalMachine/MY stores are searched in that order. Elsewhere
+// only the default store (the keychains on macOS, the token on Linux) is
+// searched. This is useful when the certificate is known, e.g. from a
+// config file, but not where its key lives. The returned identity keeps its
+// store open until it and any clones of it are closed. If no identity is found,
+// the error wraps ErrNotFound and lists the locations searched. If no location
+// could be searched at all, the first error opening or enumerating a store is
+// returned instead.
+func ResolveIdentity(certDER []byte) (Identity, error) {
+	if _, err := x509.ParseCertificate(certDER); err != nil {
+		return nil, fmt.Errorf("invalid certificate: %w", err)
+	}
+
+	var (
+		searched = make([]string, 0, len(resolveLocations))
+		firstErr error
+	)
+
+	for _, location := range resolveLocations {
+		s, err := OpenWithOptions(OpenOptions{Location: location})
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		idents, err := filterIdentities(s, func(ident Identity) bool {
+			crt, err := ident.Certificate()
+			if err != nil || !bytes.Equal(crt.Raw, certDER) {
+				return false
+			}
+
+			_, err = ident.Signer()
+			return err == nil
+		})
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			s.Close()
+			continue
+		}
+		searched = append(searched, location.String())
+
+		if len(idents) == 0 {
+			s.Close()
+			continue
+		}
+
+		for _, extra := range idents[1:] {
+			extra.Close()
+		}
+
+		return &storeIdentity{Identity: idents[0], store: &sharedStore{Store: s, refs: 1}}, nil
+	}
+
+	if len(searched) == 0 && firstErr != nil {
+		return nil, firstErr
+	}
+
+	return nil, fmt.Errorf("%w: searched %v", ErrNotFound, searched)
+}
+
+// storeIdentity is an Identity that owns the store it came from. Some
+// platforms (e.g. PKCS#11 tokens on Linux) invalidate an identity's key when
+// its store is closed, so the store is closed along with the last identity
+// (or clone) using it.
+type storeIdentity struct {
+	Identity
+	store  *sharedStore
+	closed bool
+}
+
+// Clone implements the Identity interface. The clone holds its own reference
+// to the store, so it stays usable after the original is closed.
+func (i *storeIdentity) Clone() (Identity, error) {
+	if i.closed {
+		return nil, ErrClosed
+	}
+
+	clone, err := i.Identity.Clone()
+	if err != nil {
+		return nil, err
+	}
+
+	i.store.retain()
+
+	return &storeIdentity{Identity: clone, store: i.store}, nil
+}
+
+// Close implements the Identity interface.
+func (i *storeIdentity) Close() {
+	if i.closed {
+		return
+	}
+	i.closed = true
+
+	i.Identity.Close()
+	i.store.release()
+}
+
+// sharedStore is a Store shared by a storeIdentity and its clones. It is closed
+// once every one of them has been closed.
+type sharedStore struct {
+	Store
+
+	mu   sync.Mutex
+	refs int
+}
+
+// retain adds a reference to the store.
+func (s *sharedStore) retain() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.refs++
+}
+
+// release drops a reference to the store, closing it with the last one.
+func (s *sharedStore) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.refs--; s.refs == 0 {
+		s.Store.Close()
+	}
+}
+
+// RequireIdentities is like s.Identities, but returns ErrNoIdentities along
+// with the empty slice if the store has no identities. This lets callers
+// distinguish "no certificates installed" from a failure to enumerate the
+// store, whose error is returned as is.
+func RequireIdentities(s Store) ([]Identity, error) {
+	idents, err := s.Identities()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(idents) == 0 {
+		return idents, ErrNoIdentities
+	}
+
+	return idents, nil
+}
+
+// FirstIdentity gets the first identity in the store that has a usable
+// private key and closes the rest. This is convenient for devices with a single
+// certificate. ErrNoIdentities is returned if the store is empty and
+// ErrNoPrivateKey if none of its identities have a usable private key.
+func FirstIdentity(s Store) (Identity, error) {
+	idents, err := RequireIdentities(s)
+	if err != nil {
+		return nil, err
+	}
+
+	var first Identity
+	for _, ident := range idents {
+		if first == nil {
+			if _, err := ident.Signer(); err == nil {
+				first = ident
+				continue
+			}
+		}
+
+		ident.Close()
+	}
+
+	if first == nil {
+		return nil, ErrNoPrivateKey
+	}
+
+	return first, nil
+}
+
+// NewestIdentity gets the identity with the latest NotBefore among those whose
+// certificate matches the predicate and closes the rest. A nil predicate
+// matches every certificate. This is useful during key rollover, when the old
+// and new certificates coexist in the store. ErrNotFound is returned if no
+// identity matches.
+func NewestIdentity(s Store, pred func(*x509.Certificate) bool) (Identity, error) {
+	idents, err := s.Identities()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		newest    Identity
+		newestCrt *x509.Certificate
+	)
+
+	for _, ident := range idents {
+		crt, err := ident.Certificate()
+		if err != nil || (pred != nil && !pred(crt)) {
+			ident.Close()
+			continue
+		}
+
+		if newest == nil || crt.NotBefore.After(newestCrt.NotBefore) {
+			if newest != nil {
+				newest.Close()
+			}
+
+			newest, newestCrt = ident, crt
+			continue
+		}
+
+		ident.Close()
+	}
+
+	if newest == nil {
+		return nil, ErrNotFound
+	}
+
+	return newest, nil
+}
+
+// FindIdentityByThumbprint gets the identity whose certificate has the given
+// SHA-1 thumbprint, as displayed by the Windows certificate manager. This pins
+// the exact certificate rather than guessing by iteration. On Windows, the
+// certificate is looked up directly rather than by walking the store.
+// ErrNotFound is returned if there is no such identity.
+func FindIdentityByThumbprint(s Store, tp []byte) (Identity, error) {
+	if finder, ok := s.(thumbprintFinder); ok {
+		return finder.findIdentityByThumbprint(tp)
+	}
+
+	idents, err := filterIdentities(s, func(ident Identity) bool {
+		crt, err := ident.Certificate()
+		return err == nil && bytes.Equal(thumbprint(crt), tp)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(idents) == 0 {
+		return nil, ErrNotFound
+	}
+
+	for _, extra := range idents[1:] {
+		extra.Close()
+	}
+
+	return idents[0], nil
+}
+
+// DeleteIdentityByThumbprint deletes the identity whose certificate has the
+// given SHA-1 thumbprint, removing both the certificate and its private key.
+// Like FindIdentityByThumbprint, the certificate is looked up directly on
+// Windows rather than by walking the store. ErrNotFound is returned if there is
+// no such identity.
+func DeleteIdentityByThumbprint(s Store, tp []byte) error {
+	ident, err := FindIdentityByThumbprint(s, tp)
+	if err != nil {
+		return err
+	}
+	defer ident.Close()
+
+	return ident.Delete()
+}
+
+// FindIdentitiesBySubject gets the identities whose certificate subject
+// contains cn, compared case-insensitively. Several certificates can share a
+// subject, so all matches are returned. On Windows, the certificates are looked
+// up directly with CERT_FIND_SUBJECT_STR rather than by walking the store. An
+// empty slice is returned if none match.
+func FindIdentitiesBySubject(s Store, cn string) ([]Identity, error) {
+	if finder, ok := s.(subjectFinder); ok {
+		return finder.findIdentitiesBySubject(cn)
+	}
+
+	needle := strings.ToLower(cn)
+
+	return filterIdentities(s, func(ident Identity) bool {
+		crt, err := ident.Certificate()
+		return err == nil && strings.Contains(strings.ToLower(crt.Subject.String()), needle)
+	})
+}
+
+// subjectFinder is implemented by stores that can look up certificates by
+// subject without enumerating every identity.
+type subjectFinder interface {
+	findIdentitiesBySubject(cn string) ([]Identity, error)
+}
+
+// FindIdentitiesByIssuer gets the identities whose certificate issuer contains
+// issuerCN, compared case-insensitively. This is a substring match on the whole
+// issuer name string, not an exact match on the issuer's common name or DN, so
+// "Acme CA" also matches certificates issued by "Acme CA Root" or with
+// "O=Acme CA Services" in their issuer. Check Certificate().Issuer to match
+// exactly. On Windows, the certificates are looked up directly with
+// CERT_FIND_ISSUER_STR rather than by walking the store. An empty slice is
+// returned if none match.
+func FindIdentitiesByIssuer(s Store, issuerCN string) ([]Identity, error) {
+	if finder, ok := s.(issuerFinder); ok {
+		return finder.findIdentitiesByIssuer(issuerCN)
+	}
+
+	needle := strings.ToLower(issuerCN)
+
+	return filterIdentities(s, func(ident Identity) bool {
+		crt, err := ident.Certificate()
+		return err == nil && strings.Contains(strings.ToLower(crt.Issuer.String()), needle)
+	})
+}
+
+// FindIdentitiesByExactSubject gets the identities whose certificate subject is
+// exactly dn, comparing every attribute rather than matching a substring like
+// FindIdentitiesBySubject. Names are compared in their RFC 2253 form, so
+// attribute string encodings don't matter. This trades performance for
+// correctness, since every identity in the store is enumerated and parsed. An
+// empty slice is returned if none match.
+func FindIdentitiesByExactSubject(s Store, dn pkix.Name) ([]Identity, error) {
+	want := dn.String()
+
+	return filterIdentities(s, func(ident Identity) bool {
+		crt, err := ident.Certificate()
+		return err == nil && crt.Subject.String() == want
+	})
+}
+
+// issuerFinder is implemented by stores that can look up certificates by
+// issuer without enumerating every identity.
+type issuerFinder interface {
+	findIdentitiesByIssuer(issuerCN string) ([]Identity, error)
+}
+
+// thumbprintFinder is implemented by stores that can look up a certificate by
+// thumbprint without enumerating every identity.
+type thumbprintFinder interface {
+	findIdentityByThumbprint(thumbprint []byte) (Identity, error)
+}
+
+// FindIdentitiesByProvider gets the identities in the store whose private key
+// is held by the named provider (e.g. "Microsoft Platform Crypto Provider" for
+// TPM backed keys). Identities whose provider can't be determined are skipped.
+// An empty slice is returned if none match.
+func FindIdentitiesByProvider(s Store, providerName string) ([]Identity, error) {
+	return filterIdentities(s, func(ident Identity) bool {
+		info, err := ident.KeyProviderInfo()
+		return err == nil && info.Provider == providerName
+	})
+}
+
+// FindIdentitiesBySubjectRegex gets the identities in the store whose subject
+// matches the regular expression. The pattern is matched against the subject's
+// RFC 2253 string form (e.g. "CN=Jane Doe,OU=Engineering,O=Example"), so it
+// can select on any attribute of the subject.
+func FindIdentitiesBySubjectRegex(s Store, pattern string) ([]Identity, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subject pattern: %w", err)
+	}
+
+	return filterIdentities(s, func(ident Identity) bool {
+		crt, err := ident.Certificate()
+		return err == nil && re.MatchString(crt.Subject.String())
+	})
+}
+
+// FindIdentitiesForTLS gets the identities in the store whose key can be used
+// to authenticate with the given TLS version (e.g. tls.VersionTLS13). TLS 1.3
+// only allows RSA keys to sign with RSA-PSS, so RSA keys whose provider can't
+// do PSS (e.g. older smart cards) are excluded, as are ECDSA keys on curves
+// without a TLS 1.3 signature scheme. Ed25519 keys need TLS 1.2 or later.
+// Identities are matched on their certificate's public key, and the private key
+// is only acquired to probe RSA keys for PSS support under TLS 1.3. An empty
+// slice is returned if none are suitable.
+func FindIdentitiesForTLS(s Store, version uint16) ([]Identity, error) {
+	return filterIdentities(s, func(ident Identity) bool {
+		return usableForTLS(ident, version)
+	})
+}
+
+// usableForTLS reports whether ident's key can authenticate with the given TLS
+// version.
+func usableForTLS(ident Identity, version uint16) bool {
+	crt, err := ident.Certificate()
+	if err != nil {
+		return false
+	}
+
+	switch pub := crt.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if version < tls.VersionTLS13 {
+			return true
+		}
+
+		signer, err := ident.Signer()
+		if err != nil {
+			return false
+		}
+
+		prober, ok := signer.(pssProber)
+		return !ok || prober.supportsPSS()
+	case *ecdsa.PublicKey:
+		if version < tls.VersionTLS13 {
+			return true
+		}
+
+		switch pub.Curve {
+		case elliptic.P256(), elliptic.P384(), elliptic.P521():
+			return true
+		default:
+			return false
+		}
+	case ed25519.PublicKey:
+		return version >= tls.VersionTLS12
+	default:
+		return false
+	}
+}
+
+// pssProber is implemented by signers that can tell whether their provider
+// supports RSA-PSS. Signers that don't implement it are assumed to.
+type pssProber interface {
+	supportsPSS() bool
+}
+
+// contextIdentifier is implemented by stores that can stop enumerating
+// identities when a context is done.
+type contextIdentifier interface {
+	identitiesContext(ctx context.Context) ([]Identity, error)
+}
+
+// identitiesContext gets the identities in the store, stopping early if ctx is
+// done. Stores that can't be interrupted are enumerated in full, and ctx is
+// checked afterwards.
+func identitiesContext(ctx context.Context, s Store) ([]Identity, error) {
+	if ci, ok := s.(contextIdentifier); ok {
+		return ci.identitiesContext(ctx)
+	}
+
+	idents, err := s.Identities()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		for _, ident := range idents {
+			ident.Close()
+		}
+
+		return nil, err
+	}
+
+	return idents, nil
+}
+
+// IdentityIterator lazily enumerates a store's identities, so that large stores
+// can be streamed rather than loaded into a slice all at once.
+type IdentityIterator interface {
+	// Next gets the next identity, which the caller must Close. io.EOF is
+	// returned once every identity has been read.
+	Next() (Identity, error)
+
+	// Reset restarts enumeration from the first identity. It must be called
+	// before iterating again once Next has returned io.EOF.
+	Reset() error
+
+	// Close releases the iterator. Identities already returned by Next stay
+	// valid and must still be closed by the caller.
+	Close()
+}
+
+// identityIterable is implemented by stores that can enumerate identities
+// lazily.
+type identityIterable interface {
+	iterateIdentities() (IdentityIterator, error)
+}
+
+// IterateIdentities gets an iterator over the store's identities. On Windows,
+// certificates are read from the store one at a time. Other stores are
+// enumerated up front, but identities are still handed out one at a time.
+func IterateIdentities(s Store) (IdentityIterator, error) {
+	if ii, ok := s.(identityIterable); ok {
+		return ii.iterateIdentities()
+	}
+
+	return &sliceIterator{store: s}, nil
+}
+
+// sliceIterator implements IdentityIterator on top of Store.Identities.
+type sliceIterator struct {
+	store  Store
+	idents []Identity
+	loaded bool
+}
+
+// Next implements the IdentityIterator interface.
+func (it *sliceIterator) Next() (Identity, error) {
+	if !it.loaded {
+		idents, err := it.store.Identities()
+		if err != nil {
+			return nil, err
+		}
+
+		it.idents = idents
+		it.loaded = true
+	}
+
+	if len(it.idents) == 0 {
+		return nil, io.EOF
+	}
+
+	ident := it.idents[0]
+	it.idents = it.idents[1:]
+
+	return ident, nil
+}
+
+// Reset implements the IdentityIterator interface.
+func (it *sliceIterator) Reset() error {
+	it.Close()
+	it.loaded = false
+
+	return nil
+}
+
+// Close implements the IdentityIterator interface. Identities that weren't
+// handed out are closed.
+func (it *sliceIterator) Close() {
+	for _, ident := range it.idents {
+		ident.Close()
+	}
+
+	it.idents = nil
+}
+
+// Matcher selects identities by their certificate. Matchers can be combined
+// with And, Or and Not, and are passed to FindIdentities. A Matcher can also be
+// used as SelectOptions.Match.
+type Matcher func(crt *x509.Certificate) bool
+
+// FindIdentities gets the identities in the store whose certificate matches.
+// Each certificate is parsed once and shared by all the matchers, so complex
+// selections take a single pass over the store. A nil matcher matches every
+// identity. An empty slice is returned if none match.
+func FindIdentities(s Store, m Matcher) ([]Identity, error) {
+	return FindIdentitiesContext(context.Background(), s, m)
+}
+
+// FindIdentitiesContext is like FindIdentities, but returns ctx.Err() once ctx
+// is done, closing any identities already read. On Windows, enumeration stops
+// between certificates, so this can bound time spent on slow smart card
+// readers.
+func FindIdentitiesContext(ctx context.Context, s Store, m Matcher) ([]Identity, error) {
+	return filterIdentitiesContext(ctx, s, func(ident Identity) bool {
+		crt, err := ident.Certificate()
+		return err == nil && (m == nil || m(crt))
+	})
+}
+
+// And matches certificates matched by all of the matchers.
+func And(matchers ...Matcher) Matcher {
+	return func(crt *x509.Certificate) bool {
+		for _, m := range matchers {
+			if !m(crt) {
+				return false
+			}
+		}
+
+		return true
+	}
+}
+
+// Or matches certificates matched by any of the matchers.
+func Or(matchers ...Matcher) Matcher {
+	return func(crt *x509.Certificate) bool {
+		for _, m := range matchers {
+			if m(crt) {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+// Not matches certificates not matched by the matcher.
+func Not(m Matcher) Matcher {
+	return func(crt *x509.Certificate) bool {
+		return !m(crt)
+	}
+}
+
+// BySubject matches certificates whose subject common name or RFC 2253 subject
+// string (e.g. "CN=Jane Doe,O=Example") equals name.
+func BySubject(name string) Matcher {
+	return func(crt *x509.Certificate) bool {
+		return crt.Subject.CommonName == name || crt.Subject.String() == name
+	}
+}
+
+// ByIssuer matches certificates whose issuer common name or RFC 2253 issuer
+// string equals name.
+func ByIssuer(name string) Matcher {
+	return func(crt *x509.Certificate) bool {
+		return crt.Issuer.CommonName == name || crt.Issuer.String() == name
+	}
+}
+
+// ByEKU matches certificates valid for the extended key usage. Certificates
+// without an extended key usage extension, or with the "any" usage, are valid
+// for every usage.
+func ByEKU(usage x509.ExtKeyUsage) Matcher {
+	return func(crt *x509.Certificate) bool {
+		if len(crt.ExtKeyUsage) == 0 && len(crt.UnknownExtKeyUsage) == 0 {
+			return true
+		}
+
+		for _, eku := range crt.ExtKeyUsage {
+			if eku == usage || eku == x509.ExtKeyUsageAny {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+// Common extended key usage OIDs, for use with ByEKUOID and
+// FindIdentitiesByEKU.
+var (
+	OIDExtKeyUsageServerAuth      = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 1}
+	OIDExtKeyUsageClientAuth      = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 2}
+	OIDExtKeyUsageCodeSigning     = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 3}
+	OIDExtKeyUsageEmailProtection = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 4}
+	OIDExtKeyUsageSmartcardLogon  = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 20, 2, 2}
+)
+
+// extKeyUsageOIDs maps the extended key usages that crypto/x509 parses to
+// their OIDs.
+var extKeyUsageOIDs = map[x509.ExtKeyUsage]asn1.ObjectIdentifier{
+	x509.ExtKeyUsageAny:                            {2, 5, 29, 37, 0},
+	x509.ExtKeyUsageServerAuth:                     OIDExtKeyUsageServerAuth,
+	x509.ExtKeyUsageClientAuth:                     OIDExtKeyUsageClientAuth,
+	x509.ExtKeyUsageCodeSigning:                    OIDExtKeyUsageCodeSigning,
+	x509.ExtKeyUsageEmailProtection:                OIDExtKeyUsageEmailProtection,
+	x509.ExtKeyUsageIPSECEndSystem:                 {1, 3, 6, 1, 5, 5, 7, 3, 5},
+	x509.ExtKeyUsageIPSECTunnel:                    {1, 3, 6, 1, 5, 5, 7, 3, 6},
+	x509.ExtKeyUsageIPSECUser:                      {1, 3, 6, 1, 5, 5, 7, 3, 7},
+	x509.ExtKeyUsageTimeStamping:                   {1, 3, 6, 1, 5, 5, 7, 3, 8},
+	x509.ExtKeyUsageOCSPSigning:                    {1, 3, 6, 1, 5, 5, 7, 3, 9},
+	x509.ExtKeyUsageMicrosoftServerGatedCrypto:     {1, 3, 6, 1, 4, 1, 311, 10, 3, 3},
+	x509.ExtKeyUsageNetscapeServerGatedCrypto:      {2, 16, 840, 1, 113730, 4, 1},
+	x509.ExtKeyUsageMicrosoftCommercialCodeSigning: {1, 3, 6, 1, 4, 1, 311, 2, 1, 22},
+	x509.ExtKeyUsageMicrosoftKernelCodeSigning:     {1, 3, 6, 1, 4, 1, 311, 61, 1, 1},
+}
+
+// ByEKUOID matches certificates valid for any of the extended key usage OIDs.
+// Unlike ByEKU, this works for usages crypto/x509 doesn't know about (e.g.
+// smart card logon). As with ByEKU, certificates without an extended key usage
+// extension, or with the "any" usage, are valid for every usage.
+func ByEKUOID(oids ...asn1.ObjectIdentifier) Matcher {
+	return func(crt *x509.Certificate) bool {
+		if len(crt.ExtKeyUsage) == 0 && len(crt.UnknownExtKeyUsage) == 0 {
+			return true
+		}
+
+		for _, eku := range crt.ExtKeyUsage {
+			if eku == x509.ExtKeyUsageAny {
+				return true
+			}
+
+			for _, oid := range oids {
+				if oid.Equal(extKeyUsageOIDs[eku]) {
+					return true
+				}
+			}
+		}
+
+		for _, eku := range crt.UnknownExtKeyUsage {
+			for _, oid := range oids {
+				if oid.Equal(eku) {
+					return true
+				}
+			}
+		}
+
+		return false
+	}
+}
+
+// FindIdentitiesByEKU gets the identities in the store whose certificate is
+// valid for any of the extended key usage OIDs (e.g. OIDExtKeyUsageClientAuth),
+// so that a TLS client can offer only certificates usable for client auth.
+// See ByEKUOID for how certificates are matched. An empty slice is returned if
+// none match.
+func FindIdentitiesByEKU(s Store, oids []asn1.ObjectIdentifier) ([]Identity, error) {
+	return FindIdentities(s, ByEKUOID(oids...))
+}
+
+// Valid matches certificates that are currently within their validity period.
+func Valid() Matcher {
+	return func(crt *x509.Certificate) bool {
+		return ValidAt(time.Now())(crt)
+	}
+}
+
+// ValidAt matches certificates that are within their validity period at the
+// given time.
+func ValidAt(at time.Time) Matcher {
+	return func(crt *x509.Certificate) bool {
+		return !at.Before(crt.NotBefore) && !at.After(crt.NotAfter)
+	}
+}
+
+// FindValidIdentities gets the identities in the store whose certificate is
+// valid at the given time, i.e. NotBefore <= at <= NotAfter. An empty slice is
+// returned if none are.
+func FindValidIdentities(s Store, at time.Time) ([]Identity, error) {
+	return FindIdentities(s, ValidAt(at))
+}
+
+// FindValidIdentitiesNow gets the identities in the store whose certificate is
+// currently valid.
+func FindValidIdentitiesNow(s Store) ([]Identity, error) {
+	return FindValidIdentities(s, time.Now())
+}
+
+// filterIdentities gets the identities in the store matching the predicate.
+// Identities that don't match are closed.
+func filterIdentities(s Store, match func(Identity) bool) ([]Identity, error) {
+	return filterIdentitiesContext(context.Background(), s, match)
+}
+
+// filterIdentitiesContext is like filterIdentities, but stops enumerating the
+// store once ctx is done.
+func filterIdentitiesContext(ctx context.Context, s Store, match func(Identity) bool) ([]Identity, error) {
+	idents, err := identitiesContext(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+
+	matches := []Identity{}
+	for _, ident := range idents {
+		if match(ident) {
+			matches = append(matches, ident)
+		} else {
+			ident.Close()
+		}
+	}
+
+	return matches, nil
+}
+
+// KeyInfo describes the type and size of a key.
+type KeyInfo struct {
+	// Algorithm is the key's public key algorithm.
+	Algorithm x509.PublicKeyAlgorithm
+
+	// Bits is the size of the key in bits. For RSA this is the modulus size
+	// and for ECDSA it is the curve size. It is 256 for Ed25519.
+	Bits int
+}
+
+// keyInfo gets the KeyInfo for a certificate's public key.
+func keyInfo(cert *x509.Certificate) KeyInfo {
+	info := KeyInfo{Algorithm: cert.PublicKeyAlgorithm}
+
+	switch pub := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		info.Bits = pub.N.BitLen()
+	case *ecdsa.PublicKey:
+		info.Bits = pub.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		info.Bits = 256
+	}
+
+	return info
+}
+
+// EncodeCERBase64 encodes a DER certificate in the base64 .cer form written by
+// "certutil -encode", with "-----BEGIN CERTIFICATE-----" headers and CRLF line
+// endings. Both this and the DER form can be imported with certutil or the
+// Windows certificate import wizard.
+func EncodeCERBase64(der []byte) []byte {
+	var buf bytes.Buffer
+
+	buf.WriteString("-----BEGIN CERTIFICATE-----\r\n")
+
+	b64 := base64.StdEncoding.EncodeToString(der)
+	for len(b64) > 64 {
+		buf.WriteString(b64[:64])
+		buf.WriteString("\r\n")
+		b64 = b64[64:]
+	}
+	if len(b64) > 0 {
+		buf.WriteString(b64)
+		buf.WriteString("\r\n")
+	}
+
+	buf.WriteString("-----END CERTIFICATE-----\r\n")
+
+	return buf.Bytes()
+}
+
+// FindCACertificates gets the intermediate and root CA certificates the
+// platform knows about, without signers, for building chains or an
+// x509.CertPool that matches the OS trust view. On Windows, these are read from
+// the "CA" and "Root" stores of both the current user and local machine. On
+// macOS and Linux, only the trusted roots are available, as from
+// Store.ExportTrustAnchors. Duplicates are removed.
+func FindCACertificates() ([]*x509.Certificate, error) {
+	return caCertificates()
+}
+
+// SystemRootPool builds an x509.CertPool from the platform's CA certificates,
+// for verifying chains the way the OS would. Unlike x509.SystemCertPool, this
+// works on Windows, where the "ROOT" and "CA" stores of both the current user
+// and local machine are read. On Linux, the usual root bundle files are read,
+// along with any CA certificates on the PKCS#11 token configured through the
+// PKCS11_* environment variables. On macOS, the trusted roots are used.
+func SystemRootPool() (*x509.CertPool, error) {
+	certs, err := systemRoots()
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	for _, cert := range certs {
+		pool.AddCert(cert)
+	}
+
+	return pool, nil
+}
+
+// ExportCertificatePEM gets the identity's certificate PEM encoded, without the
+// private key. Use Identity.ExportCER for the DER form.
+func ExportCertificatePEM(ident Identity) ([]byte, error) {
+	der, err := ident.ExportCER()
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+// ExportChainPEM gets the identity's certificate chain as concatenated PEM
+// blocks, starting with the leaf. A partial chain is exported as far as it
+// could be built, and the error wrapping ErrPartialChain is returned with it.
+func ExportChainPEM(ident Identity) ([]byte, error) {
+	chain, err := ident.CertificateChain()
+	if err != nil && !errors.Is(err, ErrPartialChain) {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	for _, crt := range chain {
+		if pemErr := pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: crt.Raw}); pemErr != nil {
+			return nil, pemErr
+		}
+	}
+
+	return buf.Bytes(), err
+}
+
+// caIssuersURLs gets the AIA caIssuers URLs from an identity's certificate.
+func caIssuersURLs(ident Identity) ([]string, error) {
+	crt, err := ident.Certificate()
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]string{}, crt.IssuingCertificateURL...), nil
+}
+
+// oidTLSFeature is the OID of the TLS Feature extension from RFC 7633.
+var oidTLSFeature = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24}
+
+// tlsFeatureStatusRequest is the status_request TLS extension number.
+const tlsFeatureStatusRequest = 5
+
+// mustStaple checks an identity's certificate for OCSP must-staple.
+func mustStaple(ident Identity) (bool, error) {
+	crt, err := ident.Certificate()
+	if err != nil {
+		return false, err
+	}
+
+	return certMustStaple(crt)
+}
+
+// certMustStaple checks a certificate's TLS Feature extension for
+// status_request.
+func certMustStaple(crt *x509.Certificate) (bool, error) {
+	for _, ext := range crt.Extensions {
+		if !ext.Id.Equal(oidTLSFeature) {
+			continue
+		}
+
+		var features []int
+		if rest, err := asn1.Unmarshal(ext.Value, &features); err != nil {
+			return false, fmt.Errorf("malformed TLS Feature extension: %w", err)
+		} else if len(rest) > 0 {
+			return false, errors.New("trailing data after TLS Feature extension")
+		}
+
+		for _, feature := range features {
+			if feature == tlsFeatureStatusRequest {
+				return true, nil
+			}
+		}
+
+		return false, nil
+	}
+
+	return false, nil
+}
+
+// maxChainLength bounds how many certificates completeChain will fetch, in
+// case of AIA loops.
+const maxChainLength = 10
+
+// completeChain follows AIA caIssuers URLs from the end of an identity's chain
+// to fetch missing intermediates.
+func completeChain(ctx context.Context, ident Identity, fetch func(ctx context.Context, url string) ([]byte, error)) ([]*x509.Certificate, error) {
+	chain, err := ident.CertificateChain()
+	if err != nil && !errors.Is(err, ErrPartialChain) {
+		return nil, err
+	}
+
+	for len(chain) < maxChainLength {
+		last := chain[len(chain)-1]
+		if isSelfSigned(last) || len(last.IssuingCertificateURL) == 0 {
+			return chain, nil
+		}
+
+		if err := ctx.Err(); err != nil {
+			return chain, err
+		}
+
+		issuer, err := fetchIssuer(ctx, last, fetch)
+		if err != nil {
+			return chain, err
+		}
+
+		chain = append(chain, issuer)
+	}
+
+	return chain, errors.New("certificate chain too long")
+}
+
+// fetchIssuer tries each of the certificate's caIssuers URLs in turn, returning
+// the first certificate fetched that issued it.
+func fetchIssuer(ctx context.Context, crt *x509.Certificate, fetch func(ctx context.Context, url string) ([]byte, error)) (*x509.Certificate, error) {
+	var err error
+
+	for _, url := range crt.IssuingCertificateURL {
+		var data []byte
+		if data, err = fetch(ctx, url); err != nil {
+			err = fmt.Errorf("failed to fetch %s: %w", url, err)
+			continue
+		}
+
+		if block, _ := pem.Decode(data); block != nil {
+			data = block.Bytes
+		}
+
+		var issuer *x509.Certificate
+		if issuer, err = x509.ParseCertificate(data); err != nil {
+			err = fmt.Errorf("failed to parse certificate from %s: %w", url, err)
+			continue
+		}
+
+		if err = crt.CheckSignatureFrom(issuer); err != nil {
+			err = fmt.Errorf("certificate from %s isn't the issuer: %w", url, err)
+			continue
+		}
+
+		return issuer, nil
+	}
+
+	return nil, err
+}
+
+// isSelfSigned checks whether a certificate is signed by its own key.
+func isSelfSigned(crt *x509.Certificate) bool {
+	return bytes.Equal(crt.RawIssuer, crt.RawSubject) && crt.CheckSignatureFrom(crt) == nil
+}
+
+// sameKeyAs checks whether two identities' certificates have the same
+// SubjectPublicKeyInfo.
+func sameKeyAs(a, b Identity) (bool, error) {
+	acrt, err := a.Certificate()
+	if err != nil {
+		return false, err
+	}
+
+	bcrt, err := b.Certificate()
+	if err != nil {
+		return false, err
+	}
+
+	return bytes.Equal(acrt.RawSubjectPublicKeyInfo, bcrt.RawSubjectPublicKeyInfo), nil
+}
+
+// exportCER gets a copy of an identity's DER encoded certificate.
+func exportCER(ident Identity) ([]byte, error) {
+	crt, err := ident.Certificate()
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(nil), crt.Raw...), nil
+}
+
+// spkiFingerprint gets the SHA-256 hash of a certificate's SubjectPublicKeyInfo.
+func spkiFingerprint(cert *x509.Certificate) ([]byte, error) {
+	spki, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(spki)
+
+	return sum[:], nil
+}
+
+// checkDigest checks that digest is the right size for hash before it's passed
+// to a key provider, whose errors for bad digests are unhelpful. Keys that sign
+// unhashed messages (i.e. Ed25519) must be handled before this is called, so
+// crypto.Hash(0) is an error.
+func checkDigest(digest []byte, hash crypto.Hash) error {
+	if hash == crypto.Hash(0) {
+		return errors.New("a hash function is required to sign with RSA and ECDSA keys")
+	}
+
+	if len(digest) != hash.Size() {
+		return fmt.Errorf("bad digest for %s: expected %d bytes, got %d", hashName(hash), hash.Size(), len(digest))
+	}
+
+	return nil
+}
+
+// hashName gets a name for hash in error messages.
+func hashName(hash crypto.Hash) string {
+	switch hash {
+	case crypto.MD5:
+		return "MD5"
+	case crypto.SHA1:
+		return "SHA-1"
+	case crypto.SHA224:
+		return "SHA-224"
+	case crypto.SHA256:
+		return "SHA-256"
+	case crypto.SHA384:
+		return "SHA-384"
+	case crypto.SHA512:
+		return "SHA-512"
+	case crypto.MD5SHA1:
+		return "MD5+SHA1"
+	default:
+		return fmt.Sprintf("hash %d", hash)
+	}
+}
+
+// thumbprint gets the SHA-1 thumbprint of a certificate, as displayed by the
+// Windows certificate manager.
+func thumbprint(cert *x509.Certificate) []byte {
+	sum := sha1.Sum(cert.Raw)
+	return sum[:]
+}
+
+// dedupCertificates removes duplicate certificates, preserving order.
+func dedupCertificates(certs []*x509.Certificate) []*x509.Certificate {
+	var (
+		seen   = make(map[string]bool, len(certs))
+		unique = make([]*x509.Certificate, 0, len(certs))
+	)
+
+	for _, cert := range certs {
+		key := string(thumbprint(cert))
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, cert)
+		}
+	}
+
+	return unique
+}
+
+// IdentityRecord is a snapshot of everything known about an identity.
+type IdentityRecord struct {
+	// Certificate is the identity's leaf certificate.
+	Certificate *x509.Certificate
+
+	// Chain is the identity's certificate chain, starting with the leaf.
+	Chain []*x509.Certificate
+
+	// Key describes the identity's key.
+	Key KeyInfo
+
+	// Provider describes the provider holding the private key. It is empty on
+	// platforms without named key providers.
+	Provider ProviderInfo
+
+	// NotBefore and NotAfter are the certificate's validity period.
+	NotBefore, NotAfter time.Time
+
+	// Thumbprint is the SHA-1 thumbprint of the certificate.
+	Thumbprint []byte
+
+	// Err is the first error encountered while gathering the record, if any.
+	// Fields that couldn't be gathered are left empty.
+	Err error
+}
+
+// Inventory gets a snapshot of every identity in the store, including its
+// certificate chain, key and provider information. All identities are read in
+// a single enumeration. Errors for individual identities are recorded in the
+// IdentityRecord rather than failing the whole inventory.
+func Inventory(s Store) ([]IdentityRecord, error) {
+	idents, err := s.Identities()
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]IdentityRecord, 0, len(idents))
+	for _, ident := range idents {
+		records = append(records, newIdentityRecord(ident))
+		ident.Close()
+	}
+
+	return records, nil
+}
+
+// newIdentityRecord gathers an IdentityRecord for an identity.
+func newIdentityRecord(ident Identity) IdentityRecord {
+	var rec IdentityRecord
+
+	crt, err := ident.Certificate()
+	if err != nil {
+		rec.Err = err
+		return rec
+	}
+
+	rec.Certificate = crt
+	rec.Key = keyInfo(crt)
+	rec.NotBefore = crt.NotBefore
+	rec.NotAfter = crt.NotAfter
+	rec.Thumbprint = thumbprint(crt)
+
+	if rec.Chain, err = ident.CertificateChain(); err != nil {
+		rec.Err = err
+	}
+
+	if rec.Provider, err = ident.KeyProviderInfo(); err != nil && !errors.Is(err, ErrUnsupportedOperation) && rec.Err == nil {
+		rec.Err = err
+	}
+
+	return rec
+}
+
+// KeylessPolicy determines how SelectIdentities handles identities whose
+// private key is missing or can't be loaded.
+type KeylessPolicy int
+
+const (
+	// KeylessSkip closes and omits identities without a usable private key.
+	// This is the default.
+	KeylessSkip KeylessPolicy = iota
+
+	// KeylessError fails the selection with ErrNoPrivateKey if any matching
+	// identity is without a usable private key.
+	KeylessError
+
+	// KeylessCollect returns identities without a usable private key in
+	// Selection.Unusable instead of omitting them.
+	KeylessCollect
+)
+
+// SelectOptions configures SelectIdentities.
+type SelectOptions struct {
+	// Match is called with each identity's certificate. Only identities for
+	// which it returns true are selected. All identities match if it is nil.
+	Match func(*x509.Certificate) bool
+
+	// Keyless determines how identities without a usable private key are
+	// handled. By default, they are skipped.
+	Keyless KeylessPolicy
+
+	// Dedup closes and omits identities whose certificate has the same
+	// thumbprint as one already selected, e.g. when the store merges
+	// overlapping system stores.
+	Dedup bool
+
+	// Sort orders the selected identities by certificate expiry, latest
+	// first, and then by thumbprint, so that the order is the same from run
+	// to run. By default, identities are in the order the platform returns
+	// them, which may vary.
+	Sort bool
+}
+
+// Selection is the result of SelectIdentities. The caller must Close() every
+// identity in it.
+type Selection struct {
+	// Identities are the selected identities with a usable private key.
+	Identities []Identity
+
+	// Unusable are the selected identities without a usable private key. It is
+	// only populated when using KeylessCollect.
+	Unusable []Identity
+}
+
+// SelectIdentities selects identities from the store that are suitable for
+// signing. An identity's private key is considered usable if its Signer() can
+// be loaded. Identities that fail to match or are skipped are closed.
+func SelectIdentities(s Store, opts SelectOptions) (*Selection, error) {
+	idents, err := s.Identities()
+	if err != nil {
+		return nil, err
+	}
+
+	sel := &Selection{Identities: []Identity{}}
+
+	for j, ident := range idents {
+		crt, err := ident.Certificate()
+		if err != nil || (opts.Match != nil && !opts.Match(crt)) {
+			ident.Close()
+			continue
+		}
+
+		if _, err := ident.Signer(); err == nil {
+			sel.Identities = append(sel.Identities, ident)
+			continue
+		}
+
+		switch opts.Keyless {
+		case KeylessCollect:
+			sel.Unusable = append(sel.Unusable, ident)
+		case KeylessError:
+			sel.Close()
+			for _, rest := range idents[j:] {
+				rest.Close()
+			}
+
+			return nil, fmt.Errorf("%s: %w", crt.Subject, ErrNoPrivateKey)
+		default:
+			ident.Close()
+		}
+	}
+
+	if opts.Dedup {
+		sel.Identities = dedupIdentities(sel.Identities)
+		sel.Unusable = dedupIdentities(sel.Unusable)
+	}
+
+	if opts.Sort {
+		sortIdentities(sel.Identities)
+		sortIdentities(sel.Unusable)
+	}
+
+	return sel, nil
+}
+
+// dedupIdentities closes and removes identities whose certificate has the same
+// thumbprint as an earlier one, preserving order. Identities whose certificate
+// can't be read are kept.
+func dedupIdentities(idents []Identity) []Identity {
+	var (
+		seen   = make(map[string]bool, len(idents))
+		unique = idents[:0]
+	)
+
+	for _, ident := range idents {
+		if tp, err := ident.Thumbprint(); err == nil {
+			key := string(tp)
+			if seen[key] {
+				ident.Close()
+				continue
+			}
+			seen[key] = true
+		}
+
+		unique = append(unique, ident)
+	}
+
+	return unique
+}
+
+// sortIdentities sorts identities by certificate expiry, latest first, and
+// then by thumbprint. Identities whose certificate can't be read sort last.
+func sortIdentities(idents []Identity) {
+	type sortKey struct {
+		ident      Identity
+		ok         bool
+		notAfter   time.Time
+		thumbprint []byte
+	}
+
+	keys := make([]sortKey, len(idents))
+	for j, ident := range idents {
+		keys[j].ident = ident
+		if crt, err := ident.Certificate(); err == nil {
+			keys[j].ok, keys[j].notAfter = true, crt.NotAfter
+			keys[j].thumbprint, _ = ident.Thumbprint()
+		}
+	}
+
+	sort.SliceStable(keys, func(a, b int) bool {
+		ka, kb := keys[a], keys[b]
+
+		switch {
+		case ka.ok != kb.ok:
+			return ka.ok
+		case !ka.notAfter.Equal(kb.notAfter):
+			return ka.notAfter.After(kb.notAfter)
+		default:
+			return bytes.Compare(ka.thumbprint, kb.thumbprint) < 0
+		}
+	})
+
+	for j := range keys {
+		idents[j] = keys[j].ident
+	}
+}
+
+// Close closes every identity in the selection.
+func (sel *Selection) Close() {
+	for _, ident := range sel.Identities {
+		ident.Close()
+	}
+
+	for _, ident := range sel.Unusable {
+		ident.Close()
+	}
 }
@@ -8,6 +8,7 @@ package certstore
 */
 import "C"
 import (
+	"context"
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/rsa"
@@ -32,17 +33,29 @@ var (
 	nilCFAllocatorRef    C.CFAllocatorRef
 )
 
+// resolveLocations are the store locations searched by ResolveIdentity.
+var resolveLocations = []StoreLocation{StoreLocationCurrentUser}
+
+// Make sure the platform store and identity implement the interfaces returned
+// by Open and Store.Identities.
+var (
+	_ Store    = macStore(0)
+	_ Identity = (*macIdentity)(nil)
+)
+
 // macStore is a bogus type. We have to explicitly open/close the store on
 // windows, so we provide those methods here too.
 type macStore int
 
 // openStore is a function for opening a macStore.
-func openStore() (macStore, error) {
+func openStore(opts OpenOptions) (macStore, error) {
 	return macStore(0), nil
 }
 
 // Identities implements the Store interface.
-func (s macStore) Identities() ([]Identity, error) {
+func (s macStore) Identities() (_ []Identity, err error) {
+	defer trace("certstore.Identities")(&err)
+
 	query := mapToCFDictionary(map[C.CFTypeRef]C.CFTypeRef{
 		C.CFTypeRef(C.kSecClass):      C.CFTypeRef(C.kSecClassIdentity),
 		C.CFTypeRef(C.kSecReturnRef):  C.CFTypeRef(C.kCFBooleanTrue),
@@ -81,6 +94,15 @@ func (s macStore) Identities() ([]Identity, error) {
 
 // Import implements the Store interface.
 func (s macStore) Import(data []byte, password string) error {
+	return s.ImportWithOptions(data, password, ImportOptions{})
+}
+
+// ImportWithOptions implements the Store interface.
+func (s macStore) ImportWithOptions(data []byte, password string, opts ImportOptions) error {
+	if opts.SmartCard {
+		return ErrUnsupportedOperation
+	}
+
 	cdata, err := bytesToCFData(data)
 	if err != nil {
 		return err
@@ -107,6 +129,57 @@ func (s macStore) Import(data []byte, password string) error {
 	return nil
 }
 
+// FindRenewalOf implements the Store interface.
+func (s macStore) FindRenewalOf(cert *x509.Certificate) (Identity, error) {
+	return findRenewalOf(s, cert)
+}
+
+// importEphemeral isn't implemented on macOS.
+func importEphemeral(data []byte, password string) (Store, error) {
+	return nil, ErrNotImplemented
+}
+
+// caCertificates gets the trusted roots for FindCACertificates.
+func caCertificates() ([]*x509.Certificate, error) {
+	return macStore(0).ExportTrustAnchors()
+}
+
+// systemRoots gets the certificates for SystemRootPool.
+func systemRoots() ([]*x509.Certificate, error) {
+	return caCertificates()
+}
+
+// ExportTrustAnchors implements the Store interface.
+func (s macStore) ExportTrustAnchors() ([]*x509.Certificate, error) {
+	var aryResult C.CFArrayRef
+	if err := osStatusError(C.SecTrustCopyAnchorCertificates(&aryResult)); err != nil {
+		return nil, err
+	}
+	defer C.CFRelease(C.CFTypeRef(aryResult))
+
+	n := C.CFArrayGetCount(aryResult)
+	if n == 0 {
+		return []*x509.Certificate{}, nil
+	}
+
+	// certRefs are owned by the array.
+	certRefs := make([]C.CFTypeRef, n)
+	C.CFArrayGetValues(aryResult, C.CFRange{0, n}, (*unsafe.Pointer)(unsafe.Pointer(&certRefs[0])))
+
+	anchors := make([]*x509.Certificate, 0, int(n))
+	for _, certRef := range certRefs {
+		crt, err := exportCertRef(C.SecCertificateRef(certRef))
+		if err != nil {
+			// Skip certs that Go can't parse.
+			continue
+		}
+
+		anchors = append(anchors, crt)
+	}
+
+	return dedupCertificates(anchors), nil
+}
+
 // Close implements the Store interface.
 func (s macStore) Close() {}
 
@@ -117,6 +190,7 @@ type macIdentity struct {
 	cref  C.SecCertificateRef
 	crt   *x509.Certificate
 	chain []*x509.Certificate
+	spki  []byte
 }
 
 func newMacIdentity(ref C.SecIdentityRef) *macIdentity {
@@ -126,6 +200,10 @@ func newMacIdentity(ref C.SecIdentityRef) *macIdentity {
 
 // Certificate implements the Identity interface.
 func (i *macIdentity) Certificate() (*x509.Certificate, error) {
+	if i.ref == nilSecIdentityRef {
+		return nil, ErrClosed
+	}
+
 	certRef, err := i.getCertRef()
 	if err != nil {
 		return nil, err
@@ -194,10 +272,15 @@ func (i *macIdentity) CertificateChain() ([]*x509.Certificate, error) {
 func (i *macIdentity) Signer() (crypto.Signer, error) {
 	// pre-load the certificate so Public() is less likely to return nil
 	// unexpectedly.
-	if _, err := i.Certificate(); err != nil {
+	crt, err := i.Certificate()
+	if err != nil {
 		return nil, err
 	}
 
+	if signer := testSigner(crt); signer != nil {
+		return signer, nil
+	}
+
 	return i, nil
 }
 
@@ -227,6 +310,110 @@ func (i *macIdentity) Delete() error {
 	return nil
 }
 
+// Clone implements the Identity interface.
+func (i *macIdentity) Clone() (Identity, error) {
+	if i.ref == nilSecIdentityRef {
+		return nil, ErrClosed
+	}
+
+	// newMacIdentity retains the SecIdentityRef, so the clone can be released
+	// independently.
+	return newMacIdentity(i.ref), nil
+}
+
+// SetArchived implements the Identity interface.
+func (i *macIdentity) SetArchived(archived bool) error {
+	return ErrUnsupportedOperation
+}
+
+// MustStaple implements the Identity interface.
+func (i *macIdentity) MustStaple() (bool, error) {
+	return mustStaple(i)
+}
+
+// CompleteChain implements the Identity interface.
+func (i *macIdentity) CompleteChain(ctx context.Context, fetch func(ctx context.Context, url string) ([]byte, error)) ([]*x509.Certificate, error) {
+	return completeChain(ctx, i, fetch)
+}
+
+// CAIssuersURLs implements the Identity interface.
+func (i *macIdentity) CAIssuersURLs() ([]string, error) {
+	return caIssuersURLs(i)
+}
+
+// SameKeyAs implements the Identity interface.
+func (i *macIdentity) SameKeyAs(other Identity) (bool, error) {
+	return sameKeyAs(i, other)
+}
+
+// KeyInfo implements the Identity interface.
+func (i *macIdentity) KeyInfo() (KeyInfo, error) {
+	return identityKeyInfo(i)
+}
+
+// Thumbprint implements the Identity interface.
+func (i *macIdentity) Thumbprint() ([]byte, error) {
+	return identityThumbprint(i)
+}
+
+// ThumbprintSHA256 implements the Identity interface.
+func (i *macIdentity) ThumbprintSHA256() ([]byte, error) {
+	return identityThumbprintSHA256(i)
+}
+
+// Capabilities implements the Identity interface.
+func (i *macIdentity) Capabilities() (KeyCapabilities, error) {
+	return identityCapabilities(i)
+}
+
+// DisplayName implements the Identity interface.
+func (i *macIdentity) DisplayName() (string, error) {
+	return subjectDisplayName(i)
+}
+
+// ExportPFX implements the Identity interface.
+func (i *macIdentity) ExportPFX(password string) ([]byte, error) {
+	return nil, ErrNotImplemented
+}
+
+// ExportCER implements the Identity interface.
+func (i *macIdentity) ExportCER() ([]byte, error) {
+	return exportCER(i)
+}
+
+// SPKIFingerprint implements the Identity interface.
+func (i *macIdentity) SPKIFingerprint() ([]byte, error) {
+	if i.spki != nil {
+		return append([]byte(nil), i.spki...), nil
+	}
+
+	crt, err := i.Certificate()
+	if err != nil {
+		return nil, err
+	}
+
+	if i.spki, err = spkiFingerprint(crt); err != nil {
+		return nil, err
+	}
+
+	return append([]byte(nil), i.spki...), nil
+}
+
+// VerifyForUsage implements the Identity interface.
+func (i *macIdentity) VerifyForUsage(usageOIDs []string) error {
+	return ErrNotImplemented
+}
+
+// ReaderName implements the Identity interface.
+func (i *macIdentity) ReaderName() (string, error) {
+	return "", ErrUnsupportedOperation
+}
+
+// KeyProviderInfo implements the Identity interface.
+func (i *macIdentity) KeyProviderInfo() (ProviderInfo, error) {
+	return ProviderInfo{}, ErrNotImplemented
+}
+
 // Close implements the Identity interface.
 func (i *macIdentity) Close() {
 	if i.ref != nilSecIdentityRef {
@@ -256,11 +443,30 @@ func (i *macIdentity) Public() crypto.PublicKey {
 }
 
 // Sign implements the crypto.Signer interface.
-func (i *macIdentity) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+func (i *macIdentity) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) (_ []byte, err error) {
+	defer trace("certstore.Sign")(&err)
+
+	// Security.framework always produces big-endian signatures, so
+	// LittleEndianOpts only needs unwrapping.
+	if opts, _, err = unwrapLittleEndianOpts(opts); err != nil {
+		return nil, err
+	}
+
 	hash := opts.HashFunc()
 
-	if len(digest) != hash.Size() {
-		return nil, errors.New("bad digest for hash")
+	// Security.framework always uses a salt as long as the hash. Fail rather
+	// than silently producing a signature with a different salt length.
+	pssOpts, isPSS := opts.(*rsa.PSSOptions)
+	if isPSS {
+		switch pssOpts.SaltLength {
+		case rsa.PSSSaltLengthAuto, rsa.PSSSaltLengthEqualsHash, hash.Size():
+		default:
+			return nil, ErrPSSUnsupportedByProvider
+		}
+	}
+
+	if err := checkDigest(digest, hash); err != nil {
+		return nil, err
 	}
 
 	kref, err := i.getKeyRef()
@@ -274,7 +480,7 @@ func (i *macIdentity) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts
 	}
 	defer C.CFRelease(C.CFTypeRef(cdigest))
 
-	algo, err := i.getAlgo(hash)
+	algo, err := i.getAlgo(hash, isPSS)
 	if err != nil {
 		return nil, err
 	}
@@ -300,8 +506,9 @@ func (i *macIdentity) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts
 	return sig, nil
 }
 
-// getAlgo decides which algorithm to use with this key type for the given hash.
-func (i *macIdentity) getAlgo(hash crypto.Hash) (algo C.SecKeyAlgorithm, err error) {
+// getAlgo decides which algorithm to use with this key type for the given hash
+// and padding.
+func (i *macIdentity) getAlgo(hash crypto.Hash, pss bool) (algo C.SecKeyAlgorithm, err error) {
 	var crt *x509.Certificate
 	if crt, err = i.Certificate(); err != nil {
 		return
@@ -312,6 +519,8 @@ func (i *macIdentity) getAlgo(hash crypto.Hash) (algo C.SecKeyAlgorithm, err err
 		switch hash {
 		case crypto.SHA1:
 			algo = C.kSecKeyAlgorithmECDSASignatureDigestX962SHA1
+		case crypto.SHA224:
+			algo = C.kSecKeyAlgorithmECDSASignatureDigestX962SHA224
 		case crypto.SHA256:
 			algo = C.kSecKeyAlgorithmECDSASignatureDigestX962SHA256
 		case crypto.SHA384:
@@ -322,15 +531,38 @@ func (i *macIdentity) getAlgo(hash crypto.Hash) (algo C.SecKeyAlgorithm, err err
 			err = ErrUnsupportedHash
 		}
 	case *rsa.PublicKey:
+		if pss {
+			switch hash {
+			case crypto.SHA1:
+				algo = C.kSecKeyAlgorithmRSASignatureDigestPSSSHA1
+			case crypto.SHA224:
+				algo = C.kSecKeyAlgorithmRSASignatureDigestPSSSHA224
+			case crypto.SHA256:
+				algo = C.kSecKeyAlgorithmRSASignatureDigestPSSSHA256
+			case crypto.SHA384:
+				algo = C.kSecKeyAlgorithmRSASignatureDigestPSSSHA384
+			case crypto.SHA512:
+				algo = C.kSecKeyAlgorithmRSASignatureDigestPSSSHA512
+			default:
+				err = ErrUnsupportedHash
+			}
+			break
+		}
+
 		switch hash {
 		case crypto.SHA1:
 			algo = C.kSecKeyAlgorithmRSASignatureDigestPKCS1v15SHA1
+		case crypto.SHA224:
+			algo = C.kSecKeyAlgorithmRSASignatureDigestPKCS1v15SHA224
 		case crypto.SHA256:
 			algo = C.kSecKeyAlgorithmRSASignatureDigestPKCS1v15SHA256
 		case crypto.SHA384:
 			algo = C.kSecKeyAlgorithmRSASignatureDigestPKCS1v15SHA384
 		case crypto.SHA512:
 			algo = C.kSecKeyAlgorithmRSASignatureDigestPKCS1v15SHA512
+		case crypto.MD5SHA1:
+			// TLS 1.0 and 1.1 sign the MD5+SHA1 digest without a DigestInfo.
+			algo = C.kSecKeyAlgorithmRSASignatureDigestPKCS1v15Raw
 		default:
 			err = ErrUnsupportedHash
 		}
@@ -342,11 +574,13 @@ func (i *macIdentity) getAlgo(hash crypto.Hash) (algo C.SecKeyAlgorithm, err err
 }
 
 // getKeyRef gets the SecKeyRef for this identity's pricate key.
-func (i *macIdentity) getKeyRef() (C.SecKeyRef, error) {
+func (i *macIdentity) getKeyRef() (_ C.SecKeyRef, err error) {
 	if i.kref != nilSecKeyRef {
 		return i.kref, nil
 	}
 
+	defer trace("certstore.AcquireKey")(&err)
+
 	var keyRef C.SecKeyRef
 	if err := osStatusError(C.SecIdentityCopyPrivateKey(i.ref, &keyRef)); err != nil {
 		return nilSecKeyRef, err
@@ -1,92 +1,782 @@
 package certstore
 
 import (
+	"bytes"
+	"context"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
 	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/ThalesIgnite/crypto11"
+	"github.com/miekg/pkcs11"
 	"github.com/pkg/errors"
+	"software.sslmate.com/src/go-pkcs12"
 )
 
+// rootBundleFiles are the locations of the system's root CA bundle on common
+// distributions.
+var rootBundleFiles = []string{
+	"/etc/ssl/certs/ca-certificates.crt",                // Debian/Ubuntu/Gentoo etc.
+	"/etc/pki/tls/certs/ca-bundle.crt",                  // Fedora/RHEL 6
+	"/etc/ssl/ca-bundle.pem",                            // OpenSUSE
+	"/etc/pki/tls/cacert.pem",                           // OpenELEC
+	"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem", // CentOS/RHEL 7
+	"/etc/ssl/cert.pem",                                 // Alpine Linux
+}
+
+// resolveLocations are the store locations searched by ResolveIdentity.
+var resolveLocations = []StoreLocation{StoreLocationCurrentUser}
+
+// Make sure the platform store and identity implement the interfaces returned
+// by Open and Store.Identities.
 var (
-	// ErrLinuxNoU is a generic error
-	ErrLinuxNoU = errors.New("No U!")
+	_ Store    = (*linuxStore)(nil)
+	_ Identity = (*linuxIdent)(nil)
 )
 
+// linuxStore guards the PKCS#11 context with mu the same way winStore guards
+// its store handle, so Close waits for in-flight enumeration.
 type linuxStore struct {
-	ctx *crypto11.Context
+	mu        sync.RWMutex
+	ctx       *crypto11.Context
+	config    *crypto11.Config
+	opts      OpenOptions
+	closed    bool
+	closeOnce sync.Once
 }
 
 type linuxIdent struct {
+	store  *linuxStore
 	cert   *x509.Certificate
 	signer crypto.Signer
+	spki   []byte
+	closed bool
 }
 
-// Implement this function, just to silence other compiler errors.
-func openStore() (*linuxStore, error) {
-	fmt.Println("awoo")
-	slot := 1
-	config := &crypto11.Config{
-		Path:       "/usr/lib/x86_64-linux-gnu/pkcs11/opensc-pkcs11.so",
-		SlotNumber: &slot,
-		Pin:        "123456",
+// defaultPKCS11Module is the module used if none is configured.
+const defaultPKCS11Module = "/usr/lib/x86_64-linux-gnu/pkcs11/opensc-pkcs11.so"
+
+// OpenPKCS11 opens the PKCS#11 token described by config as a Store.
+func OpenPKCS11(config PKCS11Options) (Store, error) {
+	return OpenWithOptions(OpenOptions{PKCS11: config})
+}
+
+// openStore opens the configured PKCS#11 token.
+func openStore(opts OpenOptions) (*linuxStore, error) {
+	config, err := pkcs11Config(opts.PKCS11)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Pin == "" && opts.PKCS11.PINFunc != nil {
+		if config.Pin, err = opts.PKCS11.PINFunc(); err != nil {
+			return nil, errors.Wrap(err, "failed to get PKCS#11 PIN")
+		}
 	}
 
 	ctx, err := crypto11.Configure(config)
+
+	// Go strings can't be zeroed, but drop our reference to the PIN as soon as
+	// we've logged in so it isn't retained any longer than crypto11 needs it.
+	config.Pin = ""
+
 	if err != nil {
-		return nil, err
+		return nil, errors.Wrapf(err, "failed to open PKCS#11 token with module %s", config.Path)
 	}
 
-	return &linuxStore{ctx: ctx}, nil
+	return &linuxStore{ctx: ctx, config: config, opts: opts}, nil
 }
 
-func (store *linuxStore) Identities() ([]Identity, error) {
-	serial := new(big.Int)
-	serial.SetString("04024FFB1E82B2A48FD1BA7B393DD897", 16)
-	cert, err := store.ctx.FindCertificate(nil, nil, serial)
-	if err != nil {
-		panic(err)
+// pkcs11Config builds the crypto11 config from the options, falling back to
+// environment variables for empty fields.
+func pkcs11Config(opts PKCS11Options) (*crypto11.Config, error) {
+	config := &crypto11.Config{
+		Path:       opts.ModulePath,
+		SlotNumber: opts.Slot,
+		TokenLabel: opts.TokenLabel,
+		Pin:        opts.PIN,
+	}
+
+	if config.Path == "" {
+		config.Path = os.Getenv("PKCS11_MODULE")
+	}
+	if config.Path == "" {
+		config.Path = defaultPKCS11Module
+	}
+
+	if config.SlotNumber == nil && config.TokenLabel == "" {
+		if slot := os.Getenv("PKCS11_SLOT"); slot != "" {
+			n, err := strconv.Atoi(slot)
+			if err != nil {
+				return nil, errors.Errorf("invalid PKCS11_SLOT: %q", slot)
+			}
+			config.SlotNumber = &n
+		} else if label := os.Getenv("PKCS11_TOKEN_LABEL"); label != "" {
+			config.TokenLabel = label
+		} else {
+			return nil, errors.New("no PKCS#11 token selected: set PKCS11Options.Slot or TokenLabel, or PKCS11_SLOT or PKCS11_TOKEN_LABEL")
+		}
+	} else if config.SlotNumber != nil && config.TokenLabel != "" {
+		return nil, errors.New("only one of PKCS11Options.Slot and TokenLabel can be set")
+	}
+
+	if config.Pin == "" {
+		config.Pin = os.Getenv("PKCS11_PIN")
+	}
+
+	if _, err := os.Stat(config.Path); err != nil {
+		return nil, errors.Wrap(err, "failed to load PKCS#11 module")
+	}
+
+	return config, nil
+}
+
+// Identities are certificates on the token paired with a private key by CKA_ID,
+// which tokens conventionally set to the certificate's subject key ID.
+// Certificates without a private key are skipped.
+func (store *linuxStore) Identities() (_ []Identity, err error) {
+	defer trace("certstore.Identities")(&err)
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	if store.closed {
+		return nil, ErrClosed
 	}
 
-	signer, err := store.ctx.FindKeyPair(cert.SubjectKeyId, nil)
+	pairs, err := store.ctx.FindAllPairedCertificates()
 	if err != nil {
-		panic(err)
+		return nil, errors.Wrap(err, "failed to enumerate token certificates")
 	}
 
-	ident := linuxIdent{
-		cert:   cert,
-		signer: signer,
+	idents := make([]Identity, 0, len(pairs))
+
+	for _, pair := range pairs {
+		if len(pair.Certificate) == 0 {
+			continue
+		}
+
+		cert := pair.Leaf
+		if cert == nil {
+			if cert, err = x509.ParseCertificate(pair.Certificate[0]); err != nil {
+				return nil, errors.Wrap(err, "failed to parse token certificate")
+			}
+		}
+
+		signer, ok := pair.PrivateKey.(crypto.Signer)
+		if !ok {
+			continue
+		}
+
+		idents = append(idents, &linuxIdent{
+			store:  store,
+			cert:   cert,
+			signer: signer,
+		})
 	}
-	idents := []Identity{&ident}
+
 	return idents, nil
 }
 
-// PKCS#11 store doesn't support import (because I am lazy)
+// Import writes the PKCS#12 identity's key pair and certificate to the token,
+// using the certificate's subject key ID as their CKA_ID so that they're paired
+// by Identities. Any CA certificates in the PKCS#12 data are ignored.
 func (store *linuxStore) Import(data []byte, password string) error {
-	return ErrLinuxNoU
+	key, cert, _, err := pkcs12.DecodeChain(data, password)
+	if err != nil {
+		return errors.Wrap(err, "failed to decode PKCS#12 data")
+	}
+
+	id := cert.SubjectKeyId
+	if len(id) == 0 {
+		sum := sha1.Sum(cert.RawSubjectPublicKeyInfo)
+		id = sum[:]
+	}
+	label := []byte(cert.Subject.CommonName)
+
+	pubTemplate, privTemplate, err := keyTemplates(id, label, key)
+	if err != nil {
+		return err
+	}
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	if store.closed {
+		return ErrClosed
+	}
+
+	// crypto11 can't import private keys, so create the key objects through a
+	// session of our own.
+	return store.withSession(func(p *pkcs11.Ctx, session pkcs11.SessionHandle) error {
+		priv, err := p.CreateObject(session, privTemplate)
+		if err != nil {
+			return errors.Wrap(err, "failed to import private key")
+		}
+
+		pub, err := p.CreateObject(session, pubTemplate)
+		if err != nil {
+			p.DestroyObject(session, priv)
+			return errors.Wrap(err, "failed to import public key")
+		}
+
+		if err := store.ctx.ImportCertificateWithLabel(id, label, cert); err != nil {
+			p.DestroyObject(session, pub)
+			p.DestroyObject(session, priv)
+			return errors.Wrap(err, "failed to import certificate")
+		}
+
+		return nil
+	})
+}
+
+// keyTemplates builds the attributes for creating the public and private key
+// objects for key on the token.
+func keyTemplates(id, label []byte, key interface{}) (pub, priv []*pkcs11.Attribute, err error) {
+	common := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		k.Precompute()
+
+		public := append(common,
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS, k.N.Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, big.NewInt(int64(k.E)).Bytes()),
+		)
+
+		pub = append([]*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+			pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+			pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, true),
+		}, public...)
+
+		priv = append([]*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, true),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIVATE_EXPONENT, k.D.Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIME_1, k.Primes[0].Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIME_2, k.Primes[1].Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_EXPONENT_1, k.Precomputed.Dp.Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_EXPONENT_2, k.Precomputed.Dq.Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_COEFFICIENT, k.Precomputed.Qinv.Bytes()),
+		}, public...)
+	case *ecdsa.PrivateKey:
+		oid, ok := curveOIDs[k.Curve]
+		if !ok {
+			return nil, nil, errors.New("unsupported elliptic curve")
+		}
+
+		params, err := asn1.Marshal(oid)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		point, err := asn1.Marshal(elliptic.Marshal(k.Curve, k.X, k.Y))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		common = append(common,
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, params),
+		)
+
+		pub = append([]*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+			pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, point),
+		}, common...)
+
+		priv = append([]*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_VALUE, k.D.Bytes()),
+		}, common...)
+	default:
+		return nil, nil, errors.New("unsupported private key type")
+	}
+
+	return pub, priv, nil
+}
+
+// curveOIDs are the named curve OIDs used for CKA_EC_PARAMS.
+var curveOIDs = map[elliptic.Curve]asn1.ObjectIdentifier{
+	elliptic.P224(): {1, 3, 132, 0, 33},
+	elliptic.P256(): {1, 2, 840, 10045, 3, 1, 7},
+	elliptic.P384(): {1, 3, 132, 0, 34},
+	elliptic.P521(): {1, 3, 132, 0, 35},
+}
+
+// withSession calls f with a read/write session on the store's token, for
+// operations crypto11 doesn't support. crypto11 has already initialized the
+// module and logged in, and login state is shared by all of a process's
+// sessions, so the session is usable for private objects.
+func (store *linuxStore) withSession(f func(*pkcs11.Ctx, pkcs11.SessionHandle) error) error {
+	p := pkcs11.New(store.config.Path)
+	if p == nil {
+		return errors.Errorf("failed to load PKCS#11 module %s", store.config.Path)
+	}
+	defer p.Destroy()
+
+	if err := p.Initialize(); err != nil && err != pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED) {
+		return errors.Wrap(err, "failed to initialize PKCS#11 module")
+	}
+
+	slot, err := store.findSlot(p)
+	if err != nil {
+		return err
+	}
+
+	session, err := p.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		return errors.Wrap(err, "failed to open PKCS#11 session")
+	}
+	defer p.CloseSession(session)
+
+	return f(p, session)
+}
+
+// findSlot finds the slot of the token selected by the store's config.
+func (store *linuxStore) findSlot(p *pkcs11.Ctx) (uint, error) {
+	if store.config.SlotNumber != nil {
+		return uint(*store.config.SlotNumber), nil
+	}
+
+	slots, err := p.GetSlotList(true)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to list PKCS#11 slots")
+	}
+
+	for _, slot := range slots {
+		info, err := p.GetTokenInfo(slot)
+		if err != nil {
+			continue
+		}
+
+		if strings.TrimSpace(info.Label) == store.config.TokenLabel {
+			return slot, nil
+		}
+	}
+
+	return 0, errors.Errorf("no PKCS#11 token labelled %q", store.config.TokenLabel)
+}
+
+func (store *linuxStore) ImportWithOptions(data []byte, password string, opts ImportOptions) error {
+	if opts.SmartCard {
+		return ErrUnsupportedOperation
+	}
+
+	return store.Import(data, password)
+}
+
+func (store *linuxStore) FindRenewalOf(cert *x509.Certificate) (Identity, error) {
+	return findRenewalOf(store, cert)
+}
+
+// The token doesn't hold the system's trust anchors, so read them from the
+// first root bundle found on disk.
+func (store *linuxStore) ExportTrustAnchors() ([]*x509.Certificate, error) {
+	return caCertificates()
+}
+
+// importEphemeral isn't implemented for PKCS#11 tokens.
+func importEphemeral(data []byte, password string) (Store, error) {
+	return nil, ErrNotImplemented
 }
 
+// caCertificates reads the first root bundle found on disk, for
+// ExportTrustAnchors and FindCACertificates.
+func caCertificates() ([]*x509.Certificate, error) {
+	for _, file := range rootBundleFiles {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+
+		return dedupCertificates(parsePEMCertificates(data)), nil
+	}
+
+	return nil, errors.New("no root CA bundle found")
+}
+
+// systemRoots gets the certificates for SystemRootPool: the root bundle, plus
+// the CA certificates on the token configured in the environment, if any.
+// Certificates are public objects, so the token is read without logging in.
+func systemRoots() ([]*x509.Certificate, error) {
+	certs, bundleErr := caCertificates()
+
+	if config, err := pkcs11Config(PKCS11Options{}); err == nil {
+		store := &linuxStore{config: config}
+		if tokenCerts, err := store.tokenCACertificates(); err == nil {
+			certs = dedupCertificates(append(certs, tokenCerts...))
+		}
+	}
+
+	if len(certs) == 0 && bundleErr != nil {
+		return nil, bundleErr
+	}
+
+	return certs, nil
+}
+
+// tokenCACertificates reads the CA certificates on the store's token.
+func (store *linuxStore) tokenCACertificates() ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+
+	err := store.withSession(func(p *pkcs11.Ctx, session pkcs11.SessionHandle) error {
+		template := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_CERTIFICATE)}
+		if err := p.FindObjectsInit(session, template); err != nil {
+			return errors.Wrap(err, "failed to search token certificates")
+		}
+		defer p.FindObjectsFinal(session)
+
+		for {
+			objects, _, err := p.FindObjects(session, 32)
+			if err != nil {
+				return errors.Wrap(err, "failed to search token certificates")
+			}
+			if len(objects) == 0 {
+				return nil
+			}
+
+			for _, object := range objects {
+				attrs, err := p.GetAttributeValue(session, object, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil)})
+				if err != nil || len(attrs) == 0 {
+					continue
+				}
+
+				cert, err := x509.ParseCertificate(attrs[0].Value)
+				if err != nil || !cert.IsCA {
+					continue
+				}
+
+				certs = append(certs, cert)
+			}
+		}
+	})
+
+	return certs, err
+}
+
+// parsePEMCertificates parses all the certificates in PEM data, skipping any
+// that fail to parse.
+func parsePEMCertificates(data []byte) []*x509.Certificate {
+	var certs []*x509.Certificate
+
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			break
+		}
+
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+
+		certs = append(certs, cert)
+	}
+
+	return certs
+}
+
+// findIssuer finds the certificate that issued crt. CA certificates are
+// conventionally stored on tokens with their subject key ID as their CKA_ID, so
+// the token is searched for crt's authority key ID.
+func (store *linuxStore) findIssuer(crt *x509.Certificate) *x509.Certificate {
+	var candidates []*x509.Certificate
+
+	if store.ctx != nil && len(crt.AuthorityKeyId) > 0 {
+		if ca, err := store.ctx.FindCertificate(crt.AuthorityKeyId, nil, nil); err == nil && ca != nil {
+			candidates = append(candidates, ca)
+		}
+	}
+
+	candidates = append(candidates, store.opts.Intermediates...)
+
+	for _, ca := range candidates {
+		if bytes.Equal(ca.RawSubject, crt.RawIssuer) && crt.CheckSignatureFrom(ca) == nil {
+			return ca
+		}
+	}
+
+	return nil
+}
+
+// Close may also be called by SignContext to abort a hung sign, so only close
+// the context once.
 func (store *linuxStore) Close() {
-	store.ctx.Close()
+	store.closeOnce.Do(func() {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+
+		store.closed = true
+		store.ctx.Close()
+	})
 }
 
 func (ident *linuxIdent) Certificate() (*x509.Certificate, error) {
+	if ident.closed {
+		return nil, ErrClosed
+	}
+
 	return ident.cert, nil
 }
 
+// The chain is assembled by looking up each certificate's issuer on the token
+// and in OpenOptions.Intermediates.
 func (ident *linuxIdent) CertificateChain() ([]*x509.Certificate, error) {
-	return []*x509.Certificate{ident.cert}, nil
+	if ident.closed {
+		return nil, ErrClosed
+	}
+
+	chain := []*x509.Certificate{ident.cert}
+
+	for len(chain) < maxChainLength {
+		last := chain[len(chain)-1]
+		if isSelfSigned(last) {
+			return chain, nil
+		}
+
+		issuer := ident.store.findIssuer(last)
+		if issuer == nil {
+			return chain, fmt.Errorf("no issuer found for %q: %w", last.Subject.String(), ErrPartialChain)
+		}
+
+		chain = append(chain, issuer)
+	}
+
+	return chain, errors.New("certificate chain too long")
 }
 
+// Delete removes the certificate and then its key pair from the token, matching
+// the certificate by the key pair's CKA_ID. If the key pair can't be removed
+// after the certificate was, the returned error says so, since the key is left
+// on the token without a certificate.
 func (ident *linuxIdent) Delete() error {
-	return ErrLinuxNoU
+	key, ok := ident.signer.(crypto11.Signer)
+	if !ok {
+		return ErrUnsupportedOperation
+	}
+
+	ident.store.mu.RLock()
+	defer ident.store.mu.RUnlock()
+
+	if ident.store.closed {
+		return ErrClosed
+	}
+
+	id, err := ident.store.ctx.GetAttribute(key, crypto11.CkaId)
+	if err != nil {
+		return errors.Wrap(err, "failed to get key pair CKA_ID")
+	}
+
+	if err := ident.store.ctx.DeleteCertificate(id.Value, nil, ident.cert.SerialNumber); err != nil {
+		return errors.Wrap(err, "failed to delete certificate")
+	}
+
+	if err := key.Delete(); err != nil {
+		return errors.Wrap(err, "certificate deleted, but failed to delete key pair")
+	}
+
+	return nil
 }
 
 func (ident *linuxIdent) Signer() (crypto.Signer, error) {
-	return ident.signer, nil
+	if signer := testSigner(ident.cert); signer != nil {
+		return signer, nil
+	}
+
+	return linuxSigner{ident.signer, ident.store}, nil
+}
+
+// linuxSigner wraps a token key to record spans around signing and to support
+// cancellation.
+type linuxSigner struct {
+	crypto.Signer
+	store *linuxStore
+}
+
+func (s linuxSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) (_ []byte, err error) {
+	defer trace("certstore.Sign")(&err)
+
+	// Tokens always produce big-endian signatures, so LittleEndianOpts only
+	// needs unwrapping.
+	if opts, _, err = unwrapLittleEndianOpts(opts); err != nil {
+		return nil, err
+	}
+
+	if err := checkDigest(digest, opts.HashFunc()); err != nil {
+		return nil, err
+	}
+
+	return s.Signer.Sign(rand, digest, opts)
+}
+
+// SignContext implements the ContextSigner interface. Some USB tokens wedge
+// and block in C_Sign forever. If ctx is done first, the store's PKCS#11
+// context is closed to abort the sign and ctx.Err() is returned. Whether this
+// actually unblocks C_Sign depends on how the module handles sessions being
+// closed from another thread. Either way, the store and every identity from it
+// are unusable afterwards, and the store must be reopened.
+func (s linuxSigner) SignContext(ctx context.Context, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	type result struct {
+		sig []byte
+		err error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		sig, err := s.Sign(rand.Reader, digest, opts)
+		done <- result{sig, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.sig, res.err
+	case <-ctx.Done():
+		// Closing may block behind the hung sign, so don't wait for it.
+		go s.store.Close()
+		return nil, ctx.Err()
+	}
+}
+
+func (ident *linuxIdent) SetArchived(archived bool) error {
+	return ErrUnsupportedOperation
+}
+
+func (ident *linuxIdent) MustStaple() (bool, error) {
+	return mustStaple(ident)
+}
+
+func (ident *linuxIdent) CompleteChain(ctx context.Context, fetch func(ctx context.Context, url string) ([]byte, error)) ([]*x509.Certificate, error) {
+	return completeChain(ctx, ident, fetch)
+}
+
+func (ident *linuxIdent) CAIssuersURLs() ([]string, error) {
+	return caIssuersURLs(ident)
+}
+
+func (ident *linuxIdent) SameKeyAs(other Identity) (bool, error) {
+	return sameKeyAs(ident, other)
+}
+
+func (ident *linuxIdent) KeyInfo() (KeyInfo, error) {
+	return identityKeyInfo(ident)
+}
+
+// Thumbprint implements the Identity interface.
+func (ident *linuxIdent) Thumbprint() ([]byte, error) {
+	return identityThumbprint(ident)
+}
+
+// ThumbprintSHA256 implements the Identity interface.
+func (ident *linuxIdent) ThumbprintSHA256() ([]byte, error) {
+	return identityThumbprintSHA256(ident)
+}
+
+// Capabilities implements the Identity interface.
+func (ident *linuxIdent) Capabilities() (KeyCapabilities, error) {
+	return identityCapabilities(ident)
+}
+
+// DisplayName implements the Identity interface. The private key's CKA_LABEL is
+// used if it is set.
+func (ident *linuxIdent) DisplayName() (string, error) {
+	if ident.closed {
+		return "", ErrClosed
+	}
+
+	if key, ok := ident.signer.(crypto11.Signer); ok {
+		ident.store.mu.RLock()
+		defer ident.store.mu.RUnlock()
+
+		if ident.store.closed {
+			return "", ErrClosed
+		}
+
+		if label, err := ident.store.ctx.GetAttribute(key, crypto11.CkaLabel); err == nil && label != nil && len(label.Value) > 0 {
+			return string(label.Value), nil
+		}
+	}
+
+	return subjectDisplayName(ident)
+}
+
+func (ident *linuxIdent) ExportPFX(password string) ([]byte, error) {
+	return nil, ErrNotImplemented
+}
+
+func (ident *linuxIdent) ExportCER() ([]byte, error) {
+	return exportCER(ident)
+}
+
+func (ident *linuxIdent) SPKIFingerprint() ([]byte, error) {
+	cert, err := ident.Certificate()
+	if err != nil {
+		return nil, err
+	}
+
+	if ident.spki == nil {
+		if ident.spki, err = spkiFingerprint(cert); err != nil {
+			return nil, err
+		}
+	}
+
+	return append([]byte(nil), ident.spki...), nil
+}
+
+func (ident *linuxIdent) VerifyForUsage(usageOIDs []string) error {
+	return ErrNotImplemented
+}
+
+func (ident *linuxIdent) ReaderName() (string, error) {
+	return "", ErrNotImplemented
+}
+
+func (ident *linuxIdent) KeyProviderInfo() (ProviderInfo, error) {
+	return ProviderInfo{}, ErrNotImplemented
 }
 
 func (ident *linuxIdent) Close() {
+	ident.closed = true
+}
+
+// The certificate and signer are never mutated, so a shallow copy is safe to
+// hand off.
+func (ident *linuxIdent) Clone() (Identity, error) {
+	if ident.closed {
+		return nil, ErrClosed
+	}
+
+	clone := *ident
+	return &clone, nil
 }
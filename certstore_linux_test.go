@@ -0,0 +1,137 @@
+package certstore
+
+import (
+	"crypto/sha1"
+	"crypto/x509"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestPKCS11Config(t *testing.T) {
+	for _, name := range []string{"PKCS11_MODULE", "PKCS11_SLOT", "PKCS11_TOKEN_LABEL", "PKCS11_PIN"} {
+		defer os.Setenv(name, os.Getenv(name))
+		os.Unsetenv(name)
+	}
+
+	module := os.Args[0]
+	slot := 2
+
+	if _, err := pkcs11Config(PKCS11Options{ModulePath: module}); err == nil {
+		t.Fatal("expected error without a token selection")
+	}
+	if _, err := pkcs11Config(PKCS11Options{ModulePath: module, Slot: &slot, TokenLabel: "token"}); err == nil {
+		t.Fatal("expected error with both slot and token label")
+	}
+	if _, err := pkcs11Config(PKCS11Options{ModulePath: module + ".missing", Slot: &slot}); err == nil {
+		t.Fatal("expected error for missing module")
+	}
+
+	os.Setenv("PKCS11_MODULE", module)
+	os.Setenv("PKCS11_TOKEN_LABEL", "token")
+	os.Setenv("PKCS11_PIN", "1234")
+	config, err := pkcs11Config(PKCS11Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Path != module || config.TokenLabel != "token" || config.SlotNumber != nil || config.Pin != "1234" {
+		t.Fatalf("unexpected config from environment: %+v", config)
+	}
+}
+
+func TestLinuxCertificateChain(t *testing.T) {
+	store := &linuxStore{opts: OpenOptions{
+		Intermediates: []*x509.Certificate{root.Certificate, intermediate.Certificate},
+	}}
+	ident := &linuxIdent{store: store, cert: leafRSA.Certificate}
+
+	chain, err := ident.CertificateChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []*x509.Certificate{leafRSA.Certificate, intermediate.Certificate, root.Certificate}
+	if len(chain) != len(expected) {
+		t.Fatalf("expected %d certificates, got %d", len(expected), len(chain))
+	}
+	for j := range expected {
+		if !chain[j].Equal(expected[j]) {
+			t.Fatalf("unexpected certificate at position %d: %s", j, chain[j].Subject)
+		}
+	}
+
+	store.opts.Intermediates = nil
+	if chain, err = ident.CertificateChain(); !errors.Is(err, ErrPartialChain) {
+		t.Fatalf("expected ErrPartialChain, got %v", err)
+	}
+	if len(chain) != 1 {
+		t.Fatalf("expected partial chain with leaf, got %d certificates", len(chain))
+	}
+}
+
+func TestLinuxDeleteRemovesCertificateAndKey(t *testing.T) {
+	withStore(t, func(store Store) {
+		if err := store.Import(leafEC.PFX("asdf"), "asdf"); err != nil {
+			t.Fatal(err)
+		}
+
+		ident, err := FindIdentityByThumbprint(store, thumbprint(leafEC.Certificate))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ident.Close()
+
+		if err = ident.Delete(); err != nil {
+			t.Fatal(err)
+		}
+
+		idents, err := store.Identities()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer closeIdentities(idents)
+
+		for _, other := range idents {
+			crt, err := other.Certificate()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if crt.Equal(leafEC.Certificate) {
+				t.Fatal("deleted identity still enumerated")
+			}
+		}
+
+		// Identities only pairs certificates with keys, so check that neither
+		// half was left on the token.
+		ctx := store.(*linuxStore).ctx
+		id := leafEC.Certificate.SubjectKeyId
+		if len(id) == 0 {
+			sum := sha1.Sum(leafEC.Certificate.RawSubjectPublicKeyInfo)
+			id = sum[:]
+		}
+
+		if crt, err := ctx.FindCertificate(id, nil, nil); err != nil {
+			t.Fatal(err)
+		} else if crt != nil {
+			t.Fatal("certificate left on token")
+		}
+		if key, err := ctx.FindKeyPair(id, nil); err != nil {
+			t.Fatal(err)
+		} else if key != nil {
+			t.Fatal("key pair left on token")
+		}
+	})
+}
+
+func TestResolveIdentityOpenError(t *testing.T) {
+	for _, name := range []string{"PKCS11_MODULE", "PKCS11_SLOT", "PKCS11_TOKEN_LABEL", "PKCS11_PIN"} {
+		defer os.Setenv(name, os.Getenv(name))
+		os.Unsetenv(name)
+	}
+
+	// Without a token there's nowhere to search, so the error opening the
+	// store is more useful than ErrNotFound.
+	if _, err := ResolveIdentity(leafRSA.Certificate.Raw); err == nil || errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected the error opening the store, got %v", err)
+	}
+}
@@ -1,17 +1,33 @@
 package certstore
 
 import (
+	"bytes"
+	"context"
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/sha512"
+	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/mastahyeti/fakeca"
+	"software.sslmate.com/src/go-pkcs12"
 )
 
 func TestImportDeleteRSA(t *testing.T) {
@@ -294,3 +310,1470 @@ func CertificateHelper(t *testing.T, leaf *fakeca.Identity) {
 		})
 	})
 }
+
+func TestClone(t *testing.T) {
+	withIdentity(t, leafRSA, func(ident Identity) {
+		clone, err := ident.Clone()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		crt, err := clone.Certificate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !leafRSA.Certificate.Equal(crt) {
+			t.Fatal("expected clone cert to match original")
+		}
+
+		// Closing the clone shouldn't affect the original.
+		clone.Close()
+		if _, err = clone.Clone(); err != ErrClosed {
+			t.Fatalf("expected ErrClosed cloning a closed identity, got %v", err)
+		}
+
+		signer, err := ident.Signer()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		digest := sha256.Sum256([]byte("hello"))
+		if _, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestSignBatch(t *testing.T) {
+	withIdentity(t, leafEC, func(ident Identity) {
+		var (
+			hello = sha256.Sum256([]byte("hello"))
+			world = sha256.Sum256([]byte("world"))
+		)
+
+		digests := [][]byte{hello[:], hello[5:], world[:]}
+
+		sigs, err := SignBatch(ident, digests, crypto.SHA256)
+		if err == nil {
+			t.Fatal("expected error for bad digest size")
+		}
+
+		batchErr, ok := err.(BatchError)
+		if !ok {
+			t.Fatalf("expected BatchError, got %T", err)
+		}
+		if len(batchErr) != 3 || batchErr[0] != nil || batchErr[1] == nil || batchErr[2] != nil {
+			t.Fatalf("unexpected batch errors: %v", batchErr)
+		}
+
+		for j, msg := range []string{"hello", "", "world"} {
+			if batchErr[j] != nil {
+				continue
+			}
+			if err = leafEC.Certificate.CheckSignature(x509.ECDSAWithSHA256, []byte(msg), sigs[j]); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestInventory(t *testing.T) {
+	withIdentity(t, leafEC, func(_ Identity) {
+		withStore(t, func(store Store) {
+			records, err := Inventory(store)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var found *IdentityRecord
+			for j := range records {
+				if records[j].Certificate != nil && leafEC.Certificate.Equal(records[j].Certificate) {
+					found = &records[j]
+				}
+			}
+			if found == nil {
+				t.Fatal("imported identity not in inventory")
+			}
+
+			if found.Err != nil {
+				t.Fatal(found.Err)
+			}
+			if found.Key.Algorithm != x509.ECDSA || found.Key.Bits != 256 {
+				t.Fatalf("bad key info: %+v", found.Key)
+			}
+			if !found.NotAfter.Equal(leafEC.Certificate.NotAfter) {
+				t.Fatal("bad NotAfter")
+			}
+			if len(found.Thumbprint) != sha1.Size {
+				t.Fatal("bad thumbprint")
+			}
+		})
+	})
+}
+
+// notImplementedIdentity reports KeyProviderInfo as not implemented, as the
+// macOS and Linux identities do.
+type notImplementedIdentity struct {
+	Identity
+}
+
+func (notImplementedIdentity) KeyProviderInfo() (ProviderInfo, error) {
+	return ProviderInfo{}, ErrNotImplemented
+}
+
+func TestIdentityRecordIgnoresUnsupportedProviderInfo(t *testing.T) {
+	store, err := OpenPKCS12(root.PFX("asdf"), "asdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	idents, err := store.Identities()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeIdentities(idents)
+
+	if rec := newIdentityRecord(notImplementedIdentity{idents[0]}); rec.Err != nil {
+		t.Fatalf("expected no error, got %v", rec.Err)
+	}
+}
+
+func TestSPKIFingerprint(t *testing.T) {
+	withIdentity(t, leafRSA, func(ident Identity) {
+		fp, err := ident.SPKIFingerprint()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := sha256.Sum256(leafRSA.Certificate.RawSubjectPublicKeyInfo)
+		if !bytes.Equal(fp, expected[:]) {
+			t.Fatalf("bad SPKI fingerprint. Got %x, expected %x", fp, expected)
+		}
+
+		// Callers mustn't be able to corrupt the cached fingerprint.
+		fp[0] ^= 0xff
+		if fp, err = ident.SPKIFingerprint(); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(fp, expected[:]) {
+			t.Fatalf("cached SPKI fingerprint was modified. Got %x, expected %x", fp, expected)
+		}
+	})
+}
+
+func TestFindIdentitiesBySubjectRegex(t *testing.T) {
+	withIdentity(t, leafRSA, func(_ Identity) {
+		withStore(t, func(store Store) {
+			idents, err := FindIdentitiesBySubjectRegex(store, `^CN=leaf-rsa,O=certstore$`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, ident := range idents {
+				defer ident.Close()
+			}
+
+			if len(idents) != 1 {
+				t.Fatalf("expected 1 identity, got %d", len(idents))
+			}
+
+			if _, err = FindIdentitiesBySubjectRegex(store, `(`); err == nil {
+				t.Fatal("expected error for invalid pattern")
+			}
+		})
+	})
+}
+
+func TestNewestIdentity(t *testing.T) {
+	withIdentity(t, leafRSA, func(_ Identity) {
+		withStore(t, func(store Store) {
+			ident, err := NewestIdentity(store, func(crt *x509.Certificate) bool {
+				return crt.Subject.CommonName == "leaf-rsa"
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ident.Close()
+
+			crt, err := ident.Certificate()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !crt.Equal(leafRSA.Certificate) {
+				t.Fatal("expected leaf-rsa certificate")
+			}
+
+			if _, err = NewestIdentity(store, func(*x509.Certificate) bool { return false }); err != ErrNotFound {
+				t.Fatalf("expected ErrNotFound, got %v", err)
+			}
+		})
+	})
+}
+
+func TestResolveIdentity(t *testing.T) {
+	withIdentity(t, leafRSA, func(_ Identity) {
+		ident, err := ResolveIdentity(leafRSA.Certificate.Raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ident.Close()
+
+		crt, err := ident.Certificate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !crt.Equal(leafRSA.Certificate) {
+			t.Fatal("expected leaf-rsa certificate")
+		}
+
+		// The clone keeps the store open after the original is closed.
+		clone, err := ident.Clone()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer clone.Close()
+
+		ident.Close()
+
+		signer, err := clone.Signer()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		digest := sha256.Sum256([]byte("hello"))
+		if _, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	if _, err := ResolveIdentity(leafEC.Certificate.Raw); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestStoreIdentityClone(t *testing.T) {
+	store, err := OpenPKCS12(leafEC.PFX("asdf"), "asdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idents, err := store.Identities()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ident := &storeIdentity{Identity: idents[0], store: &sharedStore{Store: store, refs: 1}}
+
+	clone, err := ident.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ident.Close()
+	ident.Close()
+
+	if _, err = store.Identities(); err != nil {
+		t.Fatalf("expected store to stay open for the clone, got %v", err)
+	}
+	if _, err = ident.Clone(); err != ErrClosed {
+		t.Fatalf("expected ErrClosed cloning a closed identity, got %v", err)
+	}
+
+	clone.Close()
+
+	if _, err = store.Identities(); err != ErrClosed {
+		t.Fatalf("expected store to be closed with the last identity, got %v", err)
+	}
+}
+
+type recordingTracer struct {
+	spans []string
+}
+
+func (rt *recordingTracer) StartSpan(name string) func(error) {
+	return func(error) {
+		rt.spans = append(rt.spans, name)
+	}
+}
+
+func TestTracer(t *testing.T) {
+	rt := &recordingTracer{}
+	SetTracer(rt)
+	defer SetTracer(nil)
+
+	withStore(t, func(store Store) {
+		if _, err := store.Identities(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	if len(rt.spans) != 2 || rt.spans[0] != "certstore.Open" || rt.spans[1] != "certstore.Identities" {
+		t.Fatalf("unexpected spans: %v", rt.spans)
+	}
+}
+
+func TestExportCER(t *testing.T) {
+	withIdentity(t, leafRSA, func(ident Identity) {
+		der, err := ident.ExportCER()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(der, leafRSA.Certificate.Raw) {
+			t.Fatal("expected DER certificate")
+		}
+
+		block, _ := pem.Decode(EncodeCERBase64(der))
+		if block == nil || block.Type != "CERTIFICATE" {
+			t.Fatal("expected CERTIFICATE PEM block")
+		}
+		if !bytes.Equal(block.Bytes, der) {
+			t.Fatal("base64 certificate doesn't round trip")
+		}
+	})
+}
+
+func TestSameKeyAs(t *testing.T) {
+	withIdentity(t, leafRSA, func(ident Identity) {
+		clone, err := ident.Clone()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		same, err := ident.SameKeyAs(clone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !same {
+			t.Fatal("expected clone to share key")
+		}
+
+		clone.Close()
+		if _, err = ident.SameKeyAs(clone); err != ErrClosed {
+			t.Fatalf("expected ErrClosed, got %v", err)
+		}
+	})
+}
+
+func TestFetchIssuer(t *testing.T) {
+	leaf := *leafRSA.Certificate
+	leaf.IssuingCertificateURL = []string{"http://example.com/bad.crt", "http://example.com/intermediate.crt"}
+
+	fetch := func(_ context.Context, url string) ([]byte, error) {
+		if url == "http://example.com/intermediate.crt" {
+			return intermediate.Certificate.Raw, nil
+		}
+		return root.Certificate.Raw, nil
+	}
+
+	issuer, err := fetchIssuer(context.Background(), &leaf, fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !issuer.Equal(intermediate.Certificate) {
+		t.Fatal("expected intermediate certificate")
+	}
+
+	leaf.IssuingCertificateURL = leaf.IssuingCertificateURL[:1]
+	if _, err = fetchIssuer(context.Background(), &leaf, fetch); err == nil {
+		t.Fatal("expected error for certificate that isn't the issuer")
+	}
+}
+
+func TestConcurrentIdentities(t *testing.T) {
+	withIdentity(t, leafEC, func(_ Identity) {
+		withStore(t, func(store Store) {
+			var wg sync.WaitGroup
+			errs := make(chan error, 8)
+
+			for j := 0; j < cap(errs); j++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+
+					idents, err := store.Identities()
+					if err != nil {
+						errs <- err
+						return
+					}
+					for _, ident := range idents {
+						ident.Close()
+					}
+				}()
+			}
+
+			wg.Wait()
+			close(errs)
+
+			for err := range errs {
+				t.Fatal(err)
+			}
+		})
+	})
+}
+
+func TestFindIdentitiesForTLS(t *testing.T) {
+	withIdentity(t, leafEC, func(_ Identity) {
+		withStore(t, func(store Store) {
+			for _, version := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+				idents, err := FindIdentitiesForTLS(store, version)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				found := false
+				for _, ident := range idents {
+					if crt, err := ident.Certificate(); err == nil && crt.Equal(leafEC.Certificate) {
+						found = true
+					}
+					ident.Close()
+				}
+
+				if !found {
+					t.Fatalf("expected leaf-ec to be usable with TLS version %x", version)
+				}
+			}
+		})
+	})
+}
+
+func TestFindIdentitiesForTLSEd25519(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{Organization: []string{"certstore"}, CommonName: "leaf-ed25519"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, pub, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pfx, err := pkcs12.Modern.Encode(priv, crt, nil, "asdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := OpenPKCS12(pfx, "asdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	for version, usable := range map[uint16]bool{
+		tls.VersionTLS11: false,
+		tls.VersionTLS12: true,
+		tls.VersionTLS13: true,
+	} {
+		idents, err := FindIdentitiesForTLS(store, version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		closeIdentities(idents)
+
+		if found := len(idents) == 1; found != usable {
+			t.Fatalf("expected usable=%t with TLS version %x, got %t", usable, version, found)
+		}
+	}
+}
+
+// signerCountingIdentity counts calls to Signer.
+type signerCountingIdentity struct {
+	Identity
+	calls int
+}
+
+func (i *signerCountingIdentity) Signer() (crypto.Signer, error) {
+	i.calls++
+	return i.Identity.Signer()
+}
+
+func TestUsableForTLSSignerAcquisition(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		leaf    *fakeca.Identity
+		version uint16
+		calls   int
+	}{
+		{"RSA TLS 1.2", leafRSA, tls.VersionTLS12, 0},
+		{"RSA TLS 1.3", leafRSA, tls.VersionTLS13, 1},
+		{"EC TLS 1.2", leafEC, tls.VersionTLS12, 0},
+		{"EC TLS 1.3", leafEC, tls.VersionTLS13, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			store, err := OpenPKCS12(tc.leaf.PFX("asdf"), "asdf")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+
+			idents, err := store.Identities()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closeIdentities(idents)
+
+			ident := &signerCountingIdentity{Identity: idents[0]}
+			if !usableForTLS(ident, tc.version) {
+				t.Fatal("expected identity to be usable")
+			}
+			if ident.calls != tc.calls {
+				t.Fatalf("expected %d Signer calls, got %d", tc.calls, ident.calls)
+			}
+		})
+	}
+}
+
+func TestDedupAndSortIdentities(t *testing.T) {
+	open := func(pfx []byte) Identity {
+		store, err := OpenPKCS12(pfx, "asdf")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		idents, err := store.Identities()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return idents[0]
+	}
+
+	var (
+		rsa1 = open(leafRSA.PFX("asdf"))
+		ec   = open(leafEC.PFX("asdf"))
+		rsa2 = open(leafRSA.PFX("asdf"))
+	)
+
+	idents := dedupIdentities([]Identity{rsa1, ec, rsa2})
+	if len(idents) != 2 || idents[0] != rsa1 || idents[1] != ec {
+		t.Fatalf("expected duplicate to be dropped, got %v", idents)
+	}
+	if _, err := rsa2.Certificate(); err != ErrClosed {
+		t.Fatalf("expected duplicate to be closed, got %v", err)
+	}
+
+	a := []Identity{rsa1, ec}
+	b := []Identity{ec, rsa1}
+	sortIdentities(a)
+	sortIdentities(b)
+
+	if a[0] != b[0] || a[1] != b[1] {
+		t.Fatal("expected the same order regardless of input order")
+	}
+
+	first, _ := a[0].Certificate()
+	second, _ := a[1].Certificate()
+	if first.NotAfter.Before(second.NotAfter) {
+		t.Fatal("expected latest expiry first")
+	}
+}
+
+func TestMustStaple(t *testing.T) {
+	crt := *leafRSA.Certificate
+
+	staple, err := certMustStaple(&crt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if staple {
+		t.Fatal("expected no must-staple without TLS Feature extension")
+	}
+
+	value, err := asn1.Marshal([]int{tlsFeatureStatusRequest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt.Extensions = append(crt.Extensions, pkix.Extension{Id: oidTLSFeature, Value: value})
+
+	if staple, err = certMustStaple(&crt); err != nil {
+		t.Fatal(err)
+	}
+	if !staple {
+		t.Fatal("expected must-staple")
+	}
+}
+
+func TestSetArchived(t *testing.T) {
+	withIdentity(t, leafRSA, func(ident Identity) {
+		if err := ident.SetArchived(true); err == ErrUnsupportedOperation {
+			t.Skip("archiving not supported on this platform")
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		defer ident.SetArchived(false)
+
+		for _, includeArchived := range []bool{false, true} {
+			store, err := OpenWithOptions(OpenOptions{IncludeArchived: includeArchived})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			idents, err := filterIdentities(store, func(i Identity) bool {
+				crt, err := i.Certificate()
+				return err == nil && crt.Equal(leafRSA.Certificate)
+			})
+			for _, i := range idents {
+				i.Close()
+			}
+			store.Close()
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found := len(idents) > 0; found != includeArchived {
+				t.Fatalf("IncludeArchived=%v: found=%v", includeArchived, found)
+			}
+		}
+	})
+}
+
+func TestNewMTLSTransport(t *testing.T) {
+	withIdentity(t, leafEC, func(ident Identity) {
+		base := &http.Transport{}
+
+		transport, err := NewMTLSTransport(ident, base)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if base.TLSClientConfig != nil {
+			t.Fatal("base transport was modified")
+		}
+
+		cert, err := transport.TLSClientConfig.GetClientCertificate(&tls.CertificateRequestInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cert.Leaf.Equal(leafEC.Certificate) {
+			t.Fatal("expected leaf-ec client certificate")
+		}
+		if _, ok := cert.PrivateKey.(crypto.Signer); !ok {
+			t.Fatal("expected private key to be a crypto.Signer")
+		}
+	})
+}
+
+func TestFindIdentities(t *testing.T) {
+	withIdentity(t, leafRSA, func(_ Identity) {
+		withStore(t, func(store Store) {
+			idents, err := FindIdentities(store, And(
+				Valid(),
+				ByIssuer("intermediate"),
+				Or(BySubject("leaf-rsa"), BySubject("leaf-ec")),
+				Not(BySubject("leaf-ec")),
+			))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, ident := range idents {
+				defer ident.Close()
+			}
+
+			if len(idents) != 1 {
+				t.Fatalf("expected 1 identity, got %d", len(idents))
+			}
+
+			crt, err := idents[0].Certificate()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !crt.Equal(leafRSA.Certificate) {
+				t.Fatal("expected leaf-rsa certificate")
+			}
+		})
+	})
+}
+
+func TestSignerRSAPSS(t *testing.T) {
+	withIdentity(t, leafRSA, func(ident Identity) {
+		signer, err := ident.Signer()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		digest := sha256.Sum256([]byte("hello"))
+
+		for _, saltLength := range []int{rsa.PSSSaltLengthAuto, rsa.PSSSaltLengthEqualsHash, 20} {
+			opts := &rsa.PSSOptions{SaltLength: saltLength, Hash: crypto.SHA256}
+
+			sig, err := signer.Sign(rand.Reader, digest[:], opts)
+			if err == ErrPSSUnsupportedByProvider {
+				t.Skip("key provider doesn't support RSA-PSS")
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			pub := leafRSA.Certificate.PublicKey.(*rsa.PublicKey)
+			if err = rsa.VerifyPSS(pub, crypto.SHA256, digest[:], sig, opts); err != nil {
+				t.Fatalf("salt length %d: %v", saltLength, err)
+			}
+		}
+	})
+}
+
+func TestFindIdentityByThumbprint(t *testing.T) {
+	withIdentity(t, leafRSA, func(_ Identity) {
+		withStore(t, func(store Store) {
+			ident, err := FindIdentityByThumbprint(store, thumbprint(leafRSA.Certificate))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ident.Close()
+
+			crt, err := ident.Certificate()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !crt.Equal(leafRSA.Certificate) {
+				t.Fatal("expected leaf-rsa certificate")
+			}
+
+			if _, err = FindIdentityByThumbprint(store, thumbprint(leafEC.Certificate)); !errors.Is(err, ErrNotFound) {
+				t.Fatalf("expected ErrNotFound, got %v", err)
+			}
+		})
+	})
+}
+
+func TestFindIdentitiesBySubject(t *testing.T) {
+	withIdentity(t, leafRSA, func(_ Identity) {
+		withStore(t, func(store Store) {
+			idents, err := FindIdentitiesBySubject(store, "LEAF-RSA")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, ident := range idents {
+				defer ident.Close()
+			}
+
+			if len(idents) != 1 {
+				t.Fatalf("expected 1 identity, got %d", len(idents))
+			}
+		})
+	})
+}
+
+func TestErrNotImplemented(t *testing.T) {
+	if !errors.Is(ErrNotImplemented, ErrUnsupportedOperation) {
+		t.Fatal("expected ErrNotImplemented to match ErrUnsupportedOperation")
+	}
+	if errors.Is(ErrUnsupportedOperation, ErrNotImplemented) {
+		t.Fatal("expected ErrUnsupportedOperation not to match ErrNotImplemented")
+	}
+}
+
+func TestFindIdentitiesContext(t *testing.T) {
+	withIdentity(t, leafRSA, func(_ Identity) {
+		withStore(t, func(store Store) {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			if _, err := FindIdentitiesContext(ctx, store, nil); err != context.Canceled {
+				t.Fatalf("expected context.Canceled, got %v", err)
+			}
+
+			idents, err := FindIdentitiesContext(context.Background(), store, BySubject("leaf-rsa"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, ident := range idents {
+				defer ident.Close()
+			}
+
+			if len(idents) != 1 {
+				t.Fatalf("expected 1 identity, got %d", len(idents))
+			}
+		})
+	})
+}
+
+func TestIterateIdentities(t *testing.T) {
+	withIdentity(t, leafRSA, func(_ Identity) {
+		withStore(t, func(store Store) {
+			it, err := IterateIdentities(store)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer it.Close()
+
+			count := func() int {
+				var n int
+				for {
+					ident, err := it.Next()
+					if err == io.EOF {
+						return n
+					} else if err != nil {
+						t.Fatal(err)
+					}
+
+					if crt, err := ident.Certificate(); err != nil {
+						t.Fatal(err)
+					} else if crt.Equal(leafRSA.Certificate) {
+						n++
+					}
+					ident.Close()
+				}
+			}
+
+			if n := count(); n != 1 {
+				t.Fatalf("expected 1 identity, got %d", n)
+			}
+			if _, err := it.Next(); err != io.EOF {
+				t.Fatalf("expected io.EOF after iteration, got %v", err)
+			}
+
+			if err := it.Reset(); err != nil {
+				t.Fatal(err)
+			}
+			if n := count(); n != 1 {
+				t.Fatalf("expected 1 identity after Reset, got %d", n)
+			}
+		})
+	})
+}
+
+func TestCloseDuringIdentities(t *testing.T) {
+	withIdentity(t, leafEC, func(_ Identity) {
+		store, err := Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 8)
+
+		for j := 0; j < cap(errs); j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				idents, err := store.Identities()
+				if err != nil {
+					if err != ErrClosed {
+						errs <- err
+					}
+					return
+				}
+				for _, ident := range idents {
+					ident.Close()
+				}
+			}()
+		}
+
+		store.Close()
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestTLSClientConfig(t *testing.T) {
+	withIdentity(t, leafRSA, func(ident Identity) {
+		config, err := TLSClientConfig(ident)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.InsecureSkipVerify = true
+
+		server := intermediate.Issue(fakeca.Subject(pkix.Name{CommonName: "server"}))
+		serverConfig := &tls.Config{
+			Certificates: []tls.Certificate{{
+				Certificate: [][]byte{server.Certificate.Raw},
+				PrivateKey:  server.PrivateKey,
+			}},
+			ClientAuth: tls.RequireAnyClientCert,
+		}
+
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		defer serverConn.Close()
+
+		errs := make(chan error, 1)
+		srv := tls.Server(serverConn, serverConfig)
+		go func() {
+			errs <- srv.Handshake()
+		}()
+
+		if err := tls.Client(clientConn, config).Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+
+		peers := srv.ConnectionState().PeerCertificates
+		if len(peers) == 0 || !peers[0].Equal(leafRSA.Certificate) {
+			t.Fatal("expected server to see leaf-rsa client certificate")
+		}
+	})
+}
+
+func TestCheckDigest(t *testing.T) {
+	for _, hash := range []crypto.Hash{crypto.SHA1, crypto.SHA256, crypto.SHA384, crypto.SHA512} {
+		if err := checkDigest(make([]byte, hash.Size()), hash); err != nil {
+			t.Fatalf("%s: %v", hashName(hash), err)
+		}
+
+		err := checkDigest(make([]byte, hash.Size()-1), hash)
+		if err == nil {
+			t.Fatalf("%s: expected error for short digest", hashName(hash))
+		}
+		if !strings.Contains(err.Error(), hashName(hash)) {
+			t.Fatalf("%s: expected error to name the hash, got %q", hashName(hash), err)
+		}
+	}
+
+	if err := checkDigest([]byte("hello"), crypto.Hash(0)); err == nil {
+		t.Fatal("expected error for zero hash")
+	}
+}
+
+func TestFindIdentitiesByIssuer(t *testing.T) {
+	withIdentity(t, leafRSA, func(_ Identity) {
+		withStore(t, func(store Store) {
+			idents, err := FindIdentitiesByIssuer(store, "INTERMEDIATE")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, ident := range idents {
+				defer ident.Close()
+			}
+
+			var found bool
+			for _, ident := range idents {
+				crt, err := ident.Certificate()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if crt.Issuer.CommonName != "intermediate" {
+					t.Fatalf("unexpected issuer %q", crt.Issuer.CommonName)
+				}
+				found = found || crt.Equal(leafRSA.Certificate)
+			}
+			if !found {
+				t.Fatal("expected leaf-rsa to be found by issuer")
+			}
+		})
+	})
+}
+
+func TestFindIdentitiesByExactSubject(t *testing.T) {
+	prefixed := intermediate.Issue(fakeca.Subject(pkix.Name{
+		Organization: []string{"certstore"},
+		CommonName:   "leaf-rsa-prefixed",
+	}))
+
+	withIdentity(t, leafRSA, func(_ Identity) {
+		withIdentity(t, prefixed, func(_ Identity) {
+			withStore(t, func(store Store) {
+				substring, err := FindIdentitiesBySubject(store, "leaf-rsa")
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, ident := range substring {
+					ident.Close()
+				}
+				if len(substring) < 2 {
+					t.Fatalf("expected substring match to find both identities, got %d", len(substring))
+				}
+
+				idents, err := FindIdentitiesByExactSubject(store, leafRSA.Certificate.Subject)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, ident := range idents {
+					defer ident.Close()
+				}
+
+				if len(idents) != 1 {
+					t.Fatalf("expected 1 identity, got %d", len(idents))
+				}
+
+				crt, err := idents[0].Certificate()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !crt.Equal(leafRSA.Certificate) {
+					t.Fatal("expected leaf-rsa certificate")
+				}
+			})
+		})
+	})
+}
+
+func TestByEKUOID(t *testing.T) {
+	var (
+		clientAuth = &x509.Certificate{ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}
+		serverAuth = &x509.Certificate{ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}
+		anyUsage   = &x509.Certificate{ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}
+		scLogon    = &x509.Certificate{UnknownExtKeyUsage: []asn1.ObjectIdentifier{OIDExtKeyUsageSmartcardLogon}}
+		noEKU      = &x509.Certificate{}
+	)
+
+	m := ByEKUOID(OIDExtKeyUsageClientAuth)
+	if !m(clientAuth) || m(serverAuth) || !m(anyUsage) || m(scLogon) || !m(noEKU) {
+		t.Fatal("unexpected client auth matches")
+	}
+
+	m = ByEKUOID(OIDExtKeyUsageSmartcardLogon, OIDExtKeyUsageServerAuth)
+	if m(clientAuth) || !m(serverAuth) || !m(scLogon) {
+		t.Fatal("unexpected smart card logon or server auth matches")
+	}
+
+	withIdentity(t, leafRSA, func(_ Identity) {
+		withStore(t, func(store Store) {
+			idents, err := FindIdentitiesByEKU(store, []asn1.ObjectIdentifier{OIDExtKeyUsageClientAuth})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, ident := range idents {
+				crt, err := ident.Certificate()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !ByEKUOID(OIDExtKeyUsageClientAuth)(crt) {
+					t.Fatalf("unexpected identity %s", crt.Subject)
+				}
+				ident.Close()
+			}
+		})
+	})
+}
+
+func TestFindValidIdentities(t *testing.T) {
+	withIdentity(t, leafRSA, func(_ Identity) {
+		withStore(t, func(store Store) {
+			contains := func(idents []Identity) bool {
+				var found bool
+				for _, ident := range idents {
+					if crt, err := ident.Certificate(); err == nil && crt.Equal(leafRSA.Certificate) {
+						found = true
+					}
+					ident.Close()
+				}
+				return found
+			}
+
+			idents, err := FindValidIdentitiesNow(store)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !contains(idents) {
+				t.Fatal("expected leaf-rsa to be currently valid")
+			}
+
+			idents, err = FindValidIdentities(store, leafRSA.Certificate.NotAfter.Add(time.Second))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if contains(idents) {
+				t.Fatal("expected leaf-rsa to be expired")
+			}
+
+			idents, err = FindValidIdentities(store, leafRSA.Certificate.NotBefore.Add(-time.Second))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if contains(idents) {
+				t.Fatal("expected leaf-rsa to be not yet valid")
+			}
+		})
+	})
+}
+
+func TestExportCertificatePEM(t *testing.T) {
+	withIdentity(t, leafRSA, func(ident Identity) {
+		data, err := ExportCertificatePEM(ident)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		block, rest := pem.Decode(data)
+		if block == nil || block.Type != "CERTIFICATE" || len(rest) != 0 {
+			t.Fatal("expected a single CERTIFICATE block")
+		}
+		if !bytes.Equal(block.Bytes, leafRSA.Certificate.Raw) {
+			t.Fatal("bad certificate")
+		}
+
+		data, err = ExportChainPEM(ident)
+		if err != nil && !errors.Is(err, ErrPartialChain) {
+			t.Fatal(err)
+		}
+
+		block, _ = pem.Decode(data)
+		if block == nil || !bytes.Equal(block.Bytes, leafRSA.Certificate.Raw) {
+			t.Fatal("expected chain to start with the leaf")
+		}
+	})
+}
+
+func TestFindCACertificates(t *testing.T) {
+	certs, err := FindCACertificates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := map[string]bool{}
+	for _, crt := range certs {
+		if seen[string(crt.Raw)] {
+			t.Fatalf("duplicate CA certificate %q", crt.Subject)
+		}
+		seen[string(crt.Raw)] = true
+	}
+}
+
+func TestSystemRootPool(t *testing.T) {
+	pool, err := SystemRootPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certs, err := FindCACertificates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Any self-signed root the platform knows about must verify against the
+	// pool.
+	for _, crt := range certs {
+		if !isSelfSigned(crt) {
+			continue
+		}
+
+		if _, err := crt.Verify(x509.VerifyOptions{Roots: pool, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}); err != nil {
+			t.Fatalf("root %q didn't verify against pool: %v", crt.Subject, err)
+		}
+
+		return
+	}
+}
+
+func TestKeyInfo(t *testing.T) {
+	withIdentity(t, leafEC, func(ident Identity) {
+		info, err := ident.KeyInfo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Algorithm != x509.ECDSA || info.Bits != 256 {
+			t.Fatalf("bad key info: %+v", info)
+		}
+	})
+
+	withIdentity(t, leafRSA, func(ident Identity) {
+		// Acquire the key first so it gets cross-checked where supported.
+		if _, err := ident.Signer(); err != nil {
+			t.Fatal(err)
+		}
+
+		info, err := ident.KeyInfo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Algorithm != x509.RSA || info.Bits != 2048 {
+			t.Fatalf("bad key info: %+v", info)
+		}
+	})
+}
+
+func TestDisplayName(t *testing.T) {
+	withIdentity(t, leafEC, func(ident Identity) {
+		name, err := ident.DisplayName()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != leafEC.Certificate.Subject.CommonName {
+			t.Fatalf("expected display name %q, got %q", leafEC.Certificate.Subject.CommonName, name)
+		}
+	})
+}
+
+func TestThumbprint(t *testing.T) {
+	withStore(t, func(store Store) {
+		if err := store.Import(leafEC.PFX("asdf"), "asdf"); err != nil {
+			t.Fatal(err)
+		}
+
+		sum := sha256.Sum256(leafEC.Certificate.Raw)
+
+		// On Windows, this is looked up with CERT_FIND_SHA1_HASH, so the
+		// certificate is found by the OS's own thumbprint.
+		ident, err := FindIdentityByThumbprint(store, thumbprint(leafEC.Certificate))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ident.Close()
+		defer ident.Delete()
+
+		tp, err := ident.Thumbprint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(tp, thumbprint(leafEC.Certificate)) {
+			t.Fatalf("expected thumbprint %x, got %x", thumbprint(leafEC.Certificate), tp)
+		}
+
+		tp256, err := ident.ThumbprintSHA256()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(tp256, sum[:]) {
+			t.Fatalf("expected SHA-256 thumbprint %x, got %x", sum[:], tp256)
+		}
+	})
+}
+
+func TestCapabilities(t *testing.T) {
+	for _, id := range []*fakeca.Identity{leafRSA, leafEC} {
+		withIdentity(t, id, func(ident Identity) {
+			caps, err := ident.Capabilities()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !caps.Sign {
+				t.Fatalf("expected %s key to be able to sign", id.Certificate.PublicKeyAlgorithm)
+			}
+		})
+	}
+
+	tests := []struct {
+		name string
+		pub  crypto.PublicKey
+		ku   x509.KeyUsage
+		caps KeyCapabilities
+	}{
+		{"rsa no key usage", leafKeyRSA.Public(), 0, KeyCapabilities{Sign: true, Decrypt: true}},
+		{"rsa sign only", leafKeyRSA.Public(), x509.KeyUsageDigitalSignature, KeyCapabilities{Sign: true}},
+		{"rsa encipherment only", leafKeyRSA.Public(), x509.KeyUsageKeyEncipherment, KeyCapabilities{Decrypt: true}},
+		{"ec no key usage", leafKeyEC.Public(), 0, KeyCapabilities{Sign: true, KeyAgreement: true}},
+		{"ec key agreement only", leafKeyEC.Public(), x509.KeyUsageKeyAgreement, KeyCapabilities{KeyAgreement: true}},
+		{"ec encipherment only", leafKeyEC.Public(), x509.KeyUsageKeyEncipherment, KeyCapabilities{}},
+	}
+
+	for _, tt := range tests {
+		crt := &x509.Certificate{PublicKey: tt.pub, KeyUsage: tt.ku}
+		if caps := certCapabilities(crt); caps != tt.caps {
+			t.Errorf("%s: expected %+v, got %+v", tt.name, tt.caps, caps)
+		}
+	}
+}
+
+func TestOpenAll(t *testing.T) {
+	// Opening the same location twice checks that identities are deduplicated.
+	store, err := OpenAll(StoreLocationCurrentUser, StoreLocationCurrentUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if err = store.Import(leafEC.PFX("asdf"), "asdf"); err != nil {
+		t.Fatal(err)
+	}
+
+	idents, err := store.Identities()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ident := range idents {
+		defer ident.Close()
+	}
+
+	var found Identity
+	for _, ident := range idents {
+		crt, err := ident.Certificate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !crt.Equal(leafEC.Certificate) {
+			continue
+		}
+		if found != nil {
+			t.Fatal("identity returned more than once")
+		}
+		found = ident
+	}
+	if found == nil {
+		t.Fatal("imported identity not found")
+	}
+
+	if err = found.Delete(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeleteIdentityByThumbprint(t *testing.T) {
+	withStore(t, func(store Store) {
+		if err := store.Import(leafEC.PFX("asdf"), "asdf"); err != nil {
+			t.Fatal(err)
+		}
+
+		tp := thumbprint(leafEC.Certificate)
+
+		if err := DeleteIdentityByThumbprint(store, tp); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := FindIdentityByThumbprint(store, tp); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expected ErrNotFound after delete, got %v", err)
+		}
+
+		if err := DeleteIdentityByThumbprint(store, tp); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expected ErrNotFound deleting again, got %v", err)
+		}
+	})
+}
+
+func TestRetrySign(t *testing.T) {
+	var (
+		errTransient = errors.New("transient")
+		errFatal     = errors.New("fatal")
+		isTransient  = func(err error) bool { return err == errTransient }
+		policy       = RetryPolicy{MaxAttempts: 3, Delay: time.Millisecond}
+	)
+
+	// sequence returns a sign function failing with each of errs in turn, then
+	// succeeding, and a pointer to how many times it was called.
+	sequence := func(errs ...error) (func() ([]byte, error), *int) {
+		calls := 0
+		return func() ([]byte, error) {
+			calls++
+			if calls <= len(errs) {
+				return nil, errs[calls-1]
+			}
+			return []byte("sig"), nil
+		}, &calls
+	}
+
+	sign, calls := sequence(errTransient)
+	if sig, err := retrySign(policy, isTransient, sign); err != nil || string(sig) != "sig" {
+		t.Fatalf("expected success after a transient error, got %q, %v", sig, err)
+	}
+	if *calls != 2 {
+		t.Fatalf("expected 2 attempts, got %d", *calls)
+	}
+
+	sign, calls = sequence(errFatal)
+	if _, err := retrySign(policy, isTransient, sign); err != errFatal {
+		t.Fatalf("expected fatal error, got %v", err)
+	}
+	if *calls != 1 {
+		t.Fatalf("expected non-transient error not to be retried, got %d attempts", *calls)
+	}
+
+	sign, calls = sequence(errTransient, errTransient, errTransient)
+	if _, err := retrySign(policy, isTransient, sign); err != errTransient {
+		t.Fatalf("expected transient error once attempts ran out, got %v", err)
+	}
+	if *calls != 3 {
+		t.Fatalf("expected 3 attempts, got %d", *calls)
+	}
+
+	sign, calls = sequence(errTransient)
+	if _, err := retrySign(RetryPolicy{}, isTransient, sign); err != errTransient {
+		t.Fatalf("expected no retries by default, got %v", err)
+	}
+	if *calls != 1 {
+		t.Fatalf("expected 1 attempt by default, got %d", *calls)
+	}
+}
+
+func TestConcurrentSign(t *testing.T) {
+	withIdentity(t, leafRSA, func(ident Identity) {
+		signer, err := ident.Signer()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		const signs = 16
+
+		var (
+			wg     sync.WaitGroup
+			errs   = make(chan error, signs/2)
+			pssErr = make(chan error, signs/2)
+			pub    = leafRSA.Certificate.PublicKey.(*rsa.PublicKey)
+		)
+
+		// Half of the signs use PSS, so that the provider is probed for PSS
+		// support while other signs are in flight. Run this with -race.
+		for j := 0; j < signs; j++ {
+			wg.Add(1)
+			go func(j int) {
+				defer wg.Done()
+
+				digest := sha256.Sum256([]byte{byte(j)})
+
+				if j%2 == 1 {
+					opts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+					sig, err := signer.Sign(rand.Reader, digest[:], opts)
+					if err == nil {
+						err = rsa.VerifyPSS(pub, crypto.SHA256, digest[:], sig, opts)
+					}
+					pssErr <- err
+					return
+				}
+
+				sig, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+				if err == nil {
+					err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig)
+				}
+				errs <- err
+			}(j)
+		}
+
+		wg.Wait()
+		close(errs)
+		close(pssErr)
+
+		for err := range errs {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Providers without PSS must say so for every sign, not just for the
+		// ones racing with the probe.
+		var unsupported int
+		for err := range pssErr {
+			if err == ErrPSSUnsupportedByProvider {
+				unsupported++
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if unsupported != 0 && unsupported != cap(pssErr) {
+			t.Fatalf("expected all or no PSS signs to be unsupported, got %d of %d", unsupported, cap(pssErr))
+		}
+	})
+}
+
+func BenchmarkSignSHA256(b *testing.B) {
+	withIdentity(b, leafRSA, func(ident Identity) {
+		signer, err := ident.Signer()
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		digest := sha256.Sum256([]byte("hello"))
+
+		b.ResetTimer()
+		for j := 0; j < b.N; j++ {
+			if _, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
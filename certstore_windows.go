@@ -1,11 +1,13 @@
 package certstore
 
 /*
-#cgo windows LDFLAGS: -lcrypt32 -lncrypt
+#cgo windows LDFLAGS: -lcrypt32 -lncrypt -lpsapi
 
 #include <windows.h>
 #include <wincrypt.h>
 #include <ncrypt.h>
+#include <psapi.h>
+#include <string.h>
 
 char* errMsg(DWORD code) {
 	char* lpMsgBuf;
@@ -27,18 +29,92 @@ char* errMsg(DWORD code) {
 		return lpMsgBuf;
 	}
 }
+
+SECURITY_STATUS importNamedKey(NCRYPT_PROV_HANDLE prov, LPCWSTR blobType, LPCWSTR keyName, PBYTE blob, DWORD blobLen, NCRYPT_KEY_HANDLE* key) {
+	NCryptBuffer buf = { (ULONG)(wcslen(keyName) + 1) * sizeof(WCHAR), NCRYPTBUFFER_PKCS_KEY_NAME, (PVOID)keyName };
+	NCryptBufferDesc desc = { NCRYPTBUFFER_VERSION, 1, &buf };
+
+	return NCryptImportKey(prov, 0, blobType, &desc, key, blob, blobLen, 0);
+}
+
+SIZE_T privateBytes() {
+	PROCESS_MEMORY_COUNTERS_EX pmc;
+
+	memset(&pmc, 0, sizeof(pmc));
+	if (!GetProcessMemoryInfo(GetCurrentProcess(), (PPROCESS_MEMORY_COUNTERS)&pmc, sizeof(pmc))) {
+		return 0;
+	}
+
+	return pmc.PrivateUsage;
+}
+
+DWORD verifyChainForUsage(PCCERT_CONTEXT cert, LPSTR* usages, DWORD nUsages, DWORD authType, DWORD chainFlags, DWORD* policyErr) {
+	CERT_CHAIN_PARA chainPara;
+	PCCERT_CHAIN_CONTEXT chain = NULL;
+	CERT_CHAIN_POLICY_PARA policyPara;
+	CERT_CHAIN_POLICY_STATUS policyStatus;
+	SSL_EXTRA_CERT_CHAIN_POLICY_PARA sslPara;
+	LPCSTR policy = CERT_CHAIN_POLICY_BASE;
+	DWORD err = 0;
+
+	memset(&chainPara, 0, sizeof(chainPara));
+	chainPara.cbSize = sizeof(chainPara);
+	chainPara.RequestedUsage.dwType = USAGE_MATCH_TYPE_AND;
+	chainPara.RequestedUsage.Usage.cUsageIdentifier = nUsages;
+	chainPara.RequestedUsage.Usage.rgpszUsageIdentifier = usages;
+
+	if (!CertGetCertificateChain(NULL, cert, NULL, cert->hCertStore, &chainPara, chainFlags, NULL, &chain)) {
+		return GetLastError();
+	}
+
+	memset(&policyPara, 0, sizeof(policyPara));
+	policyPara.cbSize = sizeof(policyPara);
+
+	if (authType != 0) {
+		memset(&sslPara, 0, sizeof(sslPara));
+		sslPara.cbSize = sizeof(sslPara);
+		sslPara.dwAuthType = authType;
+		policyPara.pvExtraPolicyPara = &sslPara;
+		policy = CERT_CHAIN_POLICY_SSL;
+	}
+
+	memset(&policyStatus, 0, sizeof(policyStatus));
+	policyStatus.cbSize = sizeof(policyStatus);
+
+	if (!CertVerifyCertificateChainPolicy(policy, chain, &policyPara, &policyStatus)) {
+		err = GetLastError();
+	} else {
+		*policyErr = policyStatus.dwError;
+	}
+
+	CertFreeCertificateChain(chain);
+
+	return err;
+}
+
+SECURITY_STATUS exportPKCS7Envelope(NCRYPT_KEY_HANDLE key, NCRYPT_KEY_HANDLE wrapKey, LPSTR algOID, PBYTE out, DWORD outLen, DWORD* resultLen) {
+	NCryptBuffer buf = { (ULONG)strlen(algOID) + 1, NCRYPTBUFFER_PKCS_ALG_OID, algOID };
+	NCryptBufferDesc desc = { NCRYPTBUFFER_VERSION, 1, &buf };
+
+	return NCryptExportKey(key, wrapKey, NCRYPT_PKCS7_ENVELOPE_BLOB, &desc, out, outLen, resultLen, 0);
+}
 */
 import "C"
 
 import (
+	"context"
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/asn1"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"math/big"
+	"strings"
+	"sync"
 	"unicode/utf16"
 	"unsafe"
 
@@ -57,11 +133,94 @@ const (
 
 	// NTE_BAD_ALGID — Invalid algorithm specified.
 	NTE_BAD_ALGID = 0x80090008
+
+	// CRYPT_E_NO_KEY_PROPERTY — The certificate has no private key property.
+	CRYPT_E_NO_KEY_PROPERTY = 0x8009200B
+
+	// NTE_BAD_KEYSET — Keyset does not exist.
+	NTE_BAD_KEYSET = 0x80090016
+
+	// NTE_NOT_FOUND — Object was not found.
+	NTE_NOT_FOUND = 0x80090011
+
+	// NTE_NO_KEY — Key does not exist.
+	NTE_NO_KEY = 0x8009000D
+
+	// NTE_PERM — Access denied.
+	NTE_PERM = 0x80090010
+
+	// NTE_BAD_KEY_STATE — Key not valid for use in specified state.
+	NTE_BAD_KEY_STATE = 0x8009000B
+
+	// NTE_BAD_TYPE — Invalid type specified.
+	NTE_BAD_TYPE = 0x8009000A
+
+	// NTE_SILENT_CONTEXT — Provider could not perform the action since the
+	// context was acquired as silent.
+	NTE_SILENT_CONTEXT = 0x80090022
+
+	// NTE_NOT_SUPPORTED — The requested operation is not supported.
+	NTE_NOT_SUPPORTED = 0x80090029
+
+	// NTE_TOKEN_KEYSET_STORAGE_FULL — The security token does not have storage
+	// space available for an additional container.
+	NTE_TOKEN_KEYSET_STORAGE_FULL = 0x80090023
+
+	// SCARD_E_WRITE_TOO_MANY — An attempt was made to write more data than
+	// would fit in the target object.
+	SCARD_E_WRITE_TOO_MANY = 0x80100028
+
+	// SCARD_E_NO_SMARTCARD — The operation requires a smart card, but no
+	// smart card is currently in the device.
+	SCARD_E_NO_SMARTCARD = 0x8010000C
+
+	// SCARD_E_UNKNOWN_READER — The specified reader name is not recognized.
+	SCARD_E_UNKNOWN_READER = 0x80100009
+
+	// SCARD_W_WRONG_CHV — The card cannot be accessed because the wrong PIN was
+	// presented.
+	SCARD_W_WRONG_CHV = 0x8010006B
+
+	// SCARD_W_CHV_BLOCKED — The card cannot be accessed because the maximum
+	// number of PIN entry attempts has been reached.
+	SCARD_W_CHV_BLOCKED = 0x8010006C
+
+	// SCARD_W_CANCELLED_BY_USER — The action was cancelled by the user.
+	SCARD_W_CANCELLED_BY_USER = 0x8010006E
+
+	// SCARD_W_REMOVED_CARD — The smart card has been removed, so that further
+	// communication is not possible.
+	SCARD_W_REMOVED_CARD = 0x80100069
+
+	// SCARD_W_RESET_CARD — The smart card has been reset, so any shared state
+	// information is invalid.
+	SCARD_W_RESET_CARD = 0x80100068
+
+	// SCARD_E_READER_UNAVAILABLE — The specified reader is not currently
+	// available for use.
+	SCARD_E_READER_UNAVAILABLE = 0x80100017
+
+	// HRESULT_ERROR_CANCELLED — The operation was canceled by the user.
+	HRESULT_ERROR_CANCELLED = 0x800704C7
+
+	// NCRYPT_PIN_CACHE_DISABLE_DPL_FLAG disables the smart card PIN cache when
+	// set in NCRYPT_PIN_CACHE_FLAGS_PROPERTY.
+	NCRYPT_PIN_CACHE_DISABLE_DPL_FLAG = 0x00000001
+
+	// szOID_PKIX_KP_SERVER_AUTH and szOID_PKIX_KP_CLIENT_AUTH are the TLS
+	// extended key usages.
+	szOID_PKIX_KP_SERVER_AUTH = "1.3.6.1.5.5.7.3.1"
+	szOID_PKIX_KP_CLIENT_AUTH = "1.3.6.1.5.5.7.3.2"
+
+	// szOID_NIST_AES256_CBC is the content encryption algorithm used for
+	// wrapped key exports.
+	szOID_NIST_AES256_CBC = "2.16.840.1.101.3.4.1.42"
 )
 
 // winAPIFlag specifies the flags that should be passed to
 // CryptAcquireCertificatePrivateKey. This impacts whether the CryptoAPI or CNG
-// API will be used.
+// API will be used. It is only used for stores opened with KeyStorageAuto, and
+// is kept for compatibility. Prefer OpenOptions.KeyStorage.
 //
 // Possible values are:
 //   0x00000000 —                                      — Only use CryptoAPI.
@@ -70,458 +229,2195 @@ const (
 //   0x00040000 — CRYPT_ACQUIRE_ONLY_NCRYPT_KEY_FLAG   — Only uyse CNG.
 var winAPIFlag C.DWORD = C.CRYPT_ACQUIRE_PREFER_NCRYPT_KEY_FLAG
 
+// apiFlag gets the CRYPT_ACQUIRE_*_NCRYPT_KEY_FLAG for a key storage
+// preference.
+func apiFlag(pref KeyStoragePreference) C.DWORD {
+	switch pref {
+	case KeyStoragePreferCAPI:
+		return C.CRYPT_ACQUIRE_ALLOW_NCRYPT_KEY_FLAG
+	case KeyStoragePreferCNG:
+		return C.CRYPT_ACQUIRE_PREFER_NCRYPT_KEY_FLAG
+	case KeyStorageOnlyCNG:
+		return C.CRYPT_ACQUIRE_ONLY_NCRYPT_KEY_FLAG
+	default:
+		return winAPIFlag
+	}
+}
+
+// resolveLocations are the store locations searched by ResolveIdentity.
+var resolveLocations = []StoreLocation{StoreLocationCurrentUser, StoreLocationLocalMachine}
+
+// Make sure the platform store and identity implement the interfaces returned
+// by Open and Store.Identities.
+var (
+	_ Store    = (*winStore)(nil)
+	_ Identity = (*winIdentity)(nil)
+)
+
 // winStore is a wrapper around a C.HCERTSTORE.
 type winStore struct {
+	// mu guards store against being closed while in use.
+	mu    sync.RWMutex
 	store C.HCERTSTORE
+	opts  OpenOptions
 }
 
-// openStore opens the current user's personal cert store.
-func openStore() (*winStore, error) {
-	storeName := unsafe.Pointer(stringToUTF16("MY"))
-	defer C.free(storeName)
+// openStore opens the requested system cert store, by default the personal
+// (MY) store.
+func openStore(opts OpenOptions) (*winStore, error) {
+	name := opts.StoreName
+	if name == "" && opts.StoreProvider != StoreProviderPhysical {
+		name = "MY"
+	} else if name != "" && strings.TrimSpace(name) == "" || strings.ContainsRune(name, 0) {
+		return nil, fmt.Errorf("invalid store name: %q", name)
+	}
 
-	store := C.CertOpenStore(CERT_STORE_PROV_SYSTEM_W, 0, 0, C.CERT_SYSTEM_STORE_CURRENT_USER, storeName)
-	if store == nil {
-		return nil, lastError("failed to open system cert store")
+	provider, err := storeProvider(opts.StoreProvider, name)
+	if err != nil {
+		return nil, err
 	}
 
-	return &winStore{store}, nil
-}
+	storeName := unsafe.Pointer(stringToUTF16(name))
+	defer C.free(storeName)
 
-// Identities implements the Store interface.
-func (s *winStore) Identities() ([]Identity, error) {
-	var (
-		err    error
-		idents = []Identity{}
+	var location C.DWORD
+	switch opts.Location {
+	case StoreLocationCurrentUser:
+		location = C.CERT_SYSTEM_STORE_CURRENT_USER
+	case StoreLocationLocalMachine:
+		location = C.CERT_SYSTEM_STORE_LOCAL_MACHINE
+	default:
+		return nil, fmt.Errorf("unknown store location: %v", opts.Location)
+	}
 
-		// CertFindChainInStore parameters
-		encoding  = C.DWORD(C.X509_ASN_ENCODING)
-		flags     = C.DWORD(C.CERT_CHAIN_FIND_BY_ISSUER_CACHE_ONLY_FLAG | C.CERT_CHAIN_FIND_BY_ISSUER_CACHE_ONLY_URL_FLAG)
-		findType  = C.DWORD(C.CERT_CHAIN_FIND_BY_ISSUER)
-		params    = &C.CERT_CHAIN_FIND_BY_ISSUER_PARA{cbSize: C.DWORD(unsafe.Sizeof(C.CERT_CHAIN_FIND_BY_ISSUER_PARA{}))}
-		paramsPtr = unsafe.Pointer(params)
-		chainCtx  = C.PCCERT_CHAIN_CONTEXT(nil)
-	)
+	if opts.IncludeArchived {
+		location |= C.CERT_STORE_ENUM_ARCHIVED_FLAG
+	}
 
-	for {
-		if chainCtx = C.CertFindChainInStore(s.store, encoding, flags, findType, paramsPtr, chainCtx); chainCtx == nil {
-			break
-		}
-		if chainCtx.cChain < 1 {
-			err = errors.New("bad chain")
-			goto fail
-		}
+	store := C.CertOpenStore(provider, 0, 0, location, storeName)
+	if store == nil {
+		err := lastError(fmt.Sprintf("failed to open %s system cert store", name))
+		logf(opts.Logger, "certstore: CertOpenStore(%q, flags=0x%08X) failed: %v", name, location, err)
+		return nil, err
+	}
+	logf(opts.Logger, "certstore: CertOpenStore(%q, flags=0x%08X) succeeded", name, location)
 
-		// not sure why this isn't 1 << 29
-		const maxPointerArray = 1 << 28
+	return &winStore{store: store, opts: opts}, nil
+}
 
-		// rgpChain is actually an array, but we only care about the first one.
-		simpleChain := *chainCtx.rgpChain
-		if simpleChain.cElement < 1 || simpleChain.cElement > maxPointerArray {
-			err = errors.New("bad chain")
-			goto fail
+// storeProvider gets the CERT_STORE_PROV_* provider for a StoreProvider,
+// checking that the store name has the form the provider expects.
+func storeProvider(provider StoreProvider, name string) (C.LPCSTR, error) {
+	switch provider {
+	case StoreProviderSystem, StoreProviderSystemRegistry:
+		if strings.ContainsRune(name, '\\') {
+			return nil, fmt.Errorf("store name %q names a physical store, which needs StoreProviderPhysical", name)
 		}
 
-		// Hacky way to get chain elements (c array) as a slice.
-		chainElts := (*[maxPointerArray]C.PCERT_CHAIN_ELEMENT)(unsafe.Pointer(simpleChain.rgpElement))[:simpleChain.cElement:simpleChain.cElement]
+		if provider == StoreProviderSystemRegistry {
+			return CERT_STORE_PROV_SYSTEM_REGISTRY_W, nil
+		}
 
-		// Build chain of certificates from each elt's certificate context.
-		chain := make([]C.PCCERT_CONTEXT, len(chainElts))
-		for j := range chainElts {
-			chain[j] = chainElts[j].pCertContext
+		return CERT_STORE_PROV_SYSTEM_W, nil
+	case StoreProviderPhysical:
+		if parts := strings.Split(name, `\`); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("StoreProviderPhysical needs a store name like `MY\\.Default`, not %q", name)
 		}
 
-		idents = append(idents, newWinIdentity(chain))
+		return CERT_STORE_PROV_PHYSICAL_W, nil
+	default:
+		return nil, fmt.Errorf("unknown store provider: %v", provider)
 	}
+}
 
-	if err = checkError("failed to iterate certs in store"); err != nil && errors.Cause(err) != errCode(CRYPT_E_NOT_FOUND) {
-		goto fail
+// importEphemeral opens a PFX as an in-memory store for ImportEphemeral. The
+// keys are loaded with PKCS12_NO_PERSIST_KEY, so they are freed along with the
+// store.
+func importEphemeral(data []byte, password string) (*winStore, error) {
+	store, err := openPFX(data, password, C.PKCS12_NO_PERSIST_KEY|C.PKCS12_ALWAYS_CNG_KSP)
+	if err != nil {
+		return nil, err
 	}
 
-	return idents, nil
+	return &winStore{store: store, opts: OpenOptions{KeyStorage: KeyStorageOnlyCNG}}, nil
+}
 
-fail:
-	for _, ident := range idents {
-		ident.Close()
+// Identities implements the Store interface.
+func (s *winStore) Identities() ([]Identity, error) {
+	return s.identitiesContext(context.Background())
+}
+
+// iterateIdentities implements the identityIterable interface.
+func (s *winStore) iterateIdentities() (IdentityIterator, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.store == nil {
+		return nil, ErrClosed
 	}
 
-	return nil, err
+	return &winIdentityIterator{store: s}, nil
 }
 
-// Import implements the Store interface.
-func (s *winStore) Import(data []byte, password string) error {
-	cdata := C.CBytes(data)
-	defer C.free(cdata)
+// winIdentityIterator implements the IdentityIterator interface, reading one
+// chain from the store per call to Next.
+type winIdentityIterator struct {
+	store *winStore
 
-	cpw := stringToUTF16(password)
-	defer C.free(unsafe.Pointer(cpw))
+	// finder walks the store's chains. It is nil until Next is first called,
+	// and again after Reset.
+	finder chainFinder
+	done   bool
+}
 
-	pfx := &C.CRYPT_DATA_BLOB{
-		cbData: C.DWORD(len(data)),
-		pbData: (*C.BYTE)(cdata),
-	}
+// Next implements the IdentityIterator interface.
+func (it *winIdentityIterator) Next() (Identity, error) {
+	s := it.store
 
-	flags := C.CRYPT_USER_KEYSET
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	// import into preferred KSP
-	if winAPIFlag&C.CRYPT_ACQUIRE_PREFER_NCRYPT_KEY_FLAG > 0 {
-		flags |= C.PKCS12_PREFER_CNG_KSP
-	} else if winAPIFlag&C.CRYPT_ACQUIRE_ONLY_NCRYPT_KEY_FLAG > 0 {
-		flags |= C.PKCS12_ALWAYS_CNG_KSP
+	if s.store == nil {
+		return nil, ErrClosed
 	}
 
-	store := C.PFXImportCertStore(pfx, cpw, C.DWORD(flags))
-	if store == nil {
-		return lastError("failed to import PFX cert store")
+	if it.done {
+		return nil, io.EOF
 	}
-	defer C.CertCloseStore(store, C.CERT_CLOSE_STORE_FORCE_FLAG)
 
-	var (
-		ctx      = C.PCCERT_CONTEXT(nil)
-		encoding = C.DWORD(C.X509_ASN_ENCODING | C.PKCS_7_ASN_ENCODING)
-	)
+	if it.finder == nil {
+		it.finder = s.findChains()
+	}
 
-	for {
-		// iterate through certs in temporary store
-		if ctx = C.CertFindCertificateInStore(store, encoding, 0, C.CERT_FIND_ANY, nil, ctx); ctx == nil {
-			if err := checkError("failed to iterate certs in store"); err != nil && errors.Cause(err) != errCode(CRYPT_E_NOT_FOUND) {
-				return err
-			}
+	ident, done, err := nextIdentity(it.finder)
+	it.done = done
 
-			break
-		}
+	return ident, err
+}
 
-		// Copy the cert to the system store.
-		if ok := C.CertAddCertificateContextToStore(s.store, ctx, C.CERT_STORE_ADD_REPLACE_EXISTING, nil); ok == winFalse {
-			return lastError("failed to add importerd certificate to MY store")
-		}
-	}
+// Reset implements the IdentityIterator interface.
+func (it *winIdentityIterator) Reset() error {
+	it.Close()
+	it.done = false
 
 	return nil
 }
 
-// Close implements the Store interface.
-func (s *winStore) Close() {
-	C.CertCloseStore(s.store, 0)
-	s.store = nil
+// Close implements the IdentityIterator interface.
+func (it *winIdentityIterator) Close() {
+	if it.finder != nil {
+		it.finder.close()
+		it.finder = nil
+	}
 }
 
-// winIdentity implements the Identity interface.
-type winIdentity struct {
-	chain  []C.PCCERT_CONTEXT
-	signer *winPrivateKey
-}
+// identitiesContext implements the contextIdentifier interface. ctx is checked
+// before each certificate is read, since building chains for certificates on
+// slow smart card readers can block.
+func (s *winStore) identitiesContext(ctx context.Context) (_ []Identity, err error) {
+	defer trace("certstore.Identities")(&err)
 
-func newWinIdentity(chain []C.PCCERT_CONTEXT) *winIdentity {
-	for _, ctx := range chain {
-		C.CertDuplicateCertificateContext(ctx)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.store == nil {
+		return nil, ErrClosed
 	}
 
-	return &winIdentity{chain: chain}
+	finder := s.findChains()
+	defer finder.close()
+
+	return collectIdentities(ctx, finder)
 }
 
-// Certificate implements the Identity interface.
-func (i *winIdentity) Certificate() (*x509.Certificate, error) {
-	return exportCertCtx(i.chain[0])
+// chainFinder is the native half of enumerating a winStore: the cgo calls that
+// walk the store's certificate chains, as CertFindChainInStore does. The Go
+// half (cancellation, telling the end of the store from a failure and cleaning
+// up after errors) is kept out of it, so that it can be tested against a fake
+// finder without a real store.
+type chainFinder interface {
+	// next gets an identity for the next chain. If the chain can't be read,
+	// the error is returned instead. Once there are no chains left, ok is
+	// false and the error is whatever the API reported, which is
+	// CRYPT_E_NOT_FOUND if the whole store was walked.
+	next() (ident Identity, ok bool, err error)
+
+	// close frees the chain last found, if any.
+	close()
 }
 
-// CertificateChain implements the Identity interface.
-func (i *winIdentity) CertificateChain() ([]*x509.Certificate, error) {
+// findChains starts walking the store's certificate chains.
+func (s *winStore) findChains() chainFinder {
+	return &cgoChainFinder{store: s}
+}
+
+// cgoChainFinder implements the chainFinder interface with
+// CertFindChainInStore.
+type cgoChainFinder struct {
+	store *winStore
+
+	// chainCtx is the chain context last returned by CertFindChainInStore. It
+	// is owned by the finder until it is passed back in to find the next
+	// chain, which frees it. It is nil once the end has been reached, since
+	// CertFindChainInStore has freed it by then, so close never frees it
+	// twice.
+	chainCtx C.PCCERT_CHAIN_CONTEXT
+}
+
+// next implements the chainFinder interface.
+func (f *cgoChainFinder) next() (Identity, bool, error) {
 	var (
-		certs = make([]*x509.Certificate, len(i.chain))
-		err   error
+		// CertFindChainInStore parameters
+		encoding = C.DWORD(C.X509_ASN_ENCODING)
+		flags    = C.DWORD(C.CERT_CHAIN_FIND_BY_ISSUER_CACHE_ONLY_FLAG | C.CERT_CHAIN_FIND_BY_ISSUER_CACHE_ONLY_URL_FLAG)
+		findType = C.DWORD(C.CERT_CHAIN_FIND_BY_ISSUER)
+		params   = &C.CERT_CHAIN_FIND_BY_ISSUER_PARA{cbSize: C.DWORD(unsafe.Sizeof(C.CERT_CHAIN_FIND_BY_ISSUER_PARA{}))}
 	)
 
-	for j := range i.chain {
-		if certs[j], err = exportCertCtx(i.chain[j]); err != nil {
-			return nil, err
-		}
+	// CertFindChainInStore frees the previous chain context.
+	if f.chainCtx = C.CertFindChainInStore(f.store.store, encoding, flags, findType, unsafe.Pointer(params), f.chainCtx); f.chainCtx == nil {
+		return nil, false, checkError("failed to iterate certs in store")
 	}
 
-	return certs, nil
-}
+	chain, err := chainContexts(f.chainCtx)
+	if err != nil {
+		return nil, true, err
+	}
 
-// Signer implements the Identity interface.
-func (i *winIdentity) Signer() (crypto.Signer, error) {
-	return i.getPrivateKey()
+	ident := newWinIdentity(f.store, chain)
+	ident.partialChain = isPartialChain(f.chainCtx)
+
+	return ident, true, nil
 }
 
-// getPrivateKey gets this identity's private *winPrivateKey.
-func (i *winIdentity) getPrivateKey() (*winPrivateKey, error) {
-	if i.signer != nil {
-		return i.signer, nil
+// close implements the chainFinder interface.
+func (f *cgoChainFinder) close() {
+	if f.chainCtx != nil {
+		C.CertFreeCertificateChain(f.chainCtx)
+		f.chainCtx = nil
 	}
+}
 
-	cert, err := i.Certificate()
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to get identity certificate")
+// nextIdentity gets an identity for the finder's next chain. done is set once
+// there are no chains left, when io.EOF is returned unless walking the store
+// failed.
+func nextIdentity(finder chainFinder) (_ Identity, done bool, err error) {
+	ident, ok, err := finder.next()
+	if !ok {
+		if err != nil && errors.Cause(err) != errCode(CRYPT_E_NOT_FOUND) {
+			return nil, true, err
+		}
+
+		return nil, true, io.EOF
 	}
 
-	signer, err := newWinPrivateKey(i.chain[0], cert.PublicKey)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to load identity private key")
+		return nil, false, err
 	}
 
-	i.signer = signer
-
-	return i.signer, nil
+	return ident, false, nil
 }
 
-// Delete implements the Identity interface.
-func (i *winIdentity) Delete() error {
-	// duplicate cert context, since CertDeleteCertificateFromStore will free it.
-	deleteCtx := C.CertDuplicateCertificateContext(i.chain[0])
+// collectIdentities gets identities for all the chains the finder walks. ctx is
+// checked before each chain is read. If anything fails, the identities already
+// read are closed.
+func collectIdentities(ctx context.Context, finder chainFinder) ([]Identity, error) {
+	idents := []Identity{}
 
-	// try deleting cert
-	if ok := C.CertDeleteCertificateFromStore(deleteCtx); ok == winFalse {
-		return lastError("failed to delete certificate from store")
-	}
+	for {
+		if err := ctx.Err(); err != nil {
+			closeIdentities(idents)
+			return nil, err
+		}
 
-	// try deleting private key
-	wpk, err := i.getPrivateKey()
-	if err != nil {
-		return errors.Wrap(err, "failed to get identity private key")
+		ident, _, err := nextIdentity(finder)
+		if err == io.EOF {
+			return idents, nil
+		} else if err != nil {
+			closeIdentities(idents)
+			return nil, err
+		}
+
+		idents = append(idents, ident)
 	}
+}
 
-	if err := wpk.Delete(); err != nil {
-		return errors.Wrap(err, "failed to delete identity private key")
+// chainContexts gets the certificate contexts from the first simple chain in a
+// chain context, starting with the leaf. The contexts are owned by the chain
+// context.
+func chainContexts(chainCtx C.PCCERT_CHAIN_CONTEXT) ([]C.PCCERT_CONTEXT, error) {
+	if chainCtx.cChain < 1 {
+		return nil, errors.New("bad chain")
 	}
 
-	return nil
-}
+	// not sure why this isn't 1 << 29
+	const maxPointerArray = 1 << 28
 
-// Close implements the Identity interface.
-func (i *winIdentity) Close() {
-	if i.signer != nil {
-		i.signer.Close()
-		i.signer = nil
+	// rgpChain is actually an array, but we only care about the first one.
+	simpleChain := *chainCtx.rgpChain
+	if simpleChain.cElement < 1 || simpleChain.cElement > maxPointerArray {
+		return nil, errors.New("bad chain")
 	}
 
-	for _, ctx := range i.chain {
-		C.CertFreeCertificateContext(ctx)
-		i.chain = nil
+	// Hacky way to get chain elements (c array) as a slice.
+	chainElts := (*[maxPointerArray]C.PCERT_CHAIN_ELEMENT)(unsafe.Pointer(simpleChain.rgpElement))[:simpleChain.cElement:simpleChain.cElement]
+
+	// Build chain of certificates from each elt's certificate context.
+	chain := make([]C.PCCERT_CONTEXT, len(chainElts))
+	for j := range chainElts {
+		chain[j] = chainElts[j].pCertContext
 	}
+
+	return chain, nil
 }
 
-// winPrivateKey is a wrapper around a HCRYPTPROV_OR_NCRYPT_KEY_HANDLE.
-type winPrivateKey struct {
-	publicKey crypto.PublicKey
+// isPartialChain checks whether CryptoAPI couldn't build a chain context up to
+// a root.
+func isPartialChain(chainCtx C.PCCERT_CHAIN_CONTEXT) bool {
+	return chainCtx.TrustStatus.dwErrorStatus&C.CERT_TRUST_IS_PARTIAL_CHAIN != 0
+}
 
-	// CryptoAPI fields
-	capiProv C.HCRYPTPROV
+// findIdentityByThumbprint implements the thumbprintFinder interface, looking
+// the certificate up with CERT_FIND_SHA1_HASH rather than walking the store.
+func (s *winStore) findIdentityByThumbprint(thumbprint []byte) (Identity, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	// CNG fields
-	cngHandle C.NCRYPT_KEY_HANDLE
-	keySpec   C.DWORD
-}
+	if s.store == nil {
+		return nil, ErrClosed
+	}
+
+	if len(thumbprint) == 0 {
+		return nil, ErrNotFound
+	}
+
+	cdata := C.CBytes(thumbprint)
+	defer C.free(cdata)
 
-// newWinPrivateKey gets a *winPrivateKey for the given certificate.
-func newWinPrivateKey(certCtx C.PCCERT_CONTEXT, publicKey crypto.PublicKey) (*winPrivateKey, error) {
 	var (
-		provOrKey C.HCRYPTPROV_OR_NCRYPT_KEY_HANDLE
-		keySpec   C.DWORD
-		mustFree  C.WINBOOL
+		encoding = C.DWORD(C.X509_ASN_ENCODING | C.PKCS_7_ASN_ENCODING)
+		blob     = C.CRYPT_HASH_BLOB{cbData: C.DWORD(len(thumbprint)), pbData: (*C.BYTE)(cdata)}
 	)
 
-	if publicKey == nil {
-		return nil, errors.New("nil public key")
-	}
+	ctx := C.CertFindCertificateInStore(s.store, encoding, 0, C.CERT_FIND_SHA1_HASH, unsafe.Pointer(&blob), nil)
+	if ctx == nil {
+		if err := checkError("failed to find certificate"); err != nil && errors.Cause(err) != errCode(CRYPT_E_NOT_FOUND) {
+			return nil, err
+		}
 
-	// Get a handle for the found private key.
-	if ok := C.CryptAcquireCertificatePrivateKey(certCtx, winAPIFlag, nil, &provOrKey, &keySpec, &mustFree); ok == winFalse {
-		return nil, lastError("failed to get private key for certificate")
+		return nil, fmt.Errorf("no certificate with thumbprint %x: %w", thumbprint, ErrNotFound)
 	}
+	defer C.CertFreeCertificateContext(ctx)
 
-	if mustFree != winTrue {
-		// This shouldn't happen since we're not asking for cached keys.
-		return nil, errors.New("CryptAcquireCertificatePrivateKey set mustFree")
+	if !hasKeyProperty(ctx) {
+		return nil, fmt.Errorf("certificate with thumbprint %x has no private key: %w", thumbprint, ErrNotFound)
 	}
 
-	if keySpec == C.CERT_NCRYPT_KEY_SPEC {
-		return &winPrivateKey{
-			publicKey: publicKey,
-			cngHandle: C.NCRYPT_KEY_HANDLE(provOrKey),
-		}, nil
-	} else {
-		return &winPrivateKey{
-			publicKey: publicKey,
-			capiProv:  C.HCRYPTPROV(provOrKey),
-			keySpec:   keySpec,
-		}, nil
-	}
+	return s.identityForCert(ctx)
 }
 
-// Public implements the crypto.Signer interface.
-func (wpk *winPrivateKey) Public() crypto.PublicKey {
-	return wpk.publicKey
+// findIdentitiesBySubject implements the subjectFinder interface, looking the
+// certificates up with CERT_FIND_SUBJECT_STR_W rather than walking the store.
+func (s *winStore) findIdentitiesBySubject(cn string) ([]Identity, error) {
+	return s.findIdentitiesByName(C.CERT_FIND_SUBJECT_STR_W, cn)
 }
 
-// Sign implements the crypto.Signer interface.
-func (wpk *winPrivateKey) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
-	if wpk.capiProv != 0 {
-		return wpk.capiSignHash(opts.HashFunc(), digest)
-	} else if wpk.cngHandle != 0 {
-		return wpk.cngSignHash(opts.HashFunc(), digest)
+// findIdentitiesByIssuer implements the issuerFinder interface, looking the
+// certificates up with CERT_FIND_ISSUER_STR_W rather than walking the store.
+func (s *winStore) findIdentitiesByIssuer(issuerCN string) ([]Identity, error) {
+	return s.findIdentitiesByName(C.CERT_FIND_ISSUER_STR_W, issuerCN)
+}
+
+// findIdentitiesByName gets identities for all the certificates found with a
+// CERT_FIND_*_STR_W find type, which matches a substring of the name.
+// Certificates without a private key (e.g. imported peer certificates) are
+// skipped, as they are by Identities.
+func (s *winStore) findIdentitiesByName(findType C.DWORD, name string) (idents []Identity, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.store == nil {
+		return nil, ErrClosed
+	}
+
+	needle := stringToUTF16(name)
+	defer C.free(unsafe.Pointer(needle))
+
+	var (
+		encoding = C.DWORD(C.X509_ASN_ENCODING | C.PKCS_7_ASN_ENCODING)
+		ctx      = C.PCCERT_CONTEXT(nil)
+	)
+
+	idents = []Identity{}
+
+	for {
+		if ctx = C.CertFindCertificateInStore(s.store, encoding, 0, findType, unsafe.Pointer(needle), ctx); ctx == nil {
+			break
+		}
+
+		if !hasKeyProperty(ctx) {
+			continue
+		}
+
+		ident, identErr := s.identityForCert(ctx)
+		if identErr != nil {
+			C.CertFreeCertificateContext(ctx)
+			err = identErr
+			goto fail
+		}
+
+		idents = append(idents, ident)
+	}
+
+	if err = checkError("failed to find certificates"); err != nil && errors.Cause(err) != errCode(CRYPT_E_NOT_FOUND) {
+		goto fail
+	}
+
+	return idents, nil
+
+fail:
+	for _, ident := range idents {
+		ident.Close()
+	}
+
+	return nil, err
+}
+
+// identityForCert builds the certificate's chain and gets a winIdentity for
+// it.
+func (s *winStore) identityForCert(ctx C.PCCERT_CONTEXT) (*winIdentity, error) {
+	var (
+		para     = C.CERT_CHAIN_PARA{cbSize: C.DWORD(unsafe.Sizeof(C.CERT_CHAIN_PARA{}))}
+		chainCtx C.PCCERT_CHAIN_CONTEXT
+	)
+
+	if ok := C.CertGetCertificateChain(nil, ctx, nil, s.store, &para, C.CERT_CHAIN_CACHE_ONLY_URL_RETRIEVAL, nil, &chainCtx); ok == winFalse {
+		return nil, lastError("failed to build certificate chain")
+	}
+	defer C.CertFreeCertificateChain(chainCtx)
+
+	chain, err := chainContexts(chainCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	ident := newWinIdentity(s, chain)
+	ident.partialChain = isPartialChain(chainCtx)
+
+	return ident, nil
+}
+
+// Import implements the Store interface.
+func (s *winStore) Import(data []byte, password string) error {
+	return s.ImportWithOptions(data, password, ImportOptions{})
+}
+
+// ImportWithOptions implements the Store interface.
+func (s *winStore) ImportWithOptions(data []byte, password string, opts ImportOptions) error {
+	if opts.SmartCard {
+		return importToSmartCard(data, password, opts.Reader)
+	}
+
+	flags := C.CRYPT_USER_KEYSET
+	if opts.Exportable {
+		flags |= C.CRYPT_EXPORTABLE
+	}
+
+	// import into preferred KSP
+	if acquireFlag := apiFlag(s.opts.KeyStorage); acquireFlag&C.CRYPT_ACQUIRE_PREFER_NCRYPT_KEY_FLAG > 0 {
+		flags |= C.PKCS12_PREFER_CNG_KSP
+	} else if acquireFlag&C.CRYPT_ACQUIRE_ONLY_NCRYPT_KEY_FLAG > 0 {
+		flags |= C.PKCS12_ALWAYS_CNG_KSP
+	}
+
+	store, err := openPFX(data, password, C.DWORD(flags))
+	if err != nil {
+		return err
+	}
+	defer C.CertCloseStore(store, C.CERT_CLOSE_STORE_FORCE_FLAG)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.store == nil {
+		return ErrClosed
+	}
+
+	var caStore *winStore
+	if opts.InstallCACertificates {
+		if caStore, err = openStore(OpenOptions{StoreName: "CA", Location: s.opts.Location}); err != nil {
+			return err
+		}
+		defer caStore.Close()
+	}
+
+	var (
+		ctx      = C.PCCERT_CONTEXT(nil)
+		encoding = C.DWORD(C.X509_ASN_ENCODING | C.PKCS_7_ASN_ENCODING)
+	)
+
+	for {
+		// iterate through certs in temporary store
+		if ctx = C.CertFindCertificateInStore(store, encoding, 0, C.CERT_FIND_ANY, nil, ctx); ctx == nil {
+			if err := checkError("failed to iterate certs in store"); err != nil && errors.Cause(err) != errCode(CRYPT_E_NOT_FOUND) {
+				return err
+			}
+
+			break
+		}
+
+		// Only certificates with a private key are identities. The PFX's CA
+		// certificates don't belong in the personal store.
+		if !hasPrivateKey(ctx) {
+			if caStore == nil {
+				continue
+			}
+
+			if ok := C.CertAddCertificateContextToStore(caStore.store, ctx, C.CERT_STORE_ADD_USE_EXISTING, nil); ok == winFalse {
+				err := lastError("failed to add imported certificate to CA store")
+				C.CertFreeCertificateContext(ctx)
+				return err
+			}
+
+			continue
+		}
+
+		// Copy the cert to the system store.
+		var added C.PCCERT_CONTEXT
+		if ok := C.CertAddCertificateContextToStore(s.store, ctx, C.CERT_STORE_ADD_REPLACE_EXISTING, &added); ok == winFalse {
+			err := lastError("failed to add imported certificate to MY store")
+			C.CertFreeCertificateContext(ctx)
+			return err
+		}
+
+		if opts.FriendlyName != "" {
+			if err := setFriendlyName(added, opts.FriendlyName); err != nil {
+				C.CertFreeCertificateContext(added)
+				C.CertFreeCertificateContext(ctx)
+				return err
+			}
+		}
+		C.CertFreeCertificateContext(added)
+	}
+
+	return nil
+}
+
+// setFriendlyName sets a certificate's CERT_FRIENDLY_NAME_PROP_ID.
+func setFriendlyName(ctx C.PCCERT_CONTEXT, name string) error {
+	wname := stringToUTF16(name)
+	defer C.free(unsafe.Pointer(wname))
+
+	// The blob holds the NUL terminated UTF-16 string.
+	blob := C.CRYPT_DATA_BLOB{
+		cbData: C.DWORD((len(utf16.Encode([]rune(name))) + 1) * 2),
+		pbData: (*C.BYTE)(unsafe.Pointer(wname)),
+	}
+
+	if ok := C.CertSetCertificateContextProperty(ctx, C.CERT_FRIENDLY_NAME_PROP_ID, 0, unsafe.Pointer(&blob)); ok == winFalse {
+		return lastError("failed to set certificate friendly name")
+	}
+
+	return nil
+}
+
+// hasKeyProperty checks whether the certificate is associated with a private
+// key, either by a CERT_KEY_PROV_INFO_PROP_ID naming its container or by a key
+// handle set on the context (e.g. for PKCS12_NO_PERSIST_KEY imports). Unlike
+// hasPrivateKey, this doesn't open the key, so it never touches a smart card.
+func hasKeyProperty(ctx C.PCCERT_CONTEXT) bool {
+	for _, prop := range []C.DWORD{C.CERT_KEY_PROV_INFO_PROP_ID, C.CERT_KEY_CONTEXT_PROP_ID, C.CERT_NCRYPT_KEY_HANDLE_PROP_ID} {
+		var size C.DWORD
+		if ok := C.CertGetCertificateContextProperty(ctx, prop, nil, &size); ok == winTrue {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasPrivateKey checks whether a private key can be acquired for the
+// certificate, without prompting the user.
+func hasPrivateKey(ctx C.PCCERT_CONTEXT) bool {
+	var (
+		provOrKey C.HCRYPTPROV_OR_NCRYPT_KEY_HANDLE
+		keySpec   C.DWORD
+		mustFree  C.WINBOOL
+	)
+
+	if ok := C.CryptAcquireCertificatePrivateKey(ctx, C.CRYPT_ACQUIRE_ALLOW_NCRYPT_KEY_FLAG|C.CRYPT_ACQUIRE_SILENT_FLAG, nil, &provOrKey, &keySpec, &mustFree); ok == winFalse {
+		return false
+	}
+
+	if mustFree == winTrue {
+		if keySpec == C.CERT_NCRYPT_KEY_SPEC {
+			C.NCryptFreeObject(C.NCRYPT_HANDLE(provOrKey))
+		} else {
+			C.CryptReleaseContext(C.HCRYPTPROV(provOrKey), 0)
+		}
+	}
+
+	return true
+}
+
+// openPFX opens a PKCS#12 blob as a temporary cert store.
+func openPFX(data []byte, password string, flags C.DWORD) (C.HCERTSTORE, error) {
+	cdata := C.CBytes(data)
+	defer C.free(cdata)
+
+	cpw := stringToUTF16(password)
+	defer C.free(unsafe.Pointer(cpw))
+
+	pfx := &C.CRYPT_DATA_BLOB{
+		cbData: C.DWORD(len(data)),
+		pbData: (*C.BYTE)(cdata),
+	}
+
+	store := C.PFXImportCertStore(pfx, cpw, flags)
+	if store == nil {
+		return nil, lastError("failed to import PFX cert store")
+	}
+
+	return store, nil
+}
+
+// importToSmartCard writes the private keys and certificates from a PKCS#12
+// blob to a smart card via the smart card KSP. The PFX keys are loaded as
+// ephemeral, exportable keys so they never touch the software key store.
+func importToSmartCard(data []byte, password string, reader string) error {
+	store, err := openPFX(data, password, C.CRYPT_EXPORTABLE|C.PKCS12_NO_PERSIST_KEY|C.PKCS12_ALWAYS_CNG_KSP)
+	if err != nil {
+		return err
+	}
+	defer C.CertCloseStore(store, C.CERT_CLOSE_STORE_FORCE_FLAG)
+
+	var prov C.NCRYPT_PROV_HANDLE
+	if err := checkStatus(C.NCryptOpenStorageProvider(&prov, MS_SMART_CARD_KEY_STORAGE_PROVIDER, 0)); err != nil {
+		return errors.Wrap(err, "failed to open smart card key storage provider")
+	}
+	defer C.NCryptFreeObject(C.NCRYPT_HANDLE(prov))
+
+	var (
+		ctx      = C.PCCERT_CONTEXT(nil)
+		encoding = C.DWORD(C.X509_ASN_ENCODING | C.PKCS_7_ASN_ENCODING)
+		imported bool
+	)
+
+	for {
+		// iterate through certs in temporary store
+		if ctx = C.CertFindCertificateInStore(store, encoding, 0, C.CERT_FIND_ANY, nil, ctx); ctx == nil {
+			if err := checkError("failed to iterate certs in store"); err != nil && errors.Cause(err) != errCode(CRYPT_E_NOT_FOUND) {
+				return err
+			}
+
+			break
+		}
+
+		// Only certificates with a private key belong on the card. CA
+		// certificates from the PFX are skipped.
+		var (
+			key      C.HCRYPTPROV_OR_NCRYPT_KEY_HANDLE
+			keySpec  C.DWORD
+			mustFree C.WINBOOL
+		)
+
+		if ok := C.CryptAcquireCertificatePrivateKey(ctx, C.CRYPT_ACQUIRE_ONLY_NCRYPT_KEY_FLAG|C.CRYPT_ACQUIRE_SILENT_FLAG, nil, &key, &keySpec, &mustFree); ok == winFalse {
+			continue
+		}
+
+		err := importKeyToSmartCard(prov, ctx, C.NCRYPT_KEY_HANDLE(key), reader)
+
+		if mustFree == winTrue {
+			C.NCryptFreeObject(C.NCRYPT_HANDLE(key))
+		}
+
+		if err != nil {
+			C.CertFreeCertificateContext(ctx)
+			return err
+		}
+
+		imported = true
+	}
+
+	if !imported {
+		return errors.New("no private key found in PFX")
+	}
+
+	return nil
+}
+
+// importKeyToSmartCard copies an ephemeral CNG key and its certificate to a
+// smart card.
+func importKeyToSmartCard(prov C.NCRYPT_PROV_HANDLE, ctx C.PCCERT_CONTEXT, key C.NCRYPT_KEY_HANDLE, reader string) error {
+	cert, err := exportCertCtx(ctx)
+	if err != nil {
+		return err
+	}
+
+	blobType := BCRYPT_RSAFULLPRIVATE_BLOB
+	if _, isEC := cert.PublicKey.(*ecdsa.PublicKey); isEC {
+		blobType = BCRYPT_ECCPRIVATE_BLOB
+	}
+
+	// get key blob length
+	var size C.DWORD
+	if err := checkStatus(C.NCryptExportKey(key, 0, blobType, nil, nil, 0, &size, 0)); err != nil {
+		return errors.Wrap(err, "failed to get private key length")
+	}
+
+	// export key blob
+	blob := make([]byte, size)
+	blobPtr := (*C.BYTE)(unsafe.Pointer(&blob[0]))
+	defer func() {
+		for j := range blob {
+			blob[j] = 0
+		}
+	}()
+
+	if err := checkStatus(C.NCryptExportKey(key, 0, blobType, nil, blobPtr, size, &size, 0)); err != nil {
+		return errors.Wrap(err, "failed to export private key")
+	}
+
+	// Name the container after the certificate so re-importing is idempotent.
+	keyName := fmt.Sprintf("%X", thumbprint(cert))
+	if reader != "" {
+		keyName = fmt.Sprintf(`\\.\%s\%s`, reader, keyName)
+	}
+
+	ckeyName := stringToUTF16(keyName)
+	defer C.free(unsafe.Pointer(ckeyName))
+
+	var cardKey C.NCRYPT_KEY_HANDLE
+	if err := checkStatus(C.importNamedKey(prov, blobType, ckeyName, blobPtr, size, &cardKey)); err != nil {
+		return smartCardError(errors.Wrap(err, "failed to write private key to smart card"))
+	}
+	defer C.NCryptFreeObject(C.NCRYPT_HANDLE(cardKey))
+
+	// Setting the certificate property writes the certificate to the key's
+	// container on the card.
+	if err := checkStatus(C.NCryptSetProperty(C.NCRYPT_HANDLE(cardKey), NCRYPT_CERTIFICATE_PROPERTY, ctx.pbCertEncoded, ctx.cbCertEncoded, 0)); err != nil {
+		return smartCardError(errors.Wrap(err, "failed to write certificate to smart card"))
+	}
+
+	return nil
+}
+
+// smartCardError translates smart card capacity and PIN errors to the
+// corresponding package errors.
+func smartCardError(err error) error {
+	switch errors.Cause(err) {
+	case securityStatus(NTE_TOKEN_KEYSET_STORAGE_FULL), securityStatus(SCARD_E_WRITE_TOO_MANY):
+		return errors.Wrap(ErrSmartCardFull, err.Error())
+	case securityStatus(SCARD_W_WRONG_CHV), securityStatus(SCARD_W_CHV_BLOCKED):
+		return errors.Wrap(ErrIncorrectPIN, err.Error())
+	case securityStatus(SCARD_W_CANCELLED_BY_USER):
+		return errors.Wrap(ErrPINCancelled, err.Error())
+	default:
+		return err
+	}
+}
+
+// ExportTrustAnchors implements the Store interface. It reads the ROOT store
+// from both the current user and local machine locations.
+func (s *winStore) ExportTrustAnchors() ([]*x509.Certificate, error) {
+	return readSystemStores("ROOT")
+}
+
+// caCertificates reads the intermediate and root CA stores for
+// FindCACertificates.
+func caCertificates() ([]*x509.Certificate, error) {
+	return readSystemStores("CA", "ROOT")
+}
+
+// systemRoots gets the certificates for SystemRootPool.
+func systemRoots() ([]*x509.Certificate, error) {
+	return readSystemStores("ROOT", "CA")
+}
+
+// readSystemStores reads the named system stores for both the current user and
+// the local machine, removing duplicates.
+func readSystemStores(names ...string) ([]*x509.Certificate, error) {
+	var all []*x509.Certificate
+
+	for _, name := range names {
+		for _, location := range []C.DWORD{C.CERT_SYSTEM_STORE_CURRENT_USER, C.CERT_SYSTEM_STORE_LOCAL_MACHINE} {
+			certs, err := readSystemStore(name, location)
+			if err != nil {
+				return nil, err
+			}
+
+			all = append(all, certs...)
+		}
+	}
+
+	return dedupCertificates(all), nil
+}
+
+// readSystemStore gets every certificate in the named system store.
+func readSystemStore(name string, location C.DWORD) ([]*x509.Certificate, error) {
+	storeName := unsafe.Pointer(stringToUTF16(name))
+	defer C.free(storeName)
+
+	flags := location | C.CERT_STORE_READONLY_FLAG | C.CERT_STORE_OPEN_EXISTING_FLAG
+
+	store := C.CertOpenStore(CERT_STORE_PROV_SYSTEM_W, 0, 0, C.DWORD(flags), storeName)
+	if store == nil {
+		return nil, lastError(fmt.Sprintf("failed to open %s system cert store", name))
+	}
+	defer C.CertCloseStore(store, 0)
+
+	var (
+		certs []*x509.Certificate
+		ctx   = C.PCCERT_CONTEXT(nil)
+	)
+
+	for {
+		if ctx = C.CertEnumCertificatesInStore(store, ctx); ctx == nil {
+			if err := checkError("failed to iterate certs in store"); err != nil && errors.Cause(err) != errCode(CRYPT_E_NOT_FOUND) {
+				return nil, err
+			}
+
+			break
+		}
+
+		cert, err := exportCertCtx(ctx)
+		if err != nil {
+			// Some stores contain certs that Go can't parse. Skip them.
+			continue
+		}
+
+		certs = append(certs, cert)
+	}
+
+	return certs, nil
+}
+
+// FindRenewalOf implements the Store interface.
+func (s *winStore) FindRenewalOf(cert *x509.Certificate) (Identity, error) {
+	return findRenewalOf(s, cert)
+}
+
+// Close implements the Store interface.
+func (s *winStore) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.store == nil {
+		return
+	}
+
+	C.CertCloseStore(s.store, 0)
+	s.store = nil
+}
+
+// winIdentity implements the Identity interface.
+type winIdentity struct {
+	store  *winStore
+	chain  []C.PCCERT_CONTEXT
+	signer *winPrivateKey
+	spki   []byte
+
+	// partialChain is set if chain couldn't be built up to a root.
+	partialChain bool
+}
+
+func newWinIdentity(store *winStore, chain []C.PCCERT_CONTEXT) *winIdentity {
+	for _, ctx := range chain {
+		C.CertDuplicateCertificateContext(ctx)
+	}
+
+	return &winIdentity{store: store, chain: chain}
+}
+
+// Certificate implements the Identity interface.
+func (i *winIdentity) Certificate() (*x509.Certificate, error) {
+	if i.chain == nil {
+		return nil, ErrClosed
+	}
+
+	return exportCertCtx(i.chain[0])
+}
+
+// CertificateChain implements the Identity interface.
+func (i *winIdentity) CertificateChain() ([]*x509.Certificate, error) {
+	if i.chain == nil {
+		return nil, ErrClosed
+	}
+
+	var (
+		certs = make([]*x509.Certificate, len(i.chain))
+		err   error
+	)
+
+	for j := range i.chain {
+		if certs[j], err = exportCertCtx(i.chain[j]); err != nil {
+			return nil, err
+		}
+	}
+
+	if i.partialChain {
+		last := certs[len(certs)-1]
+		return certs, fmt.Errorf("no issuer found for %q: %w", last.Subject.String(), ErrPartialChain)
+	}
+
+	return certs, nil
+}
+
+// Signer implements the Identity interface.
+func (i *winIdentity) Signer() (crypto.Signer, error) {
+	// Don't export the certificate again once the key has been acquired. Test
+	// signers must be set before then.
+	if i.signer != nil {
+		return i.signer, nil
+	}
+
+	cert, err := i.Certificate()
+	if err != nil {
+		return nil, err
+	}
+
+	if signer := testSigner(cert); signer != nil {
+		return signer, nil
+	}
+
+	return i.getPrivateKey()
+}
+
+// getPrivateKey gets this identity's private *winPrivateKey.
+func (i *winIdentity) getPrivateKey() (_ *winPrivateKey, err error) {
+	if i.signer != nil {
+		return i.signer, nil
+	}
+
+	defer trace("certstore.AcquireKey")(&err)
+
+	cert, err := i.Certificate()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get identity certificate")
+	}
+
+	var signer *winPrivateKey
+	if i.store.opts.Reader != "" {
+		signer, err = i.openReaderKey(cert.PublicKey)
+	} else {
+		signer, err = newWinPrivateKey(i.chain[0], cert.PublicKey, i.store.opts)
+	}
+	if cause := errors.Cause(err); cause == errCode(CRYPT_E_NO_KEY_PROPERTY) || cause == errCode(NTE_BAD_KEYSET) {
+		return nil, errors.Wrap(ErrNoPrivateKey, err.Error())
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to load identity private key")
+	}
+
+	i.signer = signer
+
+	return i.signer, nil
+}
+
+// openReaderKey opens this identity's key on the card in the reader named by
+// OpenOptions.Reader. CryptAcquireCertificatePrivateKey lets the provider pick
+// whichever reader has a matching card, so the key is instead opened by its
+// fully qualified name (\\.\<reader>\<container>).
+func (i *winIdentity) openReaderKey(publicKey crypto.PublicKey) (*winPrivateKey, error) {
+	reader := i.store.opts.Reader
+
+	info, err := i.KeyProviderInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	// CNG keys have a provider type of zero.
+	if info.ProviderType != 0 {
+		return nil, errors.New("pinning to a reader requires a CNG key storage provider")
+	}
+
+	provName := stringToUTF16(info.Provider)
+	defer C.free(unsafe.Pointer(provName))
+
+	var prov C.NCRYPT_PROV_HANDLE
+	if err := checkStatus(C.NCryptOpenStorageProvider(&prov, provName, 0)); err != nil {
+		return nil, errors.Wrap(err, "failed to open key storage provider")
+	}
+	defer C.NCryptFreeObject(C.NCRYPT_HANDLE(prov))
+
+	keyName := stringToUTF16(fmt.Sprintf(`\\.\%s\%s`, reader, info.Container))
+	defer C.free(unsafe.Pointer(keyName))
+
+	// As with CryptAcquireCertificatePrivateKey, Silent stops the provider
+	// prompting for a PIN while opening the key.
+	var openFlags C.DWORD
+	if i.store.opts.Silent {
+		openFlags = C.NCRYPT_SILENT_FLAG
+	}
+
+	var key C.NCRYPT_KEY_HANDLE
+	if err := checkStatus(C.NCryptOpenKey(prov, &key, keyName, C.DWORD(info.KeySpec), openFlags)); err != nil {
+		switch errors.Cause(err) {
+		case securityStatus(NTE_BAD_KEYSET), securityStatus(NTE_NOT_FOUND), securityStatus(SCARD_E_NO_SMARTCARD), securityStatus(SCARD_E_UNKNOWN_READER):
+			return nil, fmt.Errorf("no card with key in reader %q: %s: %w", reader, err, ErrNotFound)
+		default:
+			return nil, smartCardError(errors.Wrap(err, "failed to open key on smart card"))
+		}
+	}
+
+	return newCNGPrivateKey(key, publicKey, i.store.opts), nil
+}
+
+// SetArchived implements the Identity interface. Archiving sets
+// CERT_ARCHIVED_PROP_ID on the certificate and unarchiving removes it.
+func (i *winIdentity) SetArchived(archived bool) error {
+	if i.chain == nil {
+		return ErrClosed
+	}
+
+	var (
+		// The property is set by passing an empty blob.
+		blob = C.CRYPT_DATA_BLOB{}
+		data unsafe.Pointer
+	)
+
+	if archived {
+		data = unsafe.Pointer(&blob)
+	}
+
+	if ok := C.CertSetCertificateContextProperty(i.chain[0], C.CERT_ARCHIVED_PROP_ID, 0, data); ok == winFalse {
+		return lastError("failed to set CERT_ARCHIVED_PROP_ID")
+	}
+
+	return nil
+}
+
+// MustStaple implements the Identity interface.
+func (i *winIdentity) MustStaple() (bool, error) {
+	return mustStaple(i)
+}
+
+// CompleteChain implements the Identity interface.
+func (i *winIdentity) CompleteChain(ctx context.Context, fetch func(ctx context.Context, url string) ([]byte, error)) ([]*x509.Certificate, error) {
+	return completeChain(ctx, i, fetch)
+}
+
+// CAIssuersURLs implements the Identity interface.
+func (i *winIdentity) CAIssuersURLs() ([]string, error) {
+	return caIssuersURLs(i)
+}
+
+// SameKeyAs implements the Identity interface.
+func (i *winIdentity) SameKeyAs(other Identity) (bool, error) {
+	return sameKeyAs(i, other)
+}
+
+// KeyInfo implements the Identity interface. The key isn't acquired just to
+// cross-check it, since that may prompt for a PIN.
+func (i *winIdentity) KeyInfo() (KeyInfo, error) {
+	info, err := identityKeyInfo(i)
+	if err != nil {
+		return KeyInfo{}, err
+	}
+
+	if i.signer != nil && i.signer.cngHandle != 0 {
+		if err := i.signer.checkKeyInfo(info); err != nil {
+			return KeyInfo{}, err
+		}
+	}
+
+	return info, nil
+}
+
+// Thumbprint implements the Identity interface.
+func (i *winIdentity) Thumbprint() ([]byte, error) {
+	return identityThumbprint(i)
+}
+
+// ThumbprintSHA256 implements the Identity interface.
+func (i *winIdentity) ThumbprintSHA256() ([]byte, error) {
+	return identityThumbprintSHA256(i)
+}
+
+// Capabilities implements the Identity interface. The certificate's
+// capabilities are narrowed by what the key's provider allows.
+func (i *winIdentity) Capabilities() (KeyCapabilities, error) {
+	caps, err := identityCapabilities(i)
+	if err != nil {
+		return KeyCapabilities{}, err
+	}
+
+	wpk, err := i.getPrivateKey()
+	if err != nil {
+		return KeyCapabilities{}, err
+	}
+
+	return wpk.restrictCapabilities(caps)
+}
+
+// DisplayName implements the Identity interface. The certificate's
+// CERT_FRIENDLY_NAME_PROP_ID is used if it is set.
+func (i *winIdentity) DisplayName() (string, error) {
+	if i.chain == nil {
+		return "", ErrClosed
+	}
+
+	var size C.DWORD
+	if ok := C.CertGetCertificateContextProperty(i.chain[0], C.CERT_FRIENDLY_NAME_PROP_ID, nil, &size); ok == winTrue && size > 0 {
+		data := make([]byte, size)
+		if ok := C.CertGetCertificateContextProperty(i.chain[0], C.CERT_FRIENDLY_NAME_PROP_ID, unsafe.Pointer(&data[0]), &size); ok == winTrue {
+			if name := utf16BytesToString(data[:size]); name != "" {
+				return name, nil
+			}
+		}
+	}
+
+	return subjectDisplayName(i)
+}
+
+// ExportPFX implements the Identity interface.
+func (i *winIdentity) ExportPFX(password string) ([]byte, error) {
+	if i.chain == nil {
+		return nil, ErrClosed
+	}
+
+	store := C.CertOpenStore(CERT_STORE_PROV_MEMORY, 0, 0, 0, nil)
+	if store == nil {
+		return nil, lastError("failed to open memory cert store")
+	}
+	defer C.CertCloseStore(store, C.CERT_CLOSE_STORE_FORCE_FLAG)
+
+	if ok := C.CertAddCertificateContextToStore(store, i.chain[0], C.CERT_STORE_ADD_ALWAYS, nil); ok == winFalse {
+		return nil, lastError("failed to add certificate to memory store")
+	}
+
+	cpw := stringToUTF16(password)
+	defer C.free(unsafe.Pointer(cpw))
+
+	var (
+		pfx   C.CRYPT_DATA_BLOB
+		flags = C.DWORD(C.EXPORT_PRIVATE_KEYS | C.REPORT_NOT_ABLE_TO_EXPORT_PRIVATE_KEY)
+	)
+
+	// get PFX length
+	if ok := C.PFXExportCertStoreEx(store, &pfx, cpw, nil, flags); ok == winFalse {
+		return nil, exportError(lastError("failed to get PFX length"))
+	}
+
+	buf := C.malloc(C.size_t(pfx.cbData))
+	defer C.free(buf)
+	pfx.pbData = (*C.BYTE)(buf)
+
+	if ok := C.PFXExportCertStoreEx(store, &pfx, cpw, nil, flags); ok == winFalse {
+		return nil, exportError(lastError("failed to export PFX"))
+	}
+
+	return C.GoBytes(buf, C.int(pfx.cbData)), nil
+}
+
+// exportError translates the errors providers give for keys that can't be
+// exported to ErrNotExportable.
+func exportError(err error) error {
+	switch errors.Cause(err) {
+	case errCode(NTE_NOT_SUPPORTED), errCode(NTE_PERM), errCode(NTE_BAD_KEY_STATE), errCode(NTE_BAD_TYPE):
+		return fmt.Errorf("%s: %w", err, ErrNotExportable)
+	default:
+		return err
+	}
+}
+
+// ExportCER implements the Identity interface.
+func (i *winIdentity) ExportCER() ([]byte, error) {
+	return exportCER(i)
+}
+
+// SPKIFingerprint implements the Identity interface.
+func (i *winIdentity) SPKIFingerprint() ([]byte, error) {
+	if i.spki != nil {
+		return append([]byte(nil), i.spki...), nil
+	}
+
+	cert, err := i.Certificate()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get identity certificate")
+	}
+
+	if i.spki, err = spkiFingerprint(cert); err != nil {
+		return nil, errors.Wrap(err, "failed to marshal public key")
+	}
+
+	return append([]byte(nil), i.spki...), nil
+}
+
+// VerifyForUsage implements the Identity interface. The SSL chain policy is
+// used if server or client auth is among the usages (server auth taking
+// precedence). Otherwise the base chain policy is used.
+func (i *winIdentity) VerifyForUsage(usageOIDs []string) error {
+	if i.chain == nil {
+		return ErrClosed
+	}
+
+	var (
+		usages    = make([]C.LPSTR, len(usageOIDs))
+		usagesPtr *C.LPSTR
+		authType  C.DWORD
+	)
+
+	for j, oid := range usageOIDs {
+		usages[j] = C.CString(oid)
+		defer C.free(unsafe.Pointer(usages[j]))
+
+		switch {
+		case oid == szOID_PKIX_KP_SERVER_AUTH:
+			authType = C.AUTHTYPE_SERVER
+		case oid == szOID_PKIX_KP_CLIENT_AUTH && authType == 0:
+			authType = C.AUTHTYPE_CLIENT
+		}
+	}
+
+	if len(usages) > 0 {
+		usagesPtr = &usages[0]
+	}
+
+	var chainFlags C.DWORD
+	switch i.store.opts.Revocation {
+	case RevocationNone:
+	case RevocationCacheOnly:
+		chainFlags = C.CERT_CHAIN_REVOCATION_CHECK_CHAIN_EXCLUDE_ROOT | C.CERT_CHAIN_REVOCATION_CHECK_CACHE_ONLY
+	case RevocationOnline:
+		chainFlags = C.CERT_CHAIN_REVOCATION_CHECK_CHAIN_EXCLUDE_ROOT
+	default:
+		return fmt.Errorf("unknown revocation mode: %d", i.store.opts.Revocation)
+	}
+
+	var policyErr C.DWORD
+	if code := C.verifyChainForUsage(i.chain[0], usagesPtr, C.DWORD(len(usages)), authType, chainFlags, &policyErr); code != 0 {
+		return errors.Wrap(errCode(code), "failed to verify certificate chain")
+	}
+
+	if policyErr != 0 {
+		return errors.Wrap(errCode(policyErr), "certificate chain policy check failed")
+	}
+
+	return nil
+}
+
+// ReaderName implements the Identity interface.
+func (i *winIdentity) ReaderName() (string, error) {
+	wpk, err := i.getPrivateKey()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get identity private key")
+	}
+
+	// Only CNG exposes the reader for smart card keys.
+	if wpk.cngHandle == 0 {
+		return "", ErrUnsupportedOperation
+	}
+
+	prop, err := wpk.getProperty(NCRYPT_READER_PROPERTY)
+	if cause := errors.Cause(err); cause == securityStatus(NTE_NOT_SUPPORTED) || cause == securityStatus(NTE_NOT_FOUND) {
+		return "", ErrUnsupportedOperation
+	} else if err != nil {
+		return "", errors.Wrap(err, "failed to get NCRYPT_READER_PROPERTY")
+	}
+
+	name := utf16BytesToString(prop)
+	if name == "" {
+		return "", ErrUnsupportedOperation
+	}
+
+	return name, nil
+}
+
+// KeyProviderInfo implements the Identity interface. Once the private key has
+// been acquired (e.g. by Signer), the information is read from the key itself,
+// so it describes the key actually in use. Otherwise it comes from the
+// certificate's CERT_KEY_PROV_INFO_PROP_ID.
+func (i *winIdentity) KeyProviderInfo() (ProviderInfo, error) {
+	if i.chain == nil {
+		return ProviderInfo{}, ErrClosed
+	}
+
+	if i.signer != nil {
+		return i.signer.providerInfo()
+	}
+
+	var size C.DWORD
+	if ok := C.CertGetCertificateContextProperty(i.chain[0], C.CERT_KEY_PROV_INFO_PROP_ID, nil, &size); ok == winFalse {
+		return ProviderInfo{}, lastError("failed to get CERT_KEY_PROV_INFO_PROP_ID size")
+	}
+
+	// The property contains pointers into itself, so keep it in C memory.
+	data := C.malloc(C.size_t(size))
+	defer C.free(data)
+
+	if ok := C.CertGetCertificateContextProperty(i.chain[0], C.CERT_KEY_PROV_INFO_PROP_ID, data, &size); ok == winFalse {
+		return ProviderInfo{}, lastError("failed to get CERT_KEY_PROV_INFO_PROP_ID")
+	}
+
+	info := (*C.CRYPT_KEY_PROV_INFO)(data)
+
+	return ProviderInfo{
+		Provider:     utf16PtrToString(unsafe.Pointer(info.pwszProvName)),
+		Container:    utf16PtrToString(unsafe.Pointer(info.pwszContainerName)),
+		ProviderType: uint32(info.dwProvType),
+		KeySpec:      uint32(info.dwKeySpec),
+	}, nil
+}
+
+// Delete implements the Identity interface.
+func (i *winIdentity) Delete() error {
+	if i.chain == nil {
+		return ErrClosed
+	}
+
+	// duplicate cert context, since CertDeleteCertificateFromStore will free it.
+	deleteCtx := C.CertDuplicateCertificateContext(i.chain[0])
+
+	// try deleting cert
+	if ok := C.CertDeleteCertificateFromStore(deleteCtx); ok == winFalse {
+		return lastError("failed to delete certificate from store")
+	}
+
+	// try deleting private key
+	wpk, err := i.getPrivateKey()
+	if err != nil {
+		return errors.Wrap(err, "failed to get identity private key")
+	}
+
+	if err := wpk.Delete(); err != nil {
+		return errors.Wrap(err, "failed to delete identity private key")
+	}
+
+	return nil
+}
+
+// Clone implements the Identity interface.
+func (i *winIdentity) Clone() (Identity, error) {
+	if i.chain == nil {
+		return nil, ErrClosed
+	}
+
+	// newWinIdentity duplicates each context, so the clone holds its own
+	// references. The private key is acquired separately by the clone.
+	chain := make([]C.PCCERT_CONTEXT, len(i.chain))
+	copy(chain, i.chain)
+
+	clone := newWinIdentity(i.store, chain)
+	clone.partialChain = i.partialChain
+
+	return clone, nil
+}
+
+// Close implements the Identity interface.
+func (i *winIdentity) Close() {
+	if i.signer != nil {
+		i.signer.Close()
+		i.signer = nil
+	}
+
+	for _, ctx := range i.chain {
+		C.CertFreeCertificateContext(ctx)
+		i.chain = nil
+	}
+}
+
+// winPrivateKey is a wrapper around a HCRYPTPROV_OR_NCRYPT_KEY_HANDLE.
+type winPrivateKey struct {
+	publicKey crypto.PublicKey
+
+	// CryptoAPI fields
+	capiProv C.HCRYPTPROV
+
+	// CNG fields
+	cngHandle C.NCRYPT_KEY_HANDLE
+	keySpec   C.DWORD
+
+	// cached result of supportsPSS. Signers may be used concurrently, so the
+	// probe and its result (including pssKey) are guarded by pssMu.
+	pssMu        sync.Mutex
+	pssProbed    bool
+	pssSupported bool
+
+	// For CryptoAPI keys, the certificate the key was acquired for (owned by
+	// the winIdentity) and the options it was acquired with. These are used
+	// to reacquire the key through CNG for RSA-PSS.
+	certCtx C.PCCERT_CONTEXT
+	opts    OpenOptions
+
+	// silent is set if the key was acquired with OpenOptions.Silent, so that
+	// CNG operations must not show UI either.
+	silent bool
+
+	// closed is set once the key's handles are released by Close.
+	closed bool
+
+	// logger is OpenOptions.Logger from the store the key was acquired from.
+	logger Logger
+
+	// retry is OpenOptions.Retry from the store the key was acquired from.
+	retry RetryPolicy
+
+	// native replaces the cgo half of signing in tests. See nativeKey.
+	native nativeKey
+
+	// sigLen caches the signature length the provider reported for the first
+	// sign, so that later signs can skip the length query, which may have to
+	// talk to a smart card. Signers may be used concurrently, so it is
+	// guarded by sigLenMu.
+	sigLenMu sync.Mutex
+	sigLen   C.DWORD
+
+	// pssKey is the key reacquired through CNG for RSA-PSS. It is guarded by
+	// pssMu.
+	pssKey *winPrivateKey
+}
+
+// newWinPrivateKey gets a *winPrivateKey for the given certificate.
+func newWinPrivateKey(certCtx C.PCCERT_CONTEXT, publicKey crypto.PublicKey, opts OpenOptions) (*winPrivateKey, error) {
+	return acquireWinPrivateKey(certCtx, publicKey, opts, apiFlag(opts.KeyStorage))
+}
+
+// acquireWinPrivateKey gets a *winPrivateKey for the given certificate, using
+// the given CRYPT_ACQUIRE_*_NCRYPT_KEY_FLAG to choose between CryptoAPI and
+// CNG.
+func acquireWinPrivateKey(certCtx C.PCCERT_CONTEXT, publicKey crypto.PublicKey, opts OpenOptions, apiFlag C.DWORD) (*winPrivateKey, error) {
+	var (
+		provOrKey C.HCRYPTPROV_OR_NCRYPT_KEY_HANDLE
+		keySpec   C.DWORD
+		mustFree  C.WINBOOL
+	)
+
+	if publicKey == nil {
+		return nil, errors.New("nil public key")
+	}
+
+	// For CryptoAPI keys, this acquires the context with CRYPT_SILENT.
+	if opts.Silent {
+		apiFlag |= C.CRYPT_ACQUIRE_SILENT_FLAG
+	}
+
+	// Get a handle for the found private key.
+	if ok := C.CryptAcquireCertificatePrivateKey(certCtx, apiFlag, nil, &provOrKey, &keySpec, &mustFree); ok == winFalse {
+		err := lastError("failed to get private key for certificate")
+		logf(opts.Logger, "certstore: CryptAcquireCertificatePrivateKey(flags=0x%08X) failed: %v", apiFlag, err)
+		return nil, err
+	}
+	logf(opts.Logger, "certstore: CryptAcquireCertificatePrivateKey(flags=0x%08X) succeeded with key spec 0x%X", apiFlag, keySpec)
+
+	if mustFree != winTrue {
+		// This shouldn't happen since we're not asking for cached keys.
+		return nil, errors.New("CryptAcquireCertificatePrivateKey set mustFree")
+	}
+
+	if keySpec == C.CERT_NCRYPT_KEY_SPEC {
+		return newCNGPrivateKey(C.NCRYPT_KEY_HANDLE(provOrKey), publicKey, opts), nil
+	} else {
+		return &winPrivateKey{
+			publicKey: publicKey,
+			capiProv:  C.HCRYPTPROV(provOrKey),
+			keySpec:   keySpec,
+			certCtx:   certCtx,
+			opts:      opts,
+			silent:    opts.Silent,
+			logger:    opts.Logger,
+			retry:     opts.Retry,
+		}, nil
+	}
+}
+
+// newCNGPrivateKey wraps a CNG key handle, however it was opened, applying the
+// store's options for signing.
+func newCNGPrivateKey(key C.NCRYPT_KEY_HANDLE, publicKey crypto.PublicKey, opts OpenOptions) *winPrivateKey {
+	wpk := &winPrivateKey{
+		publicKey: publicKey,
+		cngHandle: key,
+		silent:    opts.Silent,
+		logger:    opts.Logger,
+		retry:     opts.Retry,
+	}
+
+	wpk.setPINCache(opts.PINCache)
+
+	return wpk
+}
+
+// Public implements the crypto.Signer interface.
+func (wpk *winPrivateKey) Public() crypto.PublicKey {
+	return wpk.publicKey
+}
+
+// Sign implements the crypto.Signer interface.
+func (wpk *winPrivateKey) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) (_ []byte, err error) {
+	defer trace("certstore.Sign")(&err)
+
+	if wpk.closed {
+		return nil, ErrClosed
+	}
+
+	return retrySign(wpk.retry, isTransientCardError, func() ([]byte, error) {
+		return wpk.sign(digest, opts)
+	})
+}
+
+// sign signs a digest once, without retrying.
+func (wpk *winPrivateKey) sign(digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	opts, littleEndian, err := unwrapLittleEndianOpts(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Ed25519 signs the whole message rather than a digest.
+	if _, isEd25519 := wpk.publicKey.(ed25519.PublicKey); isEd25519 {
+		return wpk.cngSignEd25519(digest, opts)
+	}
+
+	if err := checkDigest(digest, opts.HashFunc()); err != nil {
+		return nil, err
+	}
+
+	// Fail fast rather than letting the provider fail in the middle of a TLS
+	// handshake.
+	if pssOpts, isPSS := opts.(*rsa.PSSOptions); isPSS {
+		if !wpk.supportsPSS() {
+			return nil, ErrPSSUnsupportedByProvider
+		}
+
+		key := wpk.nativeKey()
+
+		wpk.pssMu.Lock()
+		if wpk.pssKey != nil {
+			key = wpk.pssKey.nativeKey()
+		}
+		wpk.pssMu.Unlock()
+
+		return signDigest(key, wpk.publicKey, opts.HashFunc(), digest, pssOpts, false)
+	}
+
+	return signDigest(wpk.nativeKey(), wpk.publicKey, opts.HashFunc(), digest, nil, littleEndian)
+}
+
+// nativeKey is the native half of signing with a winPrivateKey: the cgo calls
+// that produce a signature in the API's own format. The Go half (checking
+// digests, retrying and encoding signatures) is kept out of it, so that it can
+// be tested against a fake key without a real store.
+type nativeKey interface {
+	// signHash signs a digest. ECDSA signatures are returned as raw r||s
+	// values, as CNG produces them.
+	signHash(hash crypto.Hash, digest []byte, pssOpts *rsa.PSSOptions) ([]byte, error)
+
+	// littleEndian reports whether signatures are returned little-endian, as
+	// CryptoAPI produces them.
+	littleEndian() bool
+}
+
+// nativeKey gets the key's native half. This is the key itself, unless it was
+// replaced with a fake for testing.
+func (wpk *winPrivateKey) nativeKey() nativeKey {
+	if wpk.native != nil {
+		return wpk.native
+	}
+
+	return wpk
+}
+
+// signHash implements the nativeKey interface.
+func (wpk *winPrivateKey) signHash(hash crypto.Hash, digest []byte, pssOpts *rsa.PSSOptions) ([]byte, error) {
+	if wpk.capiProv != 0 {
+		return wpk.capiSignHash(hash, digest)
+	} else if wpk.cngHandle != 0 {
+		return wpk.cngSignHash(hash, digest, pssOpts)
 	} else {
 		return nil, errors.New("bad private key")
 	}
 }
 
-// cngSignHash signs a digest using the CNG APIs.
-func (wpk *winPrivateKey) cngSignHash(hash crypto.Hash, digest []byte) ([]byte, error) {
-	if len(digest) != hash.Size() {
-		return nil, errors.New("bad digest for hash")
+// littleEndian implements the nativeKey interface.
+func (wpk *winPrivateKey) littleEndian() bool {
+	return wpk.capiProv != 0
+}
+
+// signDigest signs a digest with a native key, converting the signature to the
+// form crypto.Signer callers expect: big-endian for RSA (unless littleEndian is
+// set) and ASN.1 DER for ECDSA. ECDSA keys held by CryptoAPI providers are
+// rejected, since CryptSignHash's signature format is only defined for RSA.
+func signDigest(key nativeKey, pub crypto.PublicKey, hash crypto.Hash, digest []byte, pssOpts *rsa.PSSOptions, littleEndian bool) ([]byte, error) {
+	if _, isEC := pub.(*ecdsa.PublicKey); isEC && key.littleEndian() {
+		return nil, errors.Wrap(ErrUnsupportedOperation, "ECDSA keys can't sign through CryptoAPI; use KeyStorageOnlyCNG")
+	}
+
+	sig, err := key.signHash(hash, digest, pssOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	if key.littleEndian() {
+		if !littleEndian {
+			reverseBytes(sig)
+		}
+
+		return sig, nil
+	}
+
+	if _, isEC := pub.(*ecdsa.PublicKey); isEC {
+		return ecdsaRawToDER(sig)
+	}
+
+	return sig, nil
+}
+
+// ecdsaRawToDER converts a raw r||s ECDSA signature, as CNG produces, to the
+// ASN.1 DER encoding Go uses.
+func ecdsaRawToDER(sig []byte) ([]byte, error) {
+	if len(sig) == 0 || len(sig)%2 != 0 {
+		return nil, errors.New("bad ecdsa signature from CNG")
+	}
+
+	type ecdsaSignature struct {
+		R, S *big.Int
+	}
+
+	r := new(big.Int).SetBytes(sig[:len(sig)/2])
+	s := new(big.Int).SetBytes(sig[len(sig)/2:])
+
+	encoded, err := asn1.Marshal(ecdsaSignature{r, s})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to ASN.1 encode EC signature")
+	}
+
+	return encoded, nil
+}
+
+// reverseBytes reverses b in place, converting between little-endian and
+// big-endian integers. The whole buffer is reversed, which assumes it holds
+// exactly one fixed-width integer, as CryptSignHash's RSA signatures do.
+func reverseBytes(b []byte) {
+	for i := len(b)/2 - 1; i >= 0; i-- {
+		opp := len(b) - 1 - i
+		b[i], b[opp] = b[opp], b[i]
+	}
+}
+
+// supportsPSS checks whether the key's provider can produce RSA-PSS
+// signatures. CryptoAPI can't, so CryptoAPI keys are reacquired through CNG,
+// which can open keys held by most CSPs. If that fails, PSS isn't supported.
+// For CNG keys, the provider is probed by asking for the length of a PSS
+// signature, which providers lacking PSS reject without prompting for a PIN.
+func (wpk *winPrivateKey) supportsPSS() bool {
+	if _, isRSA := wpk.publicKey.(*rsa.PublicKey); !isRSA {
+		return false
+	}
+
+	// Hold the lock for the whole probe, so that concurrent signs wait for
+	// its result rather than probing (and acquiring a CNG key) again.
+	wpk.pssMu.Lock()
+	defer wpk.pssMu.Unlock()
+
+	if wpk.pssProbed {
+		return wpk.pssSupported
+	}
+
+	if wpk.capiProv != 0 {
+		wpk.pssProbed = true
+
+		if wpk.certCtx == nil {
+			return false
+		}
+
+		cngKey, err := acquireWinPrivateKey(wpk.certCtx, wpk.publicKey, wpk.opts, C.CRYPT_ACQUIRE_ONLY_NCRYPT_KEY_FLAG)
+		if err != nil {
+			return false
+		}
+
+		if !cngKey.supportsPSS() {
+			cngKey.Close()
+			return false
+		}
+
+		wpk.pssKey = cngKey
+		wpk.pssSupported = true
+
+		return true
+	}
+
+	if wpk.cngHandle == 0 {
+		return false
 	}
 
+	var (
+		digest    = make([]byte, crypto.SHA256.Size())
+		digestPtr = (*C.BYTE)(&digest[0])
+		digestLen = C.DWORD(len(digest))
+		sigLen    = C.DWORD(0)
+		padInfo   = C.BCRYPT_PSS_PADDING_INFO{
+			pszAlgId: BCRYPT_SHA256_ALGORITHM,
+			cbSalt:   C.ULONG(len(digest)),
+		}
+	)
+
+	status := C.NCryptSignHash(wpk.cngHandle, unsafe.Pointer(&padInfo), digestPtr, digestLen, nil, 0, &sigLen, C.BCRYPT_PAD_PSS)
+
+	wpk.pssSupported = checkStatus(status) == nil
+	wpk.pssProbed = true
+
+	return wpk.pssSupported
+}
+
+// cngSignHash signs a digest using the CNG APIs. ECDSA signatures are returned
+// as raw r||s values.
+func (wpk *winPrivateKey) cngSignHash(hash crypto.Hash, digest []byte, pssOpts *rsa.PSSOptions) ([]byte, error) {
 	var (
 		// input
 		padPtr    = unsafe.Pointer(nil)
 		digestPtr = (*C.BYTE)(&digest[0])
 		digestLen = C.DWORD(len(digest))
-		flags     = C.DWORD(0)
+		flags     = wpk.ncryptFlags()
 
 		// output
 		sigLen = C.DWORD(0)
 	)
 
-	// setup pkcs1v1.5 padding for RSA
-	if _, isRSA := wpk.publicKey.(*rsa.PublicKey); isRSA {
+	_, isRSA := wpk.publicKey.(*rsa.PublicKey)
+
+	// TLS 1.0 and 1.1 sign the MD5+SHA1 digest with PKCS#1 v1.5 padding but no
+	// DigestInfo, which CNG does when the padding has no algorithm.
+	if hash == crypto.MD5SHA1 {
+		if !isRSA || pssOpts != nil {
+			return nil, ErrUnsupportedHash
+		}
+
 		flags |= C.BCRYPT_PAD_PKCS1
-		padInfo := C.BCRYPT_PKCS1_PADDING_INFO{}
-		padPtr = unsafe.Pointer(&padInfo)
-
-		switch hash {
-		case crypto.SHA1:
-			padInfo.pszAlgId = BCRYPT_SHA1_ALGORITHM
-		case crypto.SHA256:
-			padInfo.pszAlgId = BCRYPT_SHA256_ALGORITHM
-		case crypto.SHA384:
-			padInfo.pszAlgId = BCRYPT_SHA384_ALGORITHM
-		case crypto.SHA512:
-			padInfo.pszAlgId = BCRYPT_SHA512_ALGORITHM
-		default:
+		padPtr = unsafe.Pointer(&C.BCRYPT_PKCS1_PADDING_INFO{})
+	} else if isRSA {
+		// setup pss or pkcs1v1.5 padding for RSA
+		algID, err := cngHashAlgorithm(hash)
+		if err != nil {
+			return nil, err
+		}
+
+		if pssOpts != nil {
+			flags |= C.BCRYPT_PAD_PSS
+			padPtr = unsafe.Pointer(&C.BCRYPT_PSS_PADDING_INFO{
+				pszAlgId: algID,
+				cbSalt:   C.ULONG(pssSaltLength(pssOpts, hash)),
+			})
+		} else {
+			flags |= C.BCRYPT_PAD_PKCS1
+			padPtr = unsafe.Pointer(&C.BCRYPT_PKCS1_PADDING_INFO{
+				pszAlgId: algID,
+			})
+		}
+	}
+
+	// get signature length
+	if sigLen = wpk.cachedSigLen(); sigLen == 0 {
+		if err := checkStatus(C.NCryptSignHash(wpk.cngHandle, padPtr, digestPtr, digestLen, nil, 0, &sigLen, flags)); err != nil {
+			return nil, errors.Wrap(err, "failed to get signature length")
+		}
+		wpk.cacheSigLen(sigLen)
+	}
+
+	// get signature
+	sig := make([]byte, sigLen)
+	sigPtr := (*C.BYTE)(&sig[0])
+	if err := checkStatus(C.NCryptSignHash(wpk.cngHandle, padPtr, digestPtr, digestLen, sigPtr, sigLen, &sigLen, flags)); err != nil {
+		logf(wpk.logger, "certstore: NCryptSignHash(%v, flags=0x%08X) failed: %v", hash, flags, err)
+		return nil, errors.Wrap(err, "failed to sign digest")
+	}
+	logf(wpk.logger, "certstore: NCryptSignHash(%v, flags=0x%08X) succeeded", hash, flags)
+
+	return sig[:sigLen], nil
+}
+
+// cngSignEd25519 signs a message with an Ed25519 key. Only recent versions of
+// Windows support Ed25519 in CNG, and only for some key storage providers, so
+// ErrUnsupportedOperation is returned if the provider rejects the key.
+func (wpk *winPrivateKey) cngSignEd25519(msg []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.Hash(0) {
+		return nil, errors.New("ed25519: cannot sign hashed message")
+	}
+
+	if wpk.cngHandle == 0 {
+		return nil, ErrUnsupportedOperation
+	}
+
+	var (
+		// input
+		msgPtr = (*C.BYTE)(nil)
+		msgLen = C.DWORD(len(msg))
+		flags  = wpk.ncryptFlags()
+
+		// output
+		sigLen = C.DWORD(0)
+	)
+
+	if len(msg) > 0 {
+		msgPtr = (*C.BYTE)(&msg[0])
+	}
+
+	// get signature length
+	if err := checkStatus(C.NCryptSignHash(wpk.cngHandle, nil, msgPtr, msgLen, nil, 0, &sigLen, flags)); err != nil {
+		// checkStatus maps NTE_BAD_ALGID to ErrUnsupportedHash.
+		if err == securityStatus(NTE_NOT_SUPPORTED) || err == ErrUnsupportedHash {
+			return nil, ErrUnsupportedOperation
+		}
+
+		return nil, errors.Wrap(err, "failed to get signature length")
+	}
+
+	// get signature
+	sig := make([]byte, sigLen)
+	sigPtr := (*C.BYTE)(&sig[0])
+	if err := checkStatus(C.NCryptSignHash(wpk.cngHandle, nil, msgPtr, msgLen, sigPtr, sigLen, &sigLen, flags)); err != nil {
+		return nil, errors.Wrap(err, "failed to sign message")
+	}
+
+	if sigLen != ed25519.SignatureSize {
+		return nil, errors.New("bad ed25519 signature from CNG")
+	}
+
+	return sig, nil
+}
+
+// cachedSigLen gets the cached signature length, or zero if the key hasn't
+// signed yet.
+func (wpk *winPrivateKey) cachedSigLen() C.DWORD {
+	wpk.sigLenMu.Lock()
+	defer wpk.sigLenMu.Unlock()
+
+	return wpk.sigLen
+}
+
+// cacheSigLen caches the signature length reported by the provider.
+func (wpk *winPrivateKey) cacheSigLen(sigLen C.DWORD) {
+	wpk.sigLenMu.Lock()
+	defer wpk.sigLenMu.Unlock()
+
+	wpk.sigLen = sigLen
+}
+
+// ncryptFlags gets the flags every NCrypt operation on the key should pass.
+func (wpk *winPrivateKey) ncryptFlags() C.DWORD {
+	if wpk.silent {
+		return C.NCRYPT_SILENT_FLAG
+	}
+
+	return 0
+}
+
+// cngHashAlgorithm gets the CNG algorithm identifier for a hash. CNG has no
+// SHA-224 implementation, so crypto.SHA224 is unsupported.
+func cngHashAlgorithm(hash crypto.Hash) (C.LPCWSTR, error) {
+	switch hash {
+	case crypto.SHA1:
+		return BCRYPT_SHA1_ALGORITHM, nil
+	case crypto.SHA256:
+		return BCRYPT_SHA256_ALGORITHM, nil
+	case crypto.SHA384:
+		return BCRYPT_SHA384_ALGORITHM, nil
+	case crypto.SHA512:
+		return BCRYPT_SHA512_ALGORITHM, nil
+	default:
+		return nil, ErrUnsupportedHash
+	}
+}
+
+// pssSaltLength gets the salt length to sign with. CNG doesn't have an
+// equivalent of rsa.PSSSaltLengthAuto, so both it and
+// rsa.PSSSaltLengthEqualsHash use the digest size, which is what TLS 1.3
+// requires.
+func pssSaltLength(opts *rsa.PSSOptions, hash crypto.Hash) int {
+	if opts.SaltLength == rsa.PSSSaltLengthAuto || opts.SaltLength == rsa.PSSSaltLengthEqualsHash {
+		return hash.Size()
+	}
+
+	return opts.SaltLength
+}
+
+// capiSignHash signs a digest using the CryptoAPI APIs. The signature is
+// returned little-endian, as CryptSignHash produces it. CryptSignHash always
+// fills the whole modulus length, so any leading zero bytes of the big-endian
+// signature are present as trailing zero bytes here.
+func (wpk *winPrivateKey) capiSignHash(hash crypto.Hash, digest []byte) ([]byte, error) {
+	// Figure out which CryptoAPI hash algorithm we're using.
+	var hash_alg C.ALG_ID
+
+	// CryptoAPI has no SHA-224 algorithm, so crypto.SHA224 is unsupported.
+	switch hash {
+	case crypto.SHA1:
+		hash_alg = C.CALG_SHA1
+	case crypto.MD5SHA1:
+		// The SSL3 MD5+SHA1 hash is signed without a DigestInfo, as TLS 1.0
+		// and 1.1 need.
+		hash_alg = C.CALG_SSL3_SHAMD5
+	case crypto.SHA256:
+		hash_alg = C.CALG_SHA_256
+	case crypto.SHA384:
+		hash_alg = C.CALG_SHA_384
+	case crypto.SHA512:
+		hash_alg = C.CALG_SHA_512
+	default:
+		return nil, ErrUnsupportedHash
+	}
+
+	// Instantiate a CryptoAPI hash object. CryptSignHash finalizes it, so it
+	// can't be reused for later signs.
+	var chash C.HCRYPTHASH
+
+	if ok := C.CryptCreateHash(C.HCRYPTPROV(wpk.capiProv), hash_alg, 0, 0, &chash); ok == winFalse {
+		if err := lastError("failed to create hash"); errors.Cause(err) == errCode(NTE_BAD_ALGID) {
 			return nil, ErrUnsupportedHash
+		} else {
+			return nil, err
+		}
+	}
+	defer C.CryptDestroyHash(chash)
+
+	// Make sure the hash size matches.
+	var (
+		hashSize    C.DWORD
+		hashSizePtr = (*C.BYTE)(unsafe.Pointer(&hashSize))
+		hashSizeLen = C.DWORD(unsafe.Sizeof(hashSize))
+	)
+
+	if ok := C.CryptGetHashParam(chash, C.HP_HASHSIZE, hashSizePtr, &hashSizeLen, 0); ok == winFalse {
+		return nil, lastError("failed to get hash size")
+	}
+
+	if hash.Size() != int(hashSize) {
+		return nil, errors.New("invalid CryptoAPI hash")
+	}
+
+	// Put our digest into the hash object.
+	digestPtr := (*C.BYTE)(unsafe.Pointer(&digest[0]))
+	if ok := C.CryptSetHashParam(chash, C.HP_HASHVAL, digestPtr, 0); ok == winFalse {
+		return nil, lastError("failed to set hash digest")
+	}
+
+	// Get signature length.
+	sigLen := wpk.cachedSigLen()
+
+	if sigLen == 0 {
+		if ok := C.CryptSignHash(chash, wpk.keySpec, nil, 0, nil, &sigLen); ok == winFalse {
+			return nil, lastError("failed to get signature length")
 		}
+		wpk.cacheSigLen(sigLen)
+	}
+
+	// Get signature
+	var (
+		sig    = make([]byte, int(sigLen))
+		sigPtr = (*C.BYTE)(unsafe.Pointer(&sig[0]))
+	)
+
+	if ok := C.CryptSignHash(chash, wpk.keySpec, nil, 0, sigPtr, &sigLen); ok == winFalse {
+		err := lastError("failed to sign digest")
+		logf(wpk.logger, "certstore: CryptSignHash(alg=0x%X, key spec 0x%X) failed: %v", hash_alg, wpk.keySpec, err)
+		return nil, err
+	}
+	logf(wpk.logger, "certstore: CryptSignHash(alg=0x%X, key spec 0x%X) succeeded", hash_alg, wpk.keySpec)
+
+	return sig[:sigLen], nil
+}
+
+// Decrypt implements the crypto.Decrypter interface for RSA keys. opts may be
+// nil or *rsa.PKCS1v15DecryptOptions for PKCS#1 v1.5 padding, or
+// *rsa.OAEPOptions for OAEP. PKCS1v15DecryptOptions.SessionKeyLen isn't
+// honored, so padding errors are returned rather than a random key. CryptoAPI
+// keys only support OAEP with SHA-1 and no label.
+func (wpk *winPrivateKey) Decrypt(rand io.Reader, msg []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	if wpk.closed {
+		return nil, ErrClosed
+	}
+
+	if _, isRSA := wpk.publicKey.(*rsa.PublicKey); !isRSA {
+		return nil, ErrUnsupportedOperation
+	}
+
+	if len(msg) == 0 {
+		return nil, errors.New("empty ciphertext")
+	}
+
+	var oaepOpts *rsa.OAEPOptions
+
+	switch o := opts.(type) {
+	case nil, *rsa.PKCS1v15DecryptOptions:
+	case *rsa.OAEPOptions:
+		oaepOpts = o
+	default:
+		return nil, errors.New("unsupported decrypter options")
+	}
+
+	if wpk.cngHandle != 0 {
+		return wpk.cngDecrypt(msg, oaepOpts)
+	}
+
+	return wpk.capiDecrypt(msg, oaepOpts)
+}
+
+// SignRaw implements the RawSigner interface.
+func (wpk *winPrivateKey) SignRaw(data []byte, flags SignFlags) (_ []byte, err error) {
+	defer trace("certstore.Sign")(&err)
+
+	if wpk.closed {
+		return nil, ErrClosed
+	}
+
+	if _, isRSA := wpk.publicKey.(*rsa.PublicKey); !isRSA || wpk.cngHandle == 0 {
+		return nil, ErrUnsupportedOperation
+	}
+
+	if len(data) == 0 {
+		return nil, errors.New("empty data")
 	}
 
-	// get signature length
-	if err := checkStatus(C.NCryptSignHash(wpk.cngHandle, padPtr, digestPtr, digestLen, nil, 0, &sigLen, flags)); err != nil {
+	switch flags {
+	case SignRawPKCS1:
+		return wpk.cngSignRawPKCS1(data)
+	case SignRawNoPadding:
+		return wpk.cngPrivateOp(data)
+	default:
+		return nil, fmt.Errorf("unknown sign flags: %d", flags)
+	}
+}
+
+// cngSignRawPKCS1 signs data with PKCS#1 v1.5 padding but no DigestInfo, which
+// CNG does when the padding info has no algorithm.
+func (wpk *winPrivateKey) cngSignRawPKCS1(data []byte) ([]byte, error) {
+	var (
+		padPtr  = unsafe.Pointer(&C.BCRYPT_PKCS1_PADDING_INFO{})
+		dataPtr = (*C.BYTE)(&data[0])
+		dataLen = C.DWORD(len(data))
+		flags   = C.DWORD(C.BCRYPT_PAD_PKCS1) | wpk.ncryptFlags()
+		sigLen  = C.DWORD(0)
+	)
+
+	if err := checkStatus(C.NCryptSignHash(wpk.cngHandle, padPtr, dataPtr, dataLen, nil, 0, &sigLen, flags)); err != nil {
 		return nil, errors.Wrap(err, "failed to get signature length")
 	}
 
-	// get signature
 	sig := make([]byte, sigLen)
 	sigPtr := (*C.BYTE)(&sig[0])
-	if err := checkStatus(C.NCryptSignHash(wpk.cngHandle, padPtr, digestPtr, digestLen, sigPtr, sigLen, &sigLen, flags)); err != nil {
-		return nil, errors.Wrap(err, "failed to sign digest")
+	if err := checkStatus(C.NCryptSignHash(wpk.cngHandle, padPtr, dataPtr, dataLen, sigPtr, sigLen, &sigLen, flags)); err != nil {
+		return nil, errors.Wrap(err, "failed to sign data")
 	}
 
-	// CNG returns a raw ECDSA signature, but we wan't ASN.1 DER encoding.
-	if _, isEC := wpk.publicKey.(*ecdsa.PublicKey); isEC {
-		if len(sig)%2 != 0 {
-			return nil, errors.New("bad ecdsa signature from CNG")
-		}
+	return sig[:sigLen], nil
+}
 
-		type ecdsaSignature struct {
-			R, S *big.Int
-		}
+// cngPrivateOp applies the raw RSA private key operation to data. CNG only
+// exposes this as a decryption without padding.
+func (wpk *winPrivateKey) cngPrivateOp(data []byte) ([]byte, error) {
+	if size := (wpk.publicKey.(*rsa.PublicKey).N.BitLen() + 7) / 8; len(data) != size {
+		return nil, fmt.Errorf("data must be %d bytes, the size of the modulus", size)
+	}
 
-		r := new(big.Int).SetBytes(sig[:len(sig)/2])
-		s := new(big.Int).SetBytes(sig[len(sig)/2:])
+	var (
+		dataPtr = (*C.BYTE)(&data[0])
+		dataLen = C.DWORD(len(data))
+		flags   = C.DWORD(C.NCRYPT_NO_PADDING_FLAG) | wpk.ncryptFlags()
+		outLen  = C.DWORD(0)
+	)
 
-		encoded, err := asn1.Marshal(ecdsaSignature{r, s})
-		if err != nil {
-			return nil, errors.Wrap(err, "failed to ASN.1 encode EC signature")
-		}
+	if err := checkStatus(C.NCryptDecrypt(wpk.cngHandle, dataPtr, dataLen, nil, nil, 0, &outLen, flags)); err != nil {
+		return nil, errors.Wrap(err, "failed to get signature length")
+	}
 
-		return encoded, nil
+	out := make([]byte, outLen)
+	outPtr := (*C.BYTE)(&out[0])
+	if err := checkStatus(C.NCryptDecrypt(wpk.cngHandle, dataPtr, dataLen, nil, outPtr, outLen, &outLen, flags)); err != nil {
+		return nil, errors.Wrap(err, "failed to sign data")
 	}
 
-	return sig, nil
+	return out[:outLen], nil
 }
 
-// capiSignHash signs a digest using the CryptoAPI APIs.
-func (wpk *winPrivateKey) capiSignHash(hash crypto.Hash, digest []byte) ([]byte, error) {
-	if len(digest) != hash.Size() {
-		return nil, errors.New("bad digest for hash")
-	}
+// cngDecrypt decrypts msg using the CNG APIs, with OAEP padding if oaepOpts is
+// set and PKCS#1 v1.5 padding otherwise.
+func (wpk *winPrivateKey) cngDecrypt(msg []byte, oaepOpts *rsa.OAEPOptions) ([]byte, error) {
+	var (
+		// input
+		padPtr = unsafe.Pointer(nil)
+		msgPtr = (*C.BYTE)(&msg[0])
+		msgLen = C.DWORD(len(msg))
+		flags  = C.DWORD(C.NCRYPT_PAD_PKCS1_FLAG) | wpk.ncryptFlags()
 
-	// Figure out which CryptoAPI hash algorithm we're using.
-	var hash_alg C.ALG_ID
+		// output
+		outLen = C.DWORD(0)
+	)
 
-	switch hash {
-	case crypto.SHA1:
-		hash_alg = C.CALG_SHA1
-	case crypto.SHA256:
-		hash_alg = C.CALG_SHA_256
-	case crypto.SHA384:
-		hash_alg = C.CALG_SHA_384
-	case crypto.SHA512:
-		hash_alg = C.CALG_SHA_512
-	default:
-		return nil, ErrUnsupportedHash
-	}
+	if oaepOpts != nil {
+		algID, err := cngHashAlgorithm(oaepOpts.Hash)
+		if err != nil {
+			return nil, err
+		}
 
-	// Instantiate a CryptoAPI hash object.
-	var chash C.HCRYPTHASH
+		info := &C.BCRYPT_OAEP_PADDING_INFO{pszAlgId: algID}
 
-	if ok := C.CryptCreateHash(C.HCRYPTPROV(wpk.capiProv), hash_alg, 0, 0, &chash); ok == winFalse {
-		if err := lastError("failed to create hash"); errors.Cause(err) == errCode(NTE_BAD_ALGID) {
-			return nil, ErrUnsupportedHash
-		} else {
-			return nil, err
+		// The padding info is passed to C, so the label must be in C memory.
+		if len(oaepOpts.Label) > 0 {
+			label := C.CBytes(oaepOpts.Label)
+			defer C.free(label)
+
+			info.pbLabel = (*C.UCHAR)(label)
+			info.cbLabel = C.ULONG(len(oaepOpts.Label))
 		}
-	}
-	defer C.CryptDestroyHash(chash)
 
-	// Make sure the hash size matches.
-	var (
-		hashSize    C.DWORD
-		hashSizePtr = (*C.BYTE)(unsafe.Pointer(&hashSize))
-		hashSizeLen = C.DWORD(unsafe.Sizeof(hashSize))
-	)
+		padPtr = unsafe.Pointer(info)
+		flags = C.NCRYPT_PAD_OAEP_FLAG | wpk.ncryptFlags()
+	}
 
-	if ok := C.CryptGetHashParam(chash, C.HP_HASHSIZE, hashSizePtr, &hashSizeLen, 0); ok == winFalse {
-		return nil, lastError("failed to get hash size")
+	// get plaintext length
+	if err := checkStatus(C.NCryptDecrypt(wpk.cngHandle, msgPtr, msgLen, padPtr, nil, 0, &outLen, flags)); err != nil {
+		return nil, errors.Wrap(err, "failed to get plaintext length")
 	}
 
-	if hash.Size() != int(hashSize) {
-		return nil, errors.New("invalid CryptoAPI hash")
+	if outLen == 0 {
+		return []byte{}, nil
 	}
 
-	// Put our digest into the hash object.
-	digestPtr := (*C.BYTE)(unsafe.Pointer(&digest[0]))
-	if ok := C.CryptSetHashParam(chash, C.HP_HASHVAL, digestPtr, 0); ok == winFalse {
-		return nil, lastError("failed to set hash digest")
+	// decrypt
+	out := make([]byte, outLen)
+	outPtr := (*C.BYTE)(&out[0])
+	if err := checkStatus(C.NCryptDecrypt(wpk.cngHandle, msgPtr, msgLen, padPtr, outPtr, outLen, &outLen, flags)); err != nil {
+		return nil, errors.Wrap(err, "failed to decrypt")
 	}
 
-	// Get signature length.
-	var sigLen C.DWORD
+	return out[:outLen], nil
+}
 
-	if ok := C.CryptSignHash(chash, wpk.keySpec, nil, 0, nil, &sigLen); ok == winFalse {
-		return nil, lastError("failed to get signature length")
+// capiDecrypt decrypts msg using the CryptoAPI APIs, with OAEP padding if
+// oaepOpts is set and PKCS#1 v1.5 padding otherwise.
+func (wpk *winPrivateKey) capiDecrypt(msg []byte, oaepOpts *rsa.OAEPOptions) ([]byte, error) {
+	flags := C.DWORD(0)
+
+	if oaepOpts != nil {
+		if oaepOpts.Hash != crypto.SHA1 || len(oaepOpts.Label) > 0 {
+			return nil, errors.New("CryptoAPI keys only support OAEP with SHA-1 and no label")
+		}
+
+		flags |= C.CRYPT_OAEP
 	}
 
-	// Get signature
-	var (
-		sig    = make([]byte, int(sigLen))
-		sigPtr = (*C.BYTE)(unsafe.Pointer(&sig[0]))
-	)
+	var key C.HCRYPTKEY
+	if ok := C.CryptGetUserKey(C.HCRYPTPROV(wpk.capiProv), wpk.keySpec, &key); ok == winFalse {
+		return nil, lastError("failed to get key")
+	}
+	defer C.CryptDestroyKey(key)
 
-	if ok := C.CryptSignHash(chash, wpk.keySpec, nil, 0, sigPtr, &sigLen); ok == winFalse {
-		return nil, lastError("failed to sign digest")
+	// CryptoAPI expects little endian ciphertext, and decrypts in place.
+	buf := make([]byte, len(msg))
+	for i := range msg {
+		buf[i] = msg[len(msg)-1-i]
 	}
 
-	// Signature is little endian, but we want big endian. Reverse it.
-	for i := len(sig)/2 - 1; i >= 0; i-- {
-		opp := len(sig) - 1 - i
-		sig[i], sig[opp] = sig[opp], sig[i]
+	bufLen := C.DWORD(len(buf))
+	if ok := C.CryptDecrypt(key, 0, winTrue, flags, (*C.BYTE)(&buf[0]), &bufLen); ok == winFalse {
+		return nil, lastError("failed to decrypt")
 	}
 
-	return sig, nil
+	return buf[:bufLen], nil
 }
 
 func (wpk *winPrivateKey) Delete() error {
+	if wpk.closed {
+		return ErrClosed
+	}
+
 	if wpk.cngHandle != 0 {
 		// Delete CNG key
 		if err := checkStatus(C.NCryptDeleteKey(wpk.cngHandle, 0)); err != nil {
@@ -541,18 +2437,21 @@ func (wpk *winPrivateKey) Delete() error {
 		if param, err = wpk.getProviderParam(C.PP_CONTAINER); err != nil {
 			return errors.Wrap(err, "failed to get PP_CONTAINER")
 		} else {
+			defer C.free(param)
 			containerName = C.LPCTSTR(param)
 		}
 
 		if param, err = wpk.getProviderParam(C.PP_NAME); err != nil {
 			return errors.Wrap(err, "failed to get PP_NAME")
 		} else {
+			defer C.free(param)
 			providerName = C.LPCTSTR(param)
 		}
 
 		if param, err = wpk.getProviderParam(C.PP_PROVTYPE); err != nil {
 			return errors.Wrap(err, "failed to get PP_PROVTYPE")
 		} else {
+			defer C.free(param)
 			providerType = (*C.DWORD)(param)
 		}
 
@@ -568,7 +2467,330 @@ func (wpk *winPrivateKey) Delete() error {
 	return nil
 }
 
-// getProviderParam gets a parameter about a provider.
+// CanPerform implements the KeyOpChecker interface. For CNG keys, the key's
+// NCRYPT_KEY_USAGE_PROPERTY is checked. For CryptoAPI keys, the key spec
+// determines what is allowed: AT_SIGNATURE keys can only sign, while
+// AT_KEYEXCHANGE keys can sign and decrypt.
+func (wpk *winPrivateKey) CanPerform(op KeyOp) (bool, error) {
+	if wpk.closed {
+		return false, ErrClosed
+	}
+
+	var usage uint32
+
+	if wpk.cngHandle != 0 {
+		prop, err := wpk.getProperty(NCRYPT_KEY_USAGE_PROPERTY)
+		if err != nil {
+			return false, errors.Wrap(err, "failed to get NCRYPT_KEY_USAGE_PROPERTY")
+		}
+		if len(prop) < 4 {
+			return false, errors.New("malformed NCRYPT_KEY_USAGE_PROPERTY")
+		}
+
+		usage = binary.LittleEndian.Uint32(prop)
+	} else if wpk.capiProv != 0 {
+		usage = C.NCRYPT_ALLOW_SIGNING_FLAG
+		if wpk.keySpec == C.AT_KEYEXCHANGE {
+			usage |= C.NCRYPT_ALLOW_DECRYPT_FLAG
+		}
+	} else {
+		return false, errors.New("bad private key")
+	}
+
+	switch op {
+	case KeyOpSign:
+		return usage&C.NCRYPT_ALLOW_SIGNING_FLAG != 0, nil
+	case KeyOpDecrypt:
+		return usage&C.NCRYPT_ALLOW_DECRYPT_FLAG != 0, nil
+	case KeyOpKeyAgreement:
+		return usage&C.NCRYPT_ALLOW_KEY_AGREEMENT_FLAG != 0, nil
+	default:
+		return false, ErrUnsupportedOperation
+	}
+}
+
+// restrictCapabilities narrows caps to the operations the key allows. As well
+// as the usage checked by CanPerform, a CNG key's algorithm group decides
+// whether an EC key signs (ECDSA) or does key agreement (ECDH).
+func (wpk *winPrivateKey) restrictCapabilities(caps KeyCapabilities) (KeyCapabilities, error) {
+	if wpk.cngHandle != 0 {
+		prop, err := wpk.getProperty(NCRYPT_ALGORITHM_GROUP_PROPERTY)
+		if err != nil {
+			return KeyCapabilities{}, errors.Wrap(err, "failed to get NCRYPT_ALGORITHM_GROUP_PROPERTY")
+		}
+
+		switch utf16BytesToString(prop) {
+		case "ECDSA":
+			caps.KeyAgreement = false
+		case "ECDH":
+			caps.Sign = false
+		}
+	}
+
+	for _, check := range []struct {
+		op      KeyOp
+		capable *bool
+	}{
+		{KeyOpSign, &caps.Sign},
+		{KeyOpDecrypt, &caps.Decrypt},
+		{KeyOpKeyAgreement, &caps.KeyAgreement},
+	} {
+		if !*check.capable {
+			continue
+		}
+
+		ok, err := wpk.CanPerform(check.op)
+		if err != nil {
+			return KeyCapabilities{}, err
+		}
+		*check.capable = ok
+	}
+
+	return caps, nil
+}
+
+// ExportWrapped implements the WrappedKeyExporter interface. The key is
+// exported as a PKCS#7 envelope (NCRYPT_PKCS7_ENVELOPE_BLOB), with the content
+// encrypted using AES-256-CBC and the content encryption key wrapped to the
+// given RSA public key. Only exportable CNG keys are supported.
+func (wpk *winPrivateKey) ExportWrapped(wrappingKey crypto.PublicKey) ([]byte, error) {
+	if wpk.closed {
+		return nil, ErrClosed
+	}
+
+	if wpk.cngHandle == 0 {
+		return nil, ErrUnsupportedOperation
+	}
+
+	rsaPub, ok := wrappingKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("wrapping key must be an RSA public key")
+	}
+
+	// Fail early with a clear error if the key can't be exported.
+	policy, err := wpk.getProperty(NCRYPT_EXPORT_POLICY_PROPERTY)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get NCRYPT_EXPORT_POLICY_PROPERTY")
+	}
+	if len(policy) < 4 || binary.LittleEndian.Uint32(policy)&C.NCRYPT_ALLOW_EXPORT_FLAG == 0 {
+		return nil, ErrNotExportable
+	}
+
+	// The wrapping key has to be imported into the same provider as our key.
+	prov, err := wpk.providerHandle()
+	if err != nil {
+		return nil, err
+	}
+	defer C.NCryptFreeObject(C.NCRYPT_HANDLE(prov))
+
+	blob := rsaPublicKeyBlob(rsaPub)
+	blobPtr := (*C.BYTE)(unsafe.Pointer(&blob[0]))
+
+	var wrapKey C.NCRYPT_KEY_HANDLE
+	if err := checkStatus(C.NCryptImportKey(prov, 0, BCRYPT_RSAPUBLIC_BLOB, nil, &wrapKey, blobPtr, C.DWORD(len(blob)), 0)); err != nil {
+		return nil, errors.Wrap(err, "failed to import wrapping key")
+	}
+	defer C.NCryptFreeObject(C.NCRYPT_HANDLE(wrapKey))
+
+	algOID := C.CString(szOID_NIST_AES256_CBC)
+	defer C.free(unsafe.Pointer(algOID))
+
+	// get export length
+	var size C.DWORD
+	if err := checkStatus(C.exportPKCS7Envelope(wpk.cngHandle, wrapKey, algOID, nil, 0, &size)); err != nil {
+		return nil, errors.Wrap(err, "failed to get wrapped key length")
+	}
+
+	// export key
+	out := make([]byte, size)
+	outPtr := (*C.BYTE)(unsafe.Pointer(&out[0]))
+	if err := checkStatus(C.exportPKCS7Envelope(wpk.cngHandle, wrapKey, algOID, outPtr, size, &size)); err != nil {
+		return nil, errors.Wrap(err, "failed to export wrapped key")
+	}
+
+	return out[:size], nil
+}
+
+// rsaPublicKeyBlob encodes an RSA public key as a BCRYPT_RSAPUBLIC_BLOB.
+func rsaPublicKeyBlob(pub *rsa.PublicKey) []byte {
+	var (
+		exp = big.NewInt(int64(pub.E)).Bytes()
+		mod = pub.N.Bytes()
+
+		// BCRYPT_RSAKEY_BLOB header is six ULONGs.
+		blob = make([]byte, 24, 24+len(exp)+len(mod))
+	)
+
+	binary.LittleEndian.PutUint32(blob[0:], C.BCRYPT_RSAPUBLIC_MAGIC)
+	binary.LittleEndian.PutUint32(blob[4:], uint32(pub.N.BitLen()))
+	binary.LittleEndian.PutUint32(blob[8:], uint32(len(exp)))
+	binary.LittleEndian.PutUint32(blob[12:], uint32(len(mod)))
+
+	blob = append(blob, exp...)
+	blob = append(blob, mod...)
+
+	return blob
+}
+
+// setPINCache applies the PIN cache mode to a CNG key. Providers that don't
+// support the PIN cache reject the property, in which case their default
+// behavior is kept.
+func (wpk *winPrivateKey) setPINCache(mode PINCacheMode) {
+	var flags C.DWORD
+
+	switch mode {
+	case PINCacheEnabled:
+		flags = 0
+	case PINCacheDisabled:
+		flags = NCRYPT_PIN_CACHE_DISABLE_DPL_FLAG
+	default:
+		return
+	}
+
+	flagsPtr := (*C.BYTE)(unsafe.Pointer(&flags))
+	flagsLen := C.DWORD(unsafe.Sizeof(flags))
+
+	// Ignore errors, since most providers don't support this property.
+	C.NCryptSetProperty(C.NCRYPT_HANDLE(wpk.cngHandle), NCRYPT_PIN_CACHE_FLAGS_PROPERTY, flagsPtr, flagsLen, 0)
+}
+
+// checkKeyInfo checks that the CNG key's algorithm group and length match
+// those of the certificate's public key.
+func (wpk *winPrivateKey) checkKeyInfo(info KeyInfo) error {
+	var group string
+	switch info.Algorithm {
+	case x509.RSA:
+		group = "RSA"
+	case x509.ECDSA:
+		group = "ECDSA"
+	default:
+		return nil
+	}
+
+	prop, err := wpk.getProperty(NCRYPT_ALGORITHM_GROUP_PROPERTY)
+	if err != nil {
+		return errors.Wrap(err, "failed to get NCRYPT_ALGORITHM_GROUP_PROPERTY")
+	}
+	if keyGroup := utf16BytesToString(prop); keyGroup != group {
+		return fmt.Errorf("key algorithm group %q doesn't match certificate's %s key", keyGroup, info.Algorithm)
+	}
+
+	if prop, err = wpk.getProperty(NCRYPT_LENGTH_PROPERTY); err != nil {
+		return errors.Wrap(err, "failed to get NCRYPT_LENGTH_PROPERTY")
+	}
+	if len(prop) < 4 {
+		return errors.New("malformed NCRYPT_LENGTH_PROPERTY")
+	}
+	if bits := int(binary.LittleEndian.Uint32(prop)); bits != info.Bits {
+		return fmt.Errorf("key length %d doesn't match certificate's %d bit key", bits, info.Bits)
+	}
+
+	return nil
+}
+
+// providerHandle gets a handle for the provider holding a CNG key. The caller
+// must free it with NCryptFreeObject.
+func (wpk *winPrivateKey) providerHandle() (C.NCRYPT_PROV_HANDLE, error) {
+	provProp, err := wpk.getProperty(NCRYPT_PROVIDER_HANDLE_PROPERTY)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to get NCRYPT_PROVIDER_HANDLE_PROPERTY")
+	}
+
+	var prov C.NCRYPT_PROV_HANDLE
+	if len(provProp) != int(unsafe.Sizeof(prov)) {
+		return 0, errors.New("bad provider handle")
+	}
+
+	return *(*C.NCRYPT_PROV_HANDLE)(unsafe.Pointer(&provProp[0])), nil
+}
+
+// providerInfo gets information about the provider and container holding the
+// key from the key's handle. For CNG keys, this reads NCRYPT_NAME_PROPERTY from
+// the key and its provider. For CryptoAPI keys, it reads the PP_CONTAINER,
+// PP_NAME and PP_PROVTYPE provider parameters, as Delete does.
+func (wpk *winPrivateKey) providerInfo() (ProviderInfo, error) {
+	if wpk.closed {
+		return ProviderInfo{}, ErrClosed
+	}
+
+	if wpk.cngHandle != 0 {
+		container, err := wpk.getProperty(NCRYPT_NAME_PROPERTY)
+		if err != nil {
+			return ProviderInfo{}, errors.Wrap(err, "failed to get NCRYPT_NAME_PROPERTY")
+		}
+
+		prov, err := wpk.providerHandle()
+		if err != nil {
+			return ProviderInfo{}, err
+		}
+		defer C.NCryptFreeObject(C.NCRYPT_HANDLE(prov))
+
+		provider, err := ncryptProperty(C.NCRYPT_HANDLE(prov), NCRYPT_NAME_PROPERTY)
+		if err != nil {
+			return ProviderInfo{}, errors.Wrap(err, "failed to get provider NCRYPT_NAME_PROPERTY")
+		}
+
+		return ProviderInfo{
+			Provider:  utf16BytesToString(provider),
+			Container: utf16BytesToString(container),
+			KeySpec:   C.CERT_NCRYPT_KEY_SPEC,
+		}, nil
+	} else if wpk.capiProv != 0 {
+		var info ProviderInfo
+
+		param, err := wpk.getProviderParam(C.PP_CONTAINER)
+		if err != nil {
+			return ProviderInfo{}, errors.Wrap(err, "failed to get PP_CONTAINER")
+		}
+		defer C.free(param)
+		info.Container = C.GoString((*C.char)(param))
+
+		if param, err = wpk.getProviderParam(C.PP_NAME); err != nil {
+			return ProviderInfo{}, errors.Wrap(err, "failed to get PP_NAME")
+		}
+		defer C.free(param)
+		info.Provider = C.GoString((*C.char)(param))
+
+		if param, err = wpk.getProviderParam(C.PP_PROVTYPE); err != nil {
+			return ProviderInfo{}, errors.Wrap(err, "failed to get PP_PROVTYPE")
+		}
+		defer C.free(param)
+		info.ProviderType = uint32(*(*C.DWORD)(param))
+		info.KeySpec = uint32(wpk.keySpec)
+
+		return info, nil
+	}
+
+	return ProviderInfo{}, errors.New("bad private key")
+}
+
+// getProperty gets a property of a CNG key.
+func (wpk *winPrivateKey) getProperty(name C.LPCWSTR) ([]byte, error) {
+	return ncryptProperty(C.NCRYPT_HANDLE(wpk.cngHandle), name)
+}
+
+// ncryptProperty gets a property of a CNG object.
+func ncryptProperty(handle C.NCRYPT_HANDLE, name C.LPCWSTR) ([]byte, error) {
+	var size C.DWORD
+	if err := checkStatus(C.NCryptGetProperty(handle, name, nil, 0, &size, 0)); err != nil {
+		return nil, errors.Wrap(err, "failed to get property size")
+	}
+
+	if size == 0 {
+		return []byte{}, nil
+	}
+
+	data := make([]byte, size)
+	dataPtr := (*C.BYTE)(unsafe.Pointer(&data[0]))
+	if err := checkStatus(C.NCryptGetProperty(handle, name, dataPtr, size, &size, 0)); err != nil {
+		return nil, errors.Wrap(err, "failed to get property")
+	}
+
+	return data[:size], nil
+}
+
+// getProviderParam gets a parameter about a provider. The caller must C.free
+// the returned pointer.
 func (wpk *winPrivateKey) getProviderParam(param C.DWORD) (unsafe.Pointer, error) {
 	var dataLen C.DWORD
 	if ok := C.CryptGetProvParam(wpk.capiProv, param, nil, &dataLen, 0); ok == winFalse {
@@ -581,12 +2803,20 @@ func (wpk *winPrivateKey) getProviderParam(param C.DWORD) (unsafe.Pointer, error
 		return nil, lastError("failed to get provider parameter")
 	}
 
-	// TODO leaking memory here
 	return C.CBytes(data), nil
 }
 
 // Close closes this winPrivateKey.
 func (wpk *winPrivateKey) Close() {
+	wpk.closed = true
+
+	wpk.pssMu.Lock()
+	if wpk.pssKey != nil {
+		wpk.pssKey.Close()
+		wpk.pssKey = nil
+	}
+	wpk.pssMu.Unlock()
+
 	if wpk.cngHandle != 0 {
 		C.NCryptFreeObject(C.NCRYPT_HANDLE(wpk.cngHandle))
 		wpk.cngHandle = 0
@@ -610,6 +2840,18 @@ func exportCertCtx(ctx C.PCCERT_CONTEXT) (*x509.Certificate, error) {
 	return cert, nil
 }
 
+// processPrivateBytes gets the memory committed privately by the process,
+// which includes native allocations made by CryptoAPI and CNG. Tests use it to
+// check for leaks that Go's memory statistics can't see.
+func processPrivateBytes() (uint64, error) {
+	n := C.privateBytes()
+	if n == 0 {
+		return 0, lastError("failed to get process memory info")
+	}
+
+	return uint64(n), nil
+}
+
 type errCode uint64
 
 // lastError gets the last error from the current thread. If there isn't one, it
@@ -632,6 +2874,57 @@ func checkError(msg string) error {
 	return nil
 }
 
+// winErrors maps common CryptoAPI, CNG and smart card error codes to the
+// package's sentinel errors, so that callers can use errors.Is rather than
+// checking codes.
+var winErrors = map[uint64]error{
+	CRYPT_E_NOT_FOUND:             ErrNotFound,
+	NTE_NOT_FOUND:                 ErrNotFound,
+	CRYPT_E_NO_KEY_PROPERTY:       ErrNoPrivateKey,
+	NTE_BAD_KEYSET:                ErrNoPrivateKey,
+	NTE_NO_KEY:                    ErrNoPrivateKey,
+	NTE_PERM:                      ErrPermissionDenied,
+	NTE_SILENT_CONTEXT:            ErrSilentPINRequired,
+	NTE_NOT_SUPPORTED:             ErrUnsupportedOperation,
+	NTE_BAD_ALGID:                 ErrUnsupportedHash,
+	NTE_TOKEN_KEYSET_STORAGE_FULL: ErrSmartCardFull,
+	SCARD_E_WRITE_TOO_MANY:        ErrSmartCardFull,
+	SCARD_E_NO_SMARTCARD:          ErrNoSmartCard,
+	SCARD_W_REMOVED_CARD:          ErrNoSmartCard,
+	SCARD_W_WRONG_CHV:             ErrIncorrectPIN,
+	SCARD_W_CHV_BLOCKED:           ErrIncorrectPIN,
+	SCARD_W_CANCELLED_BY_USER:     ErrPINCancelled,
+	HRESULT_ERROR_CANCELLED:       ErrPINCancelled,
+}
+
+// transientCardErrors are the smart card error codes that may clear up if the
+// operation is retried, e.g. after the card was reset or briefly lost contact.
+var transientCardErrors = map[uint64]bool{
+	SCARD_W_RESET_CARD:         true,
+	SCARD_W_REMOVED_CARD:       true,
+	SCARD_E_NO_SMARTCARD:       true,
+	SCARD_E_READER_UNAVAILABLE: true,
+}
+
+// isTransientCardError checks whether err is caused by one of the
+// transientCardErrors.
+func isTransientCardError(err error) bool {
+	switch cause := errors.Cause(err).(type) {
+	case errCode:
+		return transientCardErrors[uint64(cause)]
+	case securityStatus:
+		return transientCardErrors[uint64(cause)]
+	default:
+		return false
+	}
+}
+
+// Is lets errors.Is match error codes against the sentinels in winErrors.
+func (c errCode) Is(target error) bool {
+	sentinel, ok := winErrors[uint64(c)]
+	return ok && sentinel == target
+}
+
 func (c errCode) Error() string {
 	cmsg := C.errMsg(C.DWORD(c))
 	if cmsg == nil {
@@ -647,7 +2940,9 @@ func (c errCode) Error() string {
 type securityStatus uint64
 
 func checkStatus(s C.SECURITY_STATUS) error {
-	ss := securityStatus(s)
+	// SECURITY_STATUS is signed. Convert through uint32 so codes like
+	// NTE_BAD_ALGID aren't sign extended.
+	ss := securityStatus(uint32(s))
 
 	if ss == ERROR_SUCCESS {
 		return nil
@@ -660,8 +2955,41 @@ func checkStatus(s C.SECURITY_STATUS) error {
 	return ss
 }
 
+// Is lets errors.Is match statuses against the sentinels in winErrors.
+func (ss securityStatus) Is(target error) bool {
+	sentinel, ok := winErrors[uint64(ss)]
+	return ok && sentinel == target
+}
+
+// statusMessages describes the NCrypt statuses we most commonly see, for when
+// the system has no message for them.
+var statusMessages = map[securityStatus]string{
+	NTE_BAD_ALGID:                 "invalid algorithm specified",
+	NTE_BAD_KEYSET:                "keyset does not exist",
+	NTE_NO_KEY:                    "key does not exist",
+	NTE_PERM:                      "access denied",
+	NTE_SILENT_CONTEXT:            "provider could not perform the action since the context was acquired as silent",
+	NTE_NOT_FOUND:                 "object was not found",
+	NTE_NOT_SUPPORTED:             "the requested operation is not supported",
+	NTE_TOKEN_KEYSET_STORAGE_FULL: "the security token does not have storage space available for an additional container",
+	SCARD_W_WRONG_CHV:             "the card cannot be accessed because the wrong PIN was presented",
+	SCARD_W_CHV_BLOCKED:           "the card cannot be accessed because the maximum number of PIN entry attempts has been reached",
+	SCARD_W_CANCELLED_BY_USER:     "the action was cancelled by the user",
+	SCARD_E_NO_SMARTCARD:          "the operation requires a smart card, but no smart card is currently in the device",
+}
+
 func (ss securityStatus) Error() string {
-	return fmt.Sprintf("SECURITY_STATUS %d", int(ss))
+	// NCrypt statuses are HRESULTs, so the system can usually describe them.
+	if cmsg := C.errMsg(C.DWORD(ss)); cmsg != nil {
+		defer C.LocalFree(C.HLOCAL(cmsg))
+		return fmt.Sprintf("SECURITY_STATUS 0x%08X: %s", uint32(ss), strings.TrimSpace(C.GoString(cmsg)))
+	}
+
+	if msg, ok := statusMessages[ss]; ok {
+		return fmt.Sprintf("SECURITY_STATUS 0x%08X: %s", uint32(ss), msg)
+	}
+
+	return fmt.Sprintf("SECURITY_STATUS 0x%08X", uint32(ss))
 }
 
 func stringToUTF16(s string) C.LPCWSTR {
@@ -680,3 +3008,37 @@ func stringToUTF16(s string) C.LPCWSTR {
 
 	return (C.LPCWSTR)(p)
 }
+
+// utf16BytesToString converts a NUL terminated, little endian UTF-16 buffer
+// (as returned by many CNG properties) to a Go string.
+func utf16BytesToString(b []byte) string {
+	u := make([]uint16, 0, len(b)/2)
+	for j := 0; j+1 < len(b); j += 2 {
+		c := uint16(b[j]) | uint16(b[j+1])<<8
+		if c == 0 {
+			break
+		}
+		u = append(u, c)
+	}
+
+	return string(utf16.Decode(u))
+}
+
+// utf16PtrToString converts a NUL terminated UTF-16 C string to a Go string.
+func utf16PtrToString(p unsafe.Pointer) string {
+	// Not sure why this isn't 1 << 30...
+	const maxUint16Array = 1 << 29
+
+	if p == nil {
+		return ""
+	}
+
+	wstr := (*[maxUint16Array]uint16)(p)
+
+	n := 0
+	for n < maxUint16Array && wstr[n] != 0 {
+		n++
+	}
+
+	return string(utf16.Decode(wstr[:n:n]))
+}
@@ -0,0 +1,1263 @@
+package certstore
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	pkgerrors "github.com/pkg/errors"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func TestPSSUnsupportedByProvider(t *testing.T) {
+	// A CryptoAPI key that can't be reacquired through CNG.
+	wpk := &winPrivateKey{
+		publicKey: leafRSA.Certificate.PublicKey,
+		capiProv:  1,
+	}
+
+	digest := sha256.Sum256([]byte("hello"))
+	opts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+
+	if _, err := wpk.Sign(rand.Reader, digest[:], opts); err != ErrPSSUnsupportedByProvider {
+		t.Fatalf("expected ErrPSSUnsupportedByProvider, got %v", err)
+	}
+}
+
+func TestWindowsErrorSentinels(t *testing.T) {
+	cases := []struct {
+		err      error
+		sentinel error
+	}{
+		{securityStatus(SCARD_W_CANCELLED_BY_USER), ErrPINCancelled},
+		{errCode(HRESULT_ERROR_CANCELLED), ErrPINCancelled},
+		{securityStatus(SCARD_W_WRONG_CHV), ErrIncorrectPIN},
+		{securityStatus(NTE_BAD_KEYSET), ErrNoPrivateKey},
+		{securityStatus(NTE_PERM), ErrPermissionDenied},
+		{errCode(NTE_SILENT_CONTEXT), ErrSilentPINRequired},
+		{errCode(CRYPT_E_NOT_FOUND), ErrNotFound},
+		{errCode(SCARD_E_NO_SMARTCARD), ErrNoSmartCard},
+	}
+
+	for _, c := range cases {
+		if err := pkgerrors.Wrap(c.err, "failed"); !errors.Is(err, c.sentinel) {
+			t.Errorf("expected %v to match %v", err, c.sentinel)
+		}
+	}
+
+	if errors.Is(securityStatus(NTE_PERM), ErrNotFound) {
+		t.Error("unexpected match for unrelated sentinel")
+	}
+}
+
+func TestIsTransientCardError(t *testing.T) {
+	if !isTransientCardError(pkgerrors.Wrap(securityStatus(SCARD_W_RESET_CARD), "failed to sign digest")) {
+		t.Fatal("expected SCARD_W_RESET_CARD to be transient")
+	}
+	if !isTransientCardError(errCode(SCARD_E_NO_SMARTCARD)) {
+		t.Fatal("expected SCARD_E_NO_SMARTCARD to be transient")
+	}
+	if isTransientCardError(securityStatus(NTE_BAD_KEYSET)) {
+		t.Fatal("expected NTE_BAD_KEYSET not to be transient")
+	}
+}
+
+func TestNewCNGPrivateKeyOptions(t *testing.T) {
+	// Keys opened by CryptAcquireCertificatePrivateKey and keys pinned to a
+	// reader both go through newCNGPrivateKey, so both honour the options.
+	var (
+		logger = &recordingLogger{}
+		retry  = RetryPolicy{MaxAttempts: 3, Delay: time.Millisecond}
+		wpk    = newCNGPrivateKey(0, leafEC.Certificate.PublicKey, OpenOptions{Silent: true, Logger: logger, Retry: retry})
+	)
+
+	if !wpk.silent {
+		t.Fatal("expected silent key")
+	}
+	if wpk.logger != logger {
+		t.Fatal("expected store logger")
+	}
+	if wpk.retry != retry {
+		t.Fatalf("expected retry policy %+v, got %+v", retry, wpk.retry)
+	}
+}
+
+func TestSecurityStatusError(t *testing.T) {
+	msg := securityStatus(NTE_BAD_KEYSET).Error()
+	if !strings.HasPrefix(msg, "SECURITY_STATUS 0x80090016: ") || len(msg) <= len("SECURITY_STATUS 0x80090016: ") {
+		t.Fatalf("expected code and description, got %q", msg)
+	}
+}
+
+func TestImportEphemeral(t *testing.T) {
+	store, err := ImportEphemeral(leafRSA.PFX("asdf"), "asdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	ident, err := FindIdentityByThumbprint(store, thumbprint(leafRSA.Certificate))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ident.Close()
+
+	signer, err := ident.Signer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest := sha256.Sum256([]byte("hello"))
+	sig, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rsa.VerifyPKCS1v15(leafRSA.Certificate.PublicKey.(*rsa.PublicKey), crypto.SHA256, digest[:], sig); err != nil {
+		t.Fatal(err)
+	}
+
+	// The identity must not have been added to the personal store.
+	withStore(t, func(my Store) {
+		if _, err := FindIdentityByThumbprint(my, thumbprint(leafRSA.Certificate)); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expected ErrNotFound from MY store, got %v", err)
+		}
+	})
+}
+
+func TestExportPFX(t *testing.T) {
+	withStore(t, func(store Store) {
+		for _, exportable := range []bool{true, false} {
+			if err := store.ImportWithOptions(leafEC.PFX("asdf"), "asdf", ImportOptions{Exportable: exportable}); err != nil {
+				t.Fatal(err)
+			}
+
+			ident, err := FindIdentityByThumbprint(store, thumbprint(leafEC.Certificate))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pfx, err := ident.ExportPFX("qwer")
+			if exportable {
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				key, cert, _, err := pkcs12.DecodeChain(pfx, "qwer")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !cert.Equal(leafEC.Certificate) {
+					t.Fatal("exported certificate doesn't match")
+				}
+				if key.(*ecdsa.PrivateKey).D.Cmp(leafEC.PrivateKey.(*ecdsa.PrivateKey).D) != 0 {
+					t.Fatal("exported key doesn't match")
+				}
+
+				reimported, err := ImportEphemeral(pfx, "qwer")
+				if err != nil {
+					t.Fatal(err)
+				}
+				reident, err := FindIdentityByThumbprint(reimported, thumbprint(leafEC.Certificate))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if same, err := reident.SameKeyAs(ident); err != nil || !same {
+					t.Fatalf("re-imported identity has a different key: %v", err)
+				}
+				reident.Close()
+				reimported.Close()
+			} else if !errors.Is(err, ErrNotExportable) {
+				t.Fatalf("expected ErrNotExportable, got %v", err)
+			}
+
+			if err = ident.Delete(); err != nil {
+				t.Fatal(err)
+			}
+			ident.Close()
+		}
+	})
+}
+
+func TestImportSkipsCACertificates(t *testing.T) {
+	pfx, err := pkcs12.Encode(rand.Reader, leafRSA.PrivateKey, leafRSA.Certificate, []*x509.Certificate{intermediate.Certificate}, "asdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withStore(t, func(store Store) {
+		if err := store.Import(pfx, "asdf"); err != nil {
+			t.Fatal(err)
+		}
+
+		ident, err := FindIdentityByThumbprint(store, thumbprint(leafRSA.Certificate))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ident.Close()
+		defer ident.Delete()
+
+		if _, err := FindIdentityByThumbprint(store, thumbprint(intermediate.Certificate)); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expected intermediate not to be imported, got %v", err)
+		}
+
+		idents, err := FindIdentities(store, BySubject(leafRSA.Certificate.Subject.CommonName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, i := range idents {
+			defer i.Close()
+		}
+		if len(idents) != 1 {
+			t.Fatalf("expected exactly 1 identity, got %d", len(idents))
+		}
+	})
+}
+
+func TestFindSkipsKeylessCertificates(t *testing.T) {
+	pfx, err := pkcs12.Encode(rand.Reader, leafRSA.PrivateKey, leafRSA.Certificate, []*x509.Certificate{intermediate.Certificate}, "asdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The ephemeral store holds the keyed leaf and the keyless intermediate.
+	store, err := ImportEphemeral(pfx, "asdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	idents, err := store.Identities()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range idents {
+		defer i.Close()
+	}
+	if len(idents) != 1 {
+		t.Fatalf("expected exactly 1 identity, got %d", len(idents))
+	}
+
+	ident, err := FindIdentityByThumbprint(store, thumbprint(leafRSA.Certificate))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ident.Close()
+
+	if _, err = ident.Signer(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = FindIdentityByThumbprint(store, thumbprint(intermediate.Certificate)); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for keyless certificate, got %v", err)
+	}
+
+	byName, err := FindIdentities(store, BySubject(intermediate.Certificate.Subject.CommonName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range byName {
+		defer i.Close()
+		crt, err := i.Certificate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if crt.Equal(intermediate.Certificate) {
+			t.Fatal("keyless certificate returned as an identity")
+		}
+	}
+}
+
+// TestIterateIdentitiesStress opens, iterates and closes the store many times,
+// stopping at different points, to catch chain contexts being freed twice. Run
+// it with page heap enabled for the test binary (gflags /p /enable) to make
+// such bugs crash reliably.
+func TestIterateIdentitiesStress(t *testing.T) {
+	withIdentity(t, leafEC, func(Identity) {
+		for i := 0; i < 200; i++ {
+			store, err := Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			it, err := IterateIdentities(store)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Stop after i identities, or at the end, whichever comes first.
+			for n := 0; n < i; n++ {
+				ident, err := it.Next()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				ident.Close()
+			}
+
+			if i%2 == 0 {
+				if err = it.Reset(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Close the store before the iterator on every third pass, since
+			// the chain contexts keep their own reference to the store.
+			if i%3 == 0 {
+				store.Close()
+				it.Close()
+			} else {
+				it.Close()
+				store.Close()
+			}
+		}
+	})
+}
+
+// recordingLogger records the messages logged to it.
+type recordingLogger struct {
+	msgs []string
+}
+
+func (l *recordingLogger) Printf(format string, v ...interface{}) {
+	l.msgs = append(l.msgs, fmt.Sprintf(format, v...))
+}
+
+func (l *recordingLogger) logged(call string) bool {
+	for _, msg := range l.msgs {
+		if strings.Contains(msg, call) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestLogger(t *testing.T) {
+	logger := new(recordingLogger)
+
+	store, err := OpenWithOptions(OpenOptions{Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if err = store.Import(leafRSA.PFX("asdf"), "asdf"); err != nil {
+		t.Fatal(err)
+	}
+
+	ident, err := FindIdentityByThumbprint(store, thumbprint(leafRSA.Certificate))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ident.Close()
+	defer ident.Delete()
+
+	signer, err := ident.Signer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest := sha256.Sum256([]byte("hello"))
+	if _, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, call := range []string{"CertOpenStore", "CryptAcquireCertificatePrivateKey", "SignHash"} {
+		if !logger.logged(call) {
+			t.Errorf("expected %s to be logged, got %q", call, logger.msgs)
+		}
+	}
+}
+
+func TestKeyProviderInfo(t *testing.T) {
+	withIdentity(t, leafRSA, func(ident Identity) {
+		fromCert, err := ident.KeyProviderInfo()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = ident.Signer(); err != nil {
+			t.Fatal(err)
+		}
+
+		fromKey, err := ident.KeyProviderInfo()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fromKey.Provider == "" || fromKey.Container == "" || fromKey.KeySpec == 0 {
+			t.Fatalf("incomplete provider info: %+v", fromKey)
+		}
+		if fromKey.Container != fromCert.Container {
+			t.Fatalf("expected container %q, got %q", fromCert.Container, fromKey.Container)
+		}
+	})
+}
+
+func TestVerifyForUsage(t *testing.T) {
+	withIdentity(t, leafEC, func(_ Identity) {
+		// The fixtures chain to a root that isn't in the Root store, so the
+		// chain policy rejects them.
+		withStore(t, func(store Store) {
+			ident, err := FindIdentityByThumbprint(store, thumbprint(leafEC.Certificate))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err = ident.VerifyForUsage([]string{szOID_PKIX_KP_CLIENT_AUTH}); err == nil {
+				t.Fatal("expected untrusted chain to fail verification")
+			}
+
+			ident.Close()
+
+			if err = ident.VerifyForUsage([]string{szOID_PKIX_KP_CLIENT_AUTH}); err != ErrClosed {
+				t.Fatalf("expected ErrClosed after Close, got %v", err)
+			}
+		})
+
+		store, err := OpenWithOptions(OpenOptions{Revocation: RevocationMode(-1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+
+		ident, err := FindIdentityByThumbprint(store, thumbprint(leafEC.Certificate))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ident.Close()
+
+		if err = ident.VerifyForUsage(nil); err == nil || !strings.Contains(err.Error(), "unknown revocation mode") {
+			t.Fatalf("expected unknown revocation mode error, got %v", err)
+		}
+	})
+}
+
+// TestDeleteCAPIKeysBounded imports and deletes CryptoAPI keys in a loop,
+// checking that native memory stays bounded. Deleting a CryptoAPI key reads
+// several provider parameters into C memory, which used to leak. Set
+// CERTSTORE_DELETE_ITERATIONS to run it for longer.
+func TestDeleteCAPIKeysBounded(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping import/delete loop in short mode")
+	}
+
+	iterations := 2000
+	if env := os.Getenv("CERTSTORE_DELETE_ITERATIONS"); env != "" {
+		n, err := strconv.Atoi(env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		iterations = n
+	}
+
+	store, err := OpenWithOptions(OpenOptions{KeyStorage: KeyStoragePreferCAPI})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	pfx := leafRSA.PFX("asdf")
+
+	importDelete := func() {
+		if err := store.Import(pfx, "asdf"); err != nil {
+			t.Fatal(err)
+		}
+
+		ident, err := FindIdentityByThumbprint(store, thumbprint(leafRSA.Certificate))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ident.Close()
+
+		signer, err := ident.Signer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wpk, ok := signer.(*winPrivateKey); !ok || wpk.capiProv == 0 {
+			t.Fatal("expected a CryptoAPI key")
+		}
+
+		if err = ident.Delete(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// nativeBytes gets the process's private bytes, less what the Go runtime
+	// has taken from the OS.
+	nativeBytes := func() int64 {
+		runtime.GC()
+		debug.FreeOSMemory()
+
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+
+		n, err := processPrivateBytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return int64(n) - int64(ms.Sys)
+	}
+
+	// Let the providers' caches and the heap warm up first.
+	for i := 0; i < 50; i++ {
+		importDelete()
+	}
+
+	before := nativeBytes()
+	for i := 0; i < iterations; i++ {
+		importDelete()
+	}
+	after := nativeBytes()
+
+	// Allow some slack for heap fragmentation, but not a per-key leak.
+	if budget := int64(256<<10 + 32*iterations); after-before > budget {
+		t.Fatalf("native memory grew by %d bytes over %d deletions (budget %d)", after-before, iterations, budget)
+	}
+}
+
+func TestImportFriendlyName(t *testing.T) {
+	withStore(t, func(store Store) {
+		if err := store.ImportWithOptions(leafEC.PFX("asdf"), "asdf", ImportOptions{FriendlyName: "My signing cert"}); err != nil {
+			t.Fatal(err)
+		}
+
+		ident, err := FindIdentityByThumbprint(store, thumbprint(leafEC.Certificate))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ident.Close()
+		defer ident.Delete()
+
+		name, err := ident.DisplayName()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != "My signing cert" {
+			t.Fatalf("expected friendly name, got %q", name)
+		}
+	})
+}
+
+func TestSignRaw(t *testing.T) {
+	withIdentity(t, leafRSA, func(ident Identity) {
+		signer, err := ident.Signer()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		raw, ok := signer.(RawSigner)
+		if !ok {
+			t.Fatal("expected signer to implement RawSigner")
+		}
+
+		var (
+			pub    = leafRSA.Certificate.PublicKey.(*rsa.PublicKey)
+			digest = sha256.Sum256([]byte("hello"))
+			prefix = []byte{0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20}
+			info   = append(append([]byte(nil), prefix...), digest[:]...)
+		)
+
+		sig, err := raw.SignRaw(info, SignRawPKCS1)
+		if errors.Is(err, ErrUnsupportedOperation) {
+			t.Skip("SignRaw isn't supported for CryptoAPI keys")
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig); err != nil {
+			t.Fatal(err)
+		}
+
+		// EMSA-PKCS1-v1_5: 00 01 FF..FF 00 DigestInfo
+		block := make([]byte, (pub.N.BitLen()+7)/8)
+		block[1] = 0x01
+		for i := 2; i < len(block)-len(info)-1; i++ {
+			block[i] = 0xff
+		}
+		copy(block[len(block)-len(info):], info)
+
+		if sig, err = raw.SignRaw(block, SignRawNoPadding); err != nil {
+			t.Fatal(err)
+		}
+		if err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = raw.SignRaw(block[1:], SignRawNoPadding); err == nil {
+			t.Fatal("expected error for data shorter than the modulus")
+		}
+	})
+}
+
+func TestStoreProvider(t *testing.T) {
+	valid := []OpenOptions{
+		{StoreProvider: StoreProviderSystemRegistry},
+		{StoreProvider: StoreProviderPhysical, StoreName: `MY\.Default`},
+	}
+
+	for _, opts := range valid {
+		store, err := OpenWithOptions(opts)
+		if err != nil {
+			t.Fatalf("%v %q: %v", opts.StoreProvider, opts.StoreName, err)
+		}
+		store.Close()
+	}
+
+	invalid := []OpenOptions{
+		{StoreProvider: StoreProviderPhysical},
+		{StoreProvider: StoreProviderPhysical, StoreName: "MY"},
+		{StoreProvider: StoreProviderPhysical, StoreName: `MY\`},
+		{StoreProvider: StoreProviderSystem, StoreName: `MY\.Default`},
+		{StoreProvider: StoreProvider(99)},
+	}
+
+	for _, opts := range invalid {
+		if store, err := OpenWithOptions(opts); err == nil {
+			store.Close()
+			t.Fatalf("expected error for %v %q", opts.StoreProvider, opts.StoreName)
+		}
+	}
+}
+
+func TestSilentSign(t *testing.T) {
+	withIdentity(t, leafRSA, func(_ Identity) {
+		store, err := OpenWithOptions(OpenOptions{Silent: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+
+		ident, err := FindIdentityByThumbprint(store, thumbprint(leafRSA.Certificate))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ident.Close()
+
+		signer, err := ident.Signer()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Software keys never prompt, so silent signing must succeed.
+		digest := sha256.Sum256([]byte("hello"))
+		if _, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestSignerAfterClose(t *testing.T) {
+	withIdentity(t, leafEC, func(_ Identity) {
+		withStore(t, func(store Store) {
+			ident, err := FindIdentityByThumbprint(store, thumbprint(leafEC.Certificate))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			signer, err := ident.Signer()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			digest := sha256.Sum256([]byte("hello"))
+			if _, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256); err != nil {
+				t.Fatal(err)
+			}
+
+			ident.Close()
+
+			if _, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256); err != ErrClosed {
+				t.Fatalf("expected ErrClosed signing after Close, got %v", err)
+			}
+			if _, err = ident.Signer(); err != ErrClosed {
+				t.Fatalf("expected ErrClosed from Signer after Close, got %v", err)
+			}
+			if _, err = ident.KeyProviderInfo(); err != ErrClosed {
+				t.Fatalf("expected ErrClosed from KeyProviderInfo after Close, got %v", err)
+			}
+			if err = ident.Delete(); err != ErrClosed {
+				t.Fatalf("expected ErrClosed from Delete after Close, got %v", err)
+			}
+		})
+	})
+}
+
+func TestSignLegacyHashes(t *testing.T) {
+	withIdentity(t, leafRSA, func(ident Identity) {
+		signer, err := ident.Signer()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The TLS 1.0 MD5+SHA1 digest is signed without a DigestInfo.
+		digest := make([]byte, crypto.MD5SHA1.Size())
+		if _, err = rand.Read(digest); err != nil {
+			t.Fatal(err)
+		}
+		sig, err := signer.Sign(rand.Reader, digest, crypto.MD5SHA1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = rsa.VerifyPKCS1v15(leafRSA.Certificate.PublicKey.(*rsa.PublicKey), crypto.MD5SHA1, digest, sig); err != nil {
+			t.Fatal(err)
+		}
+
+		// Neither CryptoAPI nor CNG can sign SHA-224 with RSA.
+		if _, err = signer.Sign(rand.Reader, make([]byte, crypto.SHA224.Size()), crypto.SHA224); !errors.Is(err, ErrUnsupportedHash) {
+			t.Fatalf("expected ErrUnsupportedHash for SHA-224, got %v", err)
+		}
+	})
+
+	withIdentity(t, leafEC, func(ident Identity) {
+		signer, err := ident.Signer()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = signer.Sign(rand.Reader, make([]byte, crypto.MD5SHA1.Size()), crypto.MD5SHA1); !errors.Is(err, ErrUnsupportedHash) {
+			t.Fatalf("expected ErrUnsupportedHash for ECDSA MD5+SHA1, got %v", err)
+		}
+	})
+}
+
+// fakeNativeKey implements the nativeKey interface, returning canned
+// signatures and errors in turn.
+type fakeNativeKey struct {
+	sigs  [][]byte
+	errs  []error
+	le    bool
+	calls int
+}
+
+func (k *fakeNativeKey) signHash(hash crypto.Hash, digest []byte, pssOpts *rsa.PSSOptions) ([]byte, error) {
+	i := k.calls
+	k.calls++
+
+	if i < len(k.errs) && k.errs[i] != nil {
+		return nil, k.errs[i]
+	}
+
+	return append([]byte(nil), k.sigs[i]...), nil
+}
+
+func (k *fakeNativeKey) littleEndian() bool {
+	return k.le
+}
+
+func TestSignNativeKey(t *testing.T) {
+	var (
+		digest  = sha256.Sum256([]byte("hello"))
+		rsaPub  = leafKeyRSA.Public()
+		ecPub   = leafKeyEC.Public()
+		der, _  = asn1.Marshal(struct{ R, S *big.Int }{big.NewInt(0x0102), big.NewInt(0x0304)})
+		errCard = securityStatus(SCARD_W_RESET_CARD)
+	)
+
+	tests := []struct {
+		name   string
+		pub    crypto.PublicKey
+		key    *fakeNativeKey
+		opts   crypto.SignerOpts
+		retry  RetryPolicy
+		want   []byte
+		err    error
+		errIs  error
+		anyErr bool
+		calls  int
+		closed bool
+	}{
+		{
+			name:  "CNG RSA",
+			pub:   rsaPub,
+			key:   &fakeNativeKey{sigs: [][]byte{{1, 2, 3}}},
+			opts:  crypto.SHA256,
+			want:  []byte{1, 2, 3},
+			calls: 1,
+		},
+		{
+			name:  "CryptoAPI RSA is reversed",
+			pub:   rsaPub,
+			key:   &fakeNativeKey{sigs: [][]byte{{1, 2, 3}}, le: true},
+			opts:  crypto.SHA256,
+			want:  []byte{3, 2, 1},
+			calls: 1,
+		},
+		{
+			name:  "CryptoAPI RSA with LittleEndianOpts",
+			pub:   rsaPub,
+			key:   &fakeNativeKey{sigs: [][]byte{{1, 2, 3}}, le: true},
+			opts:  LittleEndianOpts{crypto.SHA256},
+			want:  []byte{1, 2, 3},
+			calls: 1,
+		},
+		{
+			name:  "CryptoAPI RSA with *LittleEndianOpts",
+			pub:   rsaPub,
+			key:   &fakeNativeKey{sigs: [][]byte{{1, 2, 3}}, le: true},
+			opts:  &LittleEndianOpts{crypto.SHA256},
+			want:  []byte{1, 2, 3},
+			calls: 1,
+		},
+		{
+			name:  "LittleEndianOpts wrapping PSS is rejected",
+			pub:   rsaPub,
+			key:   &fakeNativeKey{le: true},
+			opts:  LittleEndianOpts{&rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}},
+			errIs: ErrUnsupportedOperation,
+			calls: 0,
+		},
+		{
+			name:  "CNG ECDSA is DER encoded",
+			pub:   ecPub,
+			key:   &fakeNativeKey{sigs: [][]byte{{0, 1, 2, 0, 3, 4}}},
+			opts:  crypto.SHA256,
+			want:  der,
+			calls: 1,
+		},
+		{
+			name:  "CNG ECDSA with odd length",
+			pub:   ecPub,
+			key:   &fakeNativeKey{sigs: [][]byte{{1, 2, 3}}},
+			opts:  crypto.SHA256,
+			err:   errors.New("bad ecdsa signature from CNG"),
+			calls: 1,
+		},
+		{
+			name:  "CryptoAPI ECDSA is rejected",
+			pub:   ecPub,
+			key:   &fakeNativeKey{le: true},
+			opts:  crypto.SHA256,
+			errIs: ErrUnsupportedOperation,
+			calls: 0,
+		},
+		{
+			name:  "native error",
+			pub:   rsaPub,
+			key:   &fakeNativeKey{errs: []error{securityStatus(NTE_PERM)}},
+			opts:  crypto.SHA256,
+			errIs: ErrPermissionDenied,
+			calls: 1,
+		},
+		{
+			name:  "transient error is retried",
+			pub:   rsaPub,
+			key:   &fakeNativeKey{sigs: [][]byte{nil, {1, 2, 3}}, errs: []error{errCard}},
+			opts:  crypto.SHA256,
+			retry: RetryPolicy{MaxAttempts: 2},
+			want:  []byte{1, 2, 3},
+			calls: 2,
+		},
+		{
+			name:  "transient error without retries",
+			pub:   rsaPub,
+			key:   &fakeNativeKey{errs: []error{errCard}},
+			opts:  crypto.SHA256,
+			err:   errCard,
+			calls: 1,
+		},
+		{
+			name:   "wrong digest length",
+			pub:    rsaPub,
+			key:    &fakeNativeKey{},
+			opts:   crypto.SHA384,
+			anyErr: true,
+			calls:  0,
+		},
+		{
+			name:   "closed",
+			pub:    rsaPub,
+			key:    &fakeNativeKey{},
+			opts:   crypto.SHA256,
+			errIs:  ErrClosed,
+			calls:  0,
+			closed: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wpk := &winPrivateKey{publicKey: tt.pub, native: tt.key, retry: tt.retry, closed: tt.closed}
+
+			sig, err := wpk.Sign(rand.Reader, digest[:], tt.opts)
+
+			switch {
+			case tt.err != nil:
+				if err == nil || err.Error() != tt.err.Error() {
+					t.Fatalf("expected error %v, got %v", tt.err, err)
+				}
+			case tt.anyErr:
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+			case tt.errIs != nil:
+				if !errors.Is(err, tt.errIs) {
+					t.Fatalf("expected error wrapping %v, got %v", tt.errIs, err)
+				}
+			case err != nil:
+				t.Fatal(err)
+			case !bytes.Equal(sig, tt.want):
+				t.Fatalf("expected signature %x, got %x", tt.want, sig)
+			}
+
+			if tt.key.calls != tt.calls {
+				t.Fatalf("expected %d native calls, got %d", tt.calls, tt.key.calls)
+			}
+		})
+	}
+}
+
+// fakeChainFinder implements the chainFinder interface, returning canned
+// chains and then ending with endErr.
+type fakeChainFinder struct {
+	chains []fakeChain
+	endErr error
+	calls  int
+}
+
+// fakeChain is a chain returned by fakeChainFinder: an identity, or an error
+// reading the chain.
+type fakeChain struct {
+	ident *fakeIdentity
+	err   error
+}
+
+func (f *fakeChainFinder) next() (Identity, bool, error) {
+	i := f.calls
+	f.calls++
+
+	if i >= len(f.chains) {
+		return nil, false, f.endErr
+	}
+
+	if f.chains[i].err != nil {
+		return nil, true, f.chains[i].err
+	}
+
+	return f.chains[i].ident, true, nil
+}
+
+func (f *fakeChainFinder) close() {}
+
+// fakeIdentity records whether it was closed.
+type fakeIdentity struct {
+	Identity
+	closed bool
+}
+
+func (i *fakeIdentity) Close() {
+	i.closed = true
+}
+
+func TestCollectIdentities(t *testing.T) {
+	var (
+		errWalk     = errors.New("store unavailable")
+		errBadChain = errors.New("bad chain")
+		notFound    = pkgerrors.Wrap(errCode(CRYPT_E_NOT_FOUND), "failed to iterate certs in store")
+	)
+
+	tests := []struct {
+		name      string
+		chains    int
+		badChain  bool
+		endErr    error
+		cancelled bool
+		err       error
+	}{
+		{name: "end of store", chains: 2, endErr: notFound},
+		{name: "empty store", endErr: notFound},
+		{name: "end without error", chains: 1},
+		{name: "walk fails", chains: 2, endErr: errWalk, err: errWalk},
+		{name: "bad chain", chains: 1, badChain: true, endErr: notFound, err: errBadChain},
+		{name: "cancelled", chains: 1, endErr: notFound, cancelled: true, err: context.Canceled},
+	}
+
+	for _, tt := range tests {
+		finder := &fakeChainFinder{endErr: tt.endErr}
+		for j := 0; j < tt.chains; j++ {
+			finder.chains = append(finder.chains, fakeChain{ident: &fakeIdentity{}})
+		}
+		if tt.badChain {
+			finder.chains = append(finder.chains, fakeChain{err: errBadChain})
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		if tt.cancelled {
+			cancel()
+		}
+
+		idents, err := collectIdentities(ctx, finder)
+		cancel()
+
+		if tt.cancelled && finder.calls != 0 {
+			t.Fatalf("%s: expected no chains read after cancellation", tt.name)
+		}
+
+		if err != tt.err {
+			t.Fatalf("%s: expected error %v, got %v", tt.name, tt.err, err)
+		}
+
+		if tt.err != nil {
+			if idents != nil {
+				t.Fatalf("%s: expected no identities on error", tt.name)
+			}
+			for k, c := range finder.chains {
+				if c.ident != nil && k < finder.calls && !c.ident.closed {
+					t.Fatalf("%s: expected identities read before the error to be closed", tt.name)
+				}
+			}
+			continue
+		}
+
+		if idents == nil || len(idents) != tt.chains {
+			t.Fatalf("%s: expected %d identities, got %d", tt.name, tt.chains, len(idents))
+		}
+		for _, ident := range idents {
+			if ident.(*fakeIdentity).closed {
+				t.Fatalf("%s: expected returned identities to be open", tt.name)
+			}
+		}
+	}
+}
+
+func TestNextIdentity(t *testing.T) {
+	errBadChain := errors.New("bad chain")
+
+	// A chain that can't be read doesn't end the walk.
+	finder := &fakeChainFinder{
+		chains: []fakeChain{{err: errBadChain}, {ident: &fakeIdentity{}}},
+		endErr: errCode(CRYPT_E_NOT_FOUND),
+	}
+
+	if _, done, err := nextIdentity(finder); err != errBadChain || done {
+		t.Fatalf("expected bad chain without ending, got done=%t, %v", done, err)
+	}
+	if ident, done, err := nextIdentity(finder); err != nil || done || ident != finder.chains[1].ident {
+		t.Fatalf("expected next identity, got done=%t, %v", done, err)
+	}
+	if _, done, err := nextIdentity(finder); err != io.EOF || !done {
+		t.Fatalf("expected io.EOF at end of store, got done=%t, %v", done, err)
+	}
+
+	// A failed walk ends it with the error rather than io.EOF.
+	errWalk := errors.New("store unavailable")
+	finder = &fakeChainFinder{endErr: errWalk}
+
+	if _, done, err := nextIdentity(finder); err != errWalk || !done {
+		t.Fatalf("expected walk error at end, got done=%t, %v", done, err)
+	}
+}
+
+func TestReverseBytes(t *testing.T) {
+	for n := 0; n < 6; n++ {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = byte(i)
+		}
+
+		reverseBytes(b)
+
+		for i := range b {
+			if b[i] != byte(n-1-i) {
+				t.Fatalf("bad reversal of %d bytes: %v", n, b)
+			}
+		}
+	}
+}
+
+func TestCAPISignatureByteOrder(t *testing.T) {
+	for _, bits := range []int{2048, 4096} {
+		t.Run(fmt.Sprintf("RSA-%d", bits), func(t *testing.T) {
+			key, err := rsa.GenerateKey(rand.Reader, bits)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Find a signature with a leading zero byte, since those would be
+			// the first to break if the reversal dropped or shifted bytes.
+			var (
+				digest     [sha256.Size]byte
+				sawLeading bool
+			)
+
+			for i := 0; i < 4096 && !sawLeading; i++ {
+				digest = sha256.Sum256([]byte(fmt.Sprintf("message %d", i)))
+
+				want, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+				if err != nil {
+					t.Fatal(err)
+				}
+				sawLeading = want[0] == 0
+
+				// CryptSignHash returns the signature little-endian.
+				le := append([]byte(nil), want...)
+				reverseBytes(le)
+
+				wpk := &winPrivateKey{publicKey: key.Public(), native: &fakeNativeKey{sigs: [][]byte{le}, le: true}}
+
+				sig, err := wpk.Sign(rand.Reader, digest[:], crypto.SHA256)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(sig) != bits/8 {
+					t.Fatalf("expected %d byte signature, got %d", bits/8, len(sig))
+				}
+				if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], sig); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if !sawLeading {
+				t.Fatal("no signature with a leading zero byte was produced")
+			}
+		})
+	}
+}
+
+func TestKeyStorageAPIFlag(t *testing.T) {
+	if apiFlag(KeyStorageAuto) != winAPIFlag {
+		t.Fatal("expected KeyStorageAuto to use winAPIFlag")
+	}
+
+	seen := map[interface{}]KeyStoragePreference{}
+	for _, pref := range []KeyStoragePreference{KeyStoragePreferCAPI, KeyStoragePreferCNG, KeyStorageOnlyCNG} {
+		flag := apiFlag(pref)
+		if other, ok := seen[flag]; ok {
+			t.Fatalf("preferences %d and %d use the same flag", other, pref)
+		}
+		seen[flag] = pref
+	}
+}
+
+func TestDecrypt(t *testing.T) {
+	withIdentity(t, leafRSA, func(ident Identity) {
+		signer, err := ident.Signer()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decrypter, ok := signer.(crypto.Decrypter)
+		if !ok {
+			t.Fatal("expected signer to be a crypto.Decrypter")
+		}
+
+		pub := leafRSA.Certificate.PublicKey.(*rsa.PublicKey)
+		msg := []byte("hello")
+
+		ct, err := rsa.EncryptPKCS1v15(rand.Reader, pub, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pt, err := decrypter.Decrypt(rand.Reader, ct, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(pt, msg) {
+			t.Fatalf("bad PKCS#1 v1.5 plaintext: %q", pt)
+		}
+
+		for _, opts := range []*rsa.OAEPOptions{
+			{Hash: crypto.SHA1},
+			{Hash: crypto.SHA256, Label: []byte("label")},
+		} {
+			ct, err := rsa.EncryptOAEP(opts.Hash.New(), rand.Reader, pub, msg, opts.Label)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pt, err := decrypter.Decrypt(rand.Reader, ct, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(pt, msg) {
+				t.Fatalf("bad OAEP plaintext with %v: %q", opts.Hash, pt)
+			}
+		}
+	})
+}
+
+func TestSignerEd25519(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{Organization: []string{"certstore"}, CommonName: "leaf-ed25519"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, intermediate.Certificate, pub, intermediate.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pfx, err := pkcs12.Encode(rand.Reader, priv, crt, nil, "asdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withStore(t, func(store Store) {
+		if err := store.Import(pfx, "asdf"); err != nil {
+			t.Skipf("platform doesn't support importing Ed25519 keys: %v", err)
+		}
+
+		ident, err := FindIdentityByThumbprint(store, thumbprint(crt))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ident.Close()
+		defer ident.Delete()
+
+		signer, err := ident.Signer()
+		if err != nil {
+			t.Skipf("platform doesn't support Ed25519 keys: %v", err)
+		}
+
+		msg := []byte("hello")
+
+		sig, err := signer.Sign(rand.Reader, msg, crypto.Hash(0))
+		if err == ErrUnsupportedOperation {
+			t.Skip("key provider doesn't support Ed25519")
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		if !ed25519.Verify(pub, msg, sig) {
+			t.Fatal("bad Ed25519 signature")
+		}
+
+		if _, err := signer.Sign(rand.Reader, msg, crypto.SHA256); err == nil {
+			t.Fatal("expected error signing with a hash")
+		}
+	})
+}
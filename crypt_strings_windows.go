@@ -12,6 +12,12 @@ package certstore
 
 // Store name
 LPCSTR GET_CERT_STORE_PROV_SYSTEM_W() { return CERT_STORE_PROV_SYSTEM_W; }
+LPCSTR GET_CERT_STORE_PROV_MEMORY() { return CERT_STORE_PROV_MEMORY; }
+LPCSTR GET_CERT_STORE_PROV_SYSTEM_REGISTRY_W() { return CERT_STORE_PROV_SYSTEM_REGISTRY_W; }
+LPCSTR GET_CERT_STORE_PROV_PHYSICAL_W() { return CERT_STORE_PROV_PHYSICAL_W; }
+
+// Key storage providers
+LPCWSTR GET_MS_SMART_CARD_KEY_STORAGE_PROVIDER() { return MS_SMART_CARD_KEY_STORAGE_PROVIDER; }
 
 // NCRYPT Object Property Names
 LPCWSTR GET_NCRYPT_ALGORITHM_GROUP_PROPERTY() { return NCRYPT_ALGORITHM_GROUP_PROPERTY; }
@@ -114,12 +120,24 @@ LPCWSTR GET_BCRYPT_PBKDF2_ALGORITHM() { return BCRYPT_PBKDF2_ALGORITHM; }
 LPCWSTR GET_BCRYPT_ECDSA_ALGORITHM() { return BCRYPT_ECDSA_ALGORITHM; }
 LPCWSTR GET_BCRYPT_ECDH_ALGORITHM() { return BCRYPT_ECDH_ALGORITHM; }
 LPCWSTR GET_BCRYPT_XTS_AES_ALGORITHM() { return BCRYPT_XTS_AES_ALGORITHM; }
+
+#ifndef NCRYPT_PIN_CACHE_FLAGS_PROPERTY
+#define NCRYPT_PIN_CACHE_FLAGS_PROPERTY L"PinCacheFlags"
+#endif
+
+LPCWSTR GET_NCRYPT_PIN_CACHE_FLAGS_PROPERTY() { return NCRYPT_PIN_CACHE_FLAGS_PROPERTY; }
 */
 import "C"
 
 var (
 	// Store name
-	CERT_STORE_PROV_SYSTEM_W = C.GET_CERT_STORE_PROV_SYSTEM_W()
+	CERT_STORE_PROV_SYSTEM_W          = C.GET_CERT_STORE_PROV_SYSTEM_W()
+	CERT_STORE_PROV_MEMORY            = C.GET_CERT_STORE_PROV_MEMORY()
+	CERT_STORE_PROV_SYSTEM_REGISTRY_W = C.GET_CERT_STORE_PROV_SYSTEM_REGISTRY_W()
+	CERT_STORE_PROV_PHYSICAL_W        = C.GET_CERT_STORE_PROV_PHYSICAL_W()
+
+	// Key storage providers
+	MS_SMART_CARD_KEY_STORAGE_PROVIDER = C.GET_MS_SMART_CARD_KEY_STORAGE_PROVIDER()
 
 	// NCRYPT Object Property Names
 	NCRYPT_ALGORITHM_GROUP_PROPERTY        = C.GET_NCRYPT_ALGORITHM_GROUP_PROPERTY()
@@ -204,4 +222,7 @@ var (
 	BCRYPT_ECDSA_ALGORITHM             = C.GET_BCRYPT_ECDSA_ALGORITHM()
 	BCRYPT_ECDH_ALGORITHM              = C.GET_BCRYPT_ECDH_ALGORITHM()
 	BCRYPT_XTS_AES_ALGORITHM           = C.GET_BCRYPT_XTS_AES_ALGORITHM()
+
+	// NCRYPT PIN cache property names
+	NCRYPT_PIN_CACHE_FLAGS_PROPERTY = C.GET_NCRYPT_PIN_CACHE_FLAGS_PROPERTY()
 )
@@ -1,11 +1,16 @@
 module github.com/bitcynth/certstore
 
-go 1.12
+go 1.19
 
 require (
-	github.com/ThalesIgnite/crypto11 v1.2.1
-	github.com/mastahyeti/certstore v0.0.5 // indirect
+	github.com/ThalesIgnite/crypto11 v1.2.5
 	github.com/mastahyeti/fakeca v0.0.2
 	github.com/miekg/pkcs11 v1.0.3-0.20190429190417-a667d056470f
-	github.com/pkg/errors v0.8.1
+	github.com/pkg/errors v0.9.1
+	software.sslmate.com/src/go-pkcs12 v0.4.0
+)
+
+require (
+	github.com/thales-e-security/pool v0.0.2 // indirect
+	golang.org/x/crypto v0.11.0 // indirect
 )
@@ -41,7 +41,7 @@ func init() {
 	clearFixtures()
 }
 
-func withStore(t *testing.T, cb func(Store)) {
+func withStore(t testing.TB, cb func(Store)) {
 	store, err := Open()
 	if err != nil {
 		t.Fatal(err)
@@ -51,7 +51,7 @@ func withStore(t *testing.T, cb func(Store)) {
 	cb(store)
 }
 
-func withIdentity(t *testing.T, i *fakeca.Identity, cb func(Identity)) {
+func withIdentity(t testing.TB, i *fakeca.Identity, cb func(Identity)) {
 	withStore(t, func(store Store) {
 		// Import an identity
 		if err := store.Import(i.PFX("asdf"), "asdf"); err != nil {
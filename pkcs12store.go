@@ -0,0 +1,287 @@
+package certstore
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// OpenPKCS12 opens a PKCS#12 (.p12/.pfx) blob as a read-only, in-memory Store
+// holding a single identity. It is implemented in pure Go, so it works on every
+// platform and never touches the system's certificate store or key providers.
+// Import, ImportWithOptions and Identity.Delete return ErrUnsupportedOperation.
+func OpenPKCS12(data []byte, password string) (_ Store, err error) {
+	defer trace("certstore.Open")(&err)
+
+	key, cert, caCerts, err := pkcs12.DecodeChain(data, password)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode PKCS#12 data: %w", err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type: %T", key)
+	}
+
+	return &pkcs12Store{cert: cert, signer: signer, caCerts: caCerts}, nil
+}
+
+// pkcs12Store implements the Store interface for a decoded PKCS#12 blob.
+type pkcs12Store struct {
+	mu      sync.RWMutex
+	cert    *x509.Certificate
+	signer  crypto.Signer
+	caCerts []*x509.Certificate
+	closed  bool
+}
+
+// Identities implements the Store interface.
+func (s *pkcs12Store) Identities() (_ []Identity, err error) {
+	defer trace("certstore.Identities")(&err)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return nil, ErrClosed
+	}
+
+	return []Identity{&pkcs12Identity{store: s}}, nil
+}
+
+// Import implements the Store interface.
+func (s *pkcs12Store) Import(data []byte, password string) error {
+	return ErrUnsupportedOperation
+}
+
+// ImportWithOptions implements the Store interface.
+func (s *pkcs12Store) ImportWithOptions(data []byte, password string, opts ImportOptions) error {
+	return ErrUnsupportedOperation
+}
+
+// FindRenewalOf implements the Store interface.
+func (s *pkcs12Store) FindRenewalOf(cert *x509.Certificate) (Identity, error) {
+	return findRenewalOf(s, cert)
+}
+
+// ExportTrustAnchors implements the Store interface. A PKCS#12 blob doesn't
+// say which of its CA certificates are trusted, so this isn't supported.
+func (s *pkcs12Store) ExportTrustAnchors() ([]*x509.Certificate, error) {
+	return nil, ErrUnsupportedOperation
+}
+
+// Close implements the Store interface.
+func (s *pkcs12Store) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+}
+
+// findIssuer finds the certificate from the blob that issued crt.
+func (s *pkcs12Store) findIssuer(crt *x509.Certificate) *x509.Certificate {
+	for _, ca := range s.caCerts {
+		if bytes.Equal(ca.RawSubject, crt.RawIssuer) && crt.CheckSignatureFrom(ca) == nil {
+			return ca
+		}
+	}
+
+	return nil
+}
+
+// pkcs12Identity implements the Identity interface.
+type pkcs12Identity struct {
+	store  *pkcs12Store
+	spki   []byte
+	closed bool
+}
+
+// Certificate implements the Identity interface.
+func (i *pkcs12Identity) Certificate() (*x509.Certificate, error) {
+	if i.closed {
+		return nil, ErrClosed
+	}
+
+	return i.store.cert, nil
+}
+
+// CertificateChain implements the Identity interface. The chain is built from
+// the CA certificates in the blob.
+func (i *pkcs12Identity) CertificateChain() ([]*x509.Certificate, error) {
+	if i.closed {
+		return nil, ErrClosed
+	}
+
+	chain := []*x509.Certificate{i.store.cert}
+
+	for len(chain) < maxChainLength {
+		last := chain[len(chain)-1]
+		if isSelfSigned(last) {
+			return chain, nil
+		}
+
+		issuer := i.store.findIssuer(last)
+		if issuer == nil {
+			return chain, fmt.Errorf("no issuer found for %q: %w", last.Subject.String(), ErrPartialChain)
+		}
+
+		chain = append(chain, issuer)
+	}
+
+	return chain, errors.New("certificate chain too long")
+}
+
+// Signer implements the Identity interface.
+func (i *pkcs12Identity) Signer() (crypto.Signer, error) {
+	if i.closed {
+		return nil, ErrClosed
+	}
+
+	if signer := testSigner(i.store.cert); signer != nil {
+		return signer, nil
+	}
+
+	return pkcs12Signer{i.store.signer}, nil
+}
+
+// pkcs12Signer wraps a decoded private key to record spans around signing.
+type pkcs12Signer struct {
+	crypto.Signer
+}
+
+// Sign implements the crypto.Signer interface.
+func (s pkcs12Signer) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) (_ []byte, err error) {
+	defer trace("certstore.Sign")(&err)
+
+	if opts, _, err = unwrapLittleEndianOpts(opts); err != nil {
+		return nil, err
+	}
+
+	return s.Signer.Sign(rand, digest, opts)
+}
+
+// Delete implements the Identity interface.
+func (i *pkcs12Identity) Delete() error {
+	return ErrUnsupportedOperation
+}
+
+// Close implements the Identity interface.
+func (i *pkcs12Identity) Close() {
+	i.closed = true
+}
+
+// Clone implements the Identity interface. The store is never mutated, so a
+// shallow copy is safe to hand off.
+func (i *pkcs12Identity) Clone() (Identity, error) {
+	if i.closed {
+		return nil, ErrClosed
+	}
+
+	clone := *i
+	return &clone, nil
+}
+
+// ReaderName implements the Identity interface.
+func (i *pkcs12Identity) ReaderName() (string, error) {
+	return "", ErrUnsupportedOperation
+}
+
+// KeyProviderInfo implements the Identity interface.
+func (i *pkcs12Identity) KeyProviderInfo() (ProviderInfo, error) {
+	return ProviderInfo{}, ErrUnsupportedOperation
+}
+
+// SPKIFingerprint implements the Identity interface.
+func (i *pkcs12Identity) SPKIFingerprint() ([]byte, error) {
+	if i.spki != nil {
+		return append([]byte(nil), i.spki...), nil
+	}
+
+	cert, err := i.Certificate()
+	if err != nil {
+		return nil, err
+	}
+
+	if i.spki, err = spkiFingerprint(cert); err != nil {
+		return nil, err
+	}
+
+	return append([]byte(nil), i.spki...), nil
+}
+
+// VerifyForUsage implements the Identity interface.
+func (i *pkcs12Identity) VerifyForUsage(usageOIDs []string) error {
+	return ErrUnsupportedOperation
+}
+
+// ExportCER implements the Identity interface.
+func (i *pkcs12Identity) ExportCER() ([]byte, error) {
+	return exportCER(i)
+}
+
+// SameKeyAs implements the Identity interface.
+func (i *pkcs12Identity) SameKeyAs(other Identity) (bool, error) {
+	return sameKeyAs(i, other)
+}
+
+// CAIssuersURLs implements the Identity interface.
+func (i *pkcs12Identity) CAIssuersURLs() ([]string, error) {
+	return caIssuersURLs(i)
+}
+
+// CompleteChain implements the Identity interface.
+func (i *pkcs12Identity) CompleteChain(ctx context.Context, fetch func(ctx context.Context, url string) ([]byte, error)) ([]*x509.Certificate, error) {
+	return completeChain(ctx, i, fetch)
+}
+
+// MustStaple implements the Identity interface.
+func (i *pkcs12Identity) MustStaple() (bool, error) {
+	return mustStaple(i)
+}
+
+// SetArchived implements the Identity interface.
+func (i *pkcs12Identity) SetArchived(archived bool) error {
+	return ErrUnsupportedOperation
+}
+
+// KeyInfo implements the Identity interface.
+func (i *pkcs12Identity) KeyInfo() (KeyInfo, error) {
+	return identityKeyInfo(i)
+}
+
+// Thumbprint implements the Identity interface.
+func (i *pkcs12Identity) Thumbprint() ([]byte, error) {
+	return identityThumbprint(i)
+}
+
+// ThumbprintSHA256 implements the Identity interface.
+func (i *pkcs12Identity) ThumbprintSHA256() ([]byte, error) {
+	return identityThumbprintSHA256(i)
+}
+
+// Capabilities implements the Identity interface.
+func (i *pkcs12Identity) Capabilities() (KeyCapabilities, error) {
+	return identityCapabilities(i)
+}
+
+// DisplayName implements the Identity interface.
+func (i *pkcs12Identity) DisplayName() (string, error) {
+	return subjectDisplayName(i)
+}
+
+// ExportPFX implements the Identity interface. The blob is re-encoded with the
+// given password, including the CA certificates it was opened with.
+func (i *pkcs12Identity) ExportPFX(password string) ([]byte, error) {
+	if i.closed {
+		return nil, ErrClosed
+	}
+
+	return pkcs12.Modern.Encode(i.store.signer, i.store.cert, i.store.caCerts, password)
+}
@@ -0,0 +1,77 @@
+package certstore
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"testing"
+)
+
+func TestOpenPKCS12(t *testing.T) {
+	if _, err := OpenPKCS12(leafRSA.PFX("asdf"), "wrong"); err == nil {
+		t.Fatal("expected error with wrong password")
+	}
+
+	store, err := OpenPKCS12(leafRSA.PFX("asdf"), "asdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idents, err := store.Identities()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idents) != 1 {
+		t.Fatalf("expected 1 identity, got %d", len(idents))
+	}
+	ident := idents[0]
+	defer ident.Close()
+
+	crt, err := ident.Certificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !crt.Equal(leafRSA.Certificate) {
+		t.Fatal("unexpected certificate")
+	}
+
+	signer, err := ident.Signer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest := sha256.Sum256([]byte("hello"))
+	sig, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rsa.VerifyPKCS1v15(leafRSA.Certificate.PublicKey.(*rsa.PublicKey), crypto.SHA256, digest[:], sig); err != nil {
+		t.Fatal(err)
+	}
+
+	// LittleEndianOpts has no effect here, but mustn't hide PSS options.
+	if sig, err = signer.Sign(rand.Reader, digest[:], &LittleEndianOpts{crypto.SHA256}); err != nil {
+		t.Fatal(err)
+	}
+	if err = rsa.VerifyPKCS1v15(leafRSA.Certificate.PublicKey.(*rsa.PublicKey), crypto.SHA256, digest[:], sig); err != nil {
+		t.Fatal(err)
+	}
+	pssOpts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+	if _, err = signer.Sign(rand.Reader, digest[:], LittleEndianOpts{pssOpts}); !errors.Is(err, ErrUnsupportedOperation) {
+		t.Fatalf("expected ErrUnsupportedOperation for LittleEndianOpts wrapping PSS, got %v", err)
+	}
+
+	if err = store.Import(leafEC.PFX("asdf"), "asdf"); err != ErrUnsupportedOperation {
+		t.Fatalf("expected ErrUnsupportedOperation from Import, got %v", err)
+	}
+	if err = ident.Delete(); err != ErrUnsupportedOperation {
+		t.Fatalf("expected ErrUnsupportedOperation from Delete, got %v", err)
+	}
+
+	store.Close()
+	if _, err = store.Identities(); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
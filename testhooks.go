@@ -0,0 +1,47 @@
+//go:build certstore_testhooks
+// +build certstore_testhooks
+
+package certstore
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/hex"
+	"sync"
+)
+
+// This file is only built with the certstore_testhooks build tag. It is for
+// testing only and must never be used in production builds.
+
+var (
+	testSignersMu sync.RWMutex
+	testSigners   = map[string]crypto.Signer{}
+)
+
+// SetTestSigner makes Identity.Signer return signer for the certificate with
+// the given SHA-1 thumbprint instead of its real private key. This lets code
+// built on this package (e.g. TLS identity selection or CSR building) be tested
+// without hardware and with reproducible signatures. Passing a nil signer
+// removes the override.
+//
+// SetTestSigner is only available with the certstore_testhooks build tag and is
+// for testing only.
+func SetTestSigner(thumbprint []byte, signer crypto.Signer) {
+	testSignersMu.Lock()
+	defer testSignersMu.Unlock()
+
+	if signer == nil {
+		delete(testSigners, hex.EncodeToString(thumbprint))
+	} else {
+		testSigners[hex.EncodeToString(thumbprint)] = signer
+	}
+}
+
+// testSigner gets the signer set for the certificate with SetTestSigner, if
+// any.
+func testSigner(cert *x509.Certificate) crypto.Signer {
+	testSignersMu.RLock()
+	defer testSignersMu.RUnlock()
+
+	return testSigners[hex.EncodeToString(thumbprint(cert))]
+}
@@ -0,0 +1,23 @@
+//go:build certstore_testhooks
+// +build certstore_testhooks
+
+package certstore
+
+import "testing"
+
+func TestSetTestSigner(t *testing.T) {
+	withIdentity(t, leafEC, func(ident Identity) {
+		tp := thumbprint(leafEC.Certificate)
+
+		SetTestSigner(tp, leafKeyEC)
+		defer SetTestSigner(tp, nil)
+
+		signer, err := ident.Signer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if signer != leafKeyEC {
+			t.Fatal("expected test signer")
+		}
+	})
+}